@@ -1,7 +1,9 @@
 package api
 
 import (
+	"context"
 	"github.com/gin-gonic/gin"
+	"github.com/wuranxu/light/internal/service/etcd"
 	"github.com/wuranxu/light/service"
 )
 
@@ -13,6 +15,24 @@ func NewRouter(app *gin.Engine) *PityGatewayRouter {
 	return &PityGatewayRouter{app: app}
 }
 
+// AddRestRoutes serves the REST routes declared by the google.api.http options of the registered
+// methods, they run before the routes of AddRoute but templates matching the calls of other methods or
+// the OpenAPI document are skipped. gin can not drop routes, so they are kept in a table rebuilt by
+// WatchRegistry. Call it before AddRoute.
+func (p *PityGatewayRouter) AddRestRoutes() {
+	p.app.Use(service.RestHandler)
+}
+
+// AddOpenAPI serves the OpenAPI document of the registered methods, it is regenerated by WatchRegistry
+func (p *PityGatewayRouter) AddOpenAPI() {
+	p.app.GET(service.OpenAPIPath, service.OpenAPI)
+}
+
+// WatchRegistry rebuilds the REST routes and the OpenAPI document in the background until ctx is done
+func (p *PityGatewayRouter) WatchRegistry(ctx context.Context) {
+	go service.WatchRegistry(ctx, etcd.Cli)
+}
+
 func (p *PityGatewayRouter) AddRoute() {
 	p.app.GET("/", func(context *gin.Context) {
 		context.String(200, "hello, pity gateway!")
@@ -23,5 +43,7 @@ func (p *PityGatewayRouter) AddRoute() {
 
 	//p.app.POST("/:version/:service/:method", service.CallRpc)
 	p.app.POST("/:version/:service/:method", service.Invoke)
+	// calls bound from the query string, websocket upgrades for streaming methods
+	p.app.GET("/:version/:service/:method", service.Invoke)
 
 }
@@ -26,21 +26,177 @@ type SqlConfig struct {
 	LogMode  bool   `json:"log_mode"`
 }
 
+type PoolConfig struct {
+	// IdleTimeout seconds a service connection may stay unused before it is closed, 0 keeps it forever
+	IdleTimeout int64 `yaml:"idle_timeout"`
+}
+
+type GatewayConfig struct {
+	// LegacyErrors always answers http 200 with the error in the envelope, as the old frontend expects
+	LegacyErrors bool `yaml:"legacy_errors"`
+	// DefaultTimeout milliseconds a call may take when neither the method nor the client sets one
+	DefaultTimeout int64 `yaml:"default_timeout"`
+	// MaxTimeout the largest timeout in milliseconds a client may ask for, unless the method allows more
+	MaxTimeout int64 `yaml:"max_timeout"`
+	// MaxBodySize the largest body in bytes of a grpc-web or connect call and of a single message of their
+	// streams, defaults to 4MB
+	MaxBodySize int64 `yaml:"max_body_size"`
+	// AllowedOrigins origins of the pages that may open websockets besides the gateway host, * allows any
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+// RetryPolicy how calls of idempotent methods are retried, zero fields fall back to the gateway policy
+type RetryPolicy struct {
+	MaxAttempts int `yaml:"max_attempts" json:"max_attempts,omitempty"`
+	// InitialBackoff milliseconds to wait before the first retry
+	InitialBackoff int64 `yaml:"initial_backoff" json:"initial_backoff,omitempty"`
+	// MaxBackoff milliseconds the wait between retries never exceeds
+	MaxBackoff        int64   `yaml:"max_backoff" json:"max_backoff,omitempty"`
+	BackoffMultiplier float64 `yaml:"backoff_multiplier" json:"backoff_multiplier,omitempty"`
+	// RetryableCodes grpc codes worth another attempt, like UNAVAILABLE
+	RetryableCodes []string `yaml:"retryable_codes" json:"retryable_codes,omitempty"`
+}
+
+// OutlierConfig when a backend address is ejected, durations are milliseconds, zero fields use defaults
+type OutlierConfig struct {
+	// ConsecutiveFailures failures in a row that eject an address
+	ConsecutiveFailures int `yaml:"consecutive_failures"`
+	// ErrorRate failure ratio within Interval that ejects an address, once MinRequests were seen
+	ErrorRate   float64 `yaml:"error_rate"`
+	MinRequests int     `yaml:"min_requests"`
+	// SlowLatency average latency that ejects an address, 0 disables latency ejection
+	SlowLatency int64 `yaml:"slow_latency"`
+	Interval    int64 `yaml:"interval"`
+	// BaseEjection grows with every ejection of the same address up to MaxEjection
+	BaseEjection int64 `yaml:"base_ejection"`
+	MaxEjection  int64 `yaml:"max_ejection"`
+}
+
+// BreakerConfig when the circuit breaker of a service opens, durations are milliseconds
+type BreakerConfig struct {
+	Disabled bool `yaml:"disabled"`
+	// ConsecutiveFailures failures in a row that open the circuit
+	ConsecutiveFailures int `yaml:"consecutive_failures"`
+	// Cooldown time the circuit stays open before a probe call is let through
+	Cooldown int64 `yaml:"cooldown"`
+}
+
+// LocalityConfig keeps calls in the zone of the gateway while the zone has enough healthy capacity
+type LocalityConfig struct {
+	// Zone the zone of this gateway replica, empty balances over every zone
+	Zone string `yaml:"zone"`
+	// MinHealthy share of the weight of the local instances that has to be healthy, below it calls
+	// spill over to the other zones. Defaults to 0.5
+	MinHealthy float64 `yaml:"min_healthy"`
+}
+
+// ProxyConfig the listener proxying native grpc calls to the backends without transcoding them
+type ProxyConfig struct {
+	// Port of the grpc listener, 0 disables it
+	Port int `yaml:"port"`
+	// CertFile and KeyFile serve tls, without them the listener speaks h2c
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// DefaultVersion the version of calls without a x-api-version header
+	DefaultVersion string `yaml:"default_version"`
+}
+
+// UploadConfig limits of form bodies and uploaded files, sizes are bytes, zero fields use defaults
+type UploadConfig struct {
+	// MaxRequestSize the largest form bound into the request of a unary call, defaults to 32MB
+	MaxRequestSize int64 `yaml:"max_request_size"`
+	// MaxFileSize the largest file bound into the request of a unary call, defaults to 10MB
+	MaxFileSize int64 `yaml:"max_file_size"`
+	// MaxStreamSize the largest form streamed to a client streaming method, defaults to 1GB
+	MaxStreamSize int64 `yaml:"max_stream_size"`
+	// ChunkSize the size of the chunks files are streamed in, defaults to 64KB
+	ChunkSize int `yaml:"chunk_size"`
+}
+
+type CacheConfig struct {
+	// DescriptorTTL seconds method descriptors are cached, 0 caches them until the backend changes
+	DescriptorTTL int64 `yaml:"descriptor_ttl"`
+}
+
+const (
+	// SourceReflection descriptors come from the grpc reflection api of the backend
+	SourceReflection = "reflection"
+	// SourceFile descriptors come from protoset or .proto files only
+	SourceFile = "file"
+	// SourceFallback reflection first, files when the backend does not support reflection
+	SourceFallback = "fallback"
+)
+
+type DescriptorConfig struct {
+	// Source one of reflection, file, fallback. Defaults to fallback when files are configured
+	Source      string   `yaml:"source"`
+	ProtoSets   []string `yaml:"protosets"`
+	ProtoDirs   []string `yaml:"proto_dirs"`
+	ImportPaths []string `yaml:"import_paths"`
+}
+
 type Config struct {
 	Etcd EtcdConfig `yaml:"etcd"`
 	//Database SqlConfig  `json:"database"`
-	Scheme string `yaml:"scheme"`
+	Scheme  string        `yaml:"scheme"`
+	Gateway GatewayConfig `yaml:"gateway"`
+	Pool    PoolConfig    `yaml:"pool"`
+	Cache   CacheConfig   `yaml:"cache"`
+	Retry   RetryPolicy   `yaml:"retry"`
+	Outlier OutlierConfig `yaml:"outlier"`
+	Breaker BreakerConfig `yaml:"breaker"`
+	// Locality zone aware balancing
+	Locality LocalityConfig `yaml:"locality"`
+	Proxy    ProxyConfig    `yaml:"proxy"`
+	Upload   UploadConfig   `yaml:"upload"`
+	// Descriptors descriptor sources by service name, services not listed use reflection
+	Descriptors map[string]DescriptorConfig `yaml:"descriptors"`
 }
 
 type YamlConfig struct {
-	Service string        `yaml:"service"`
-	Version string        `yaml:"version"`
-	Port    int           `yaml:"port"`
-	Method  map[string]Md `yaml:"method"`
+	Service  string         `yaml:"service"`
+	Version  string         `yaml:"version"`
+	Port     int            `yaml:"port"`
+	Method   map[string]Md  `yaml:"method"`
+	Instance InstanceConfig `yaml:"instance"`
+	// HashKey routes every method of the service by consistent hashing, see Md.HashKey
+	HashKey string `yaml:"hash_key"`
+}
+
+// InstanceConfig metadata registered with every instance of a service
+type InstanceConfig struct {
+	// Weight share of the traffic, 0 drains the instance, nil uses the default weight
+	Weight *int              `yaml:"weight"`
+	Zone   string            `yaml:"zone"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+// DownloadConfig answers a method with the raw bytes of a field of its response instead of json.
+// ContentType and Filename are fixed values or field:<name> for a string field of the response.
+type DownloadConfig struct {
+	// Field the bytes field written as the body, defaults to data like google.api.HttpBody
+	Field string `yaml:"field" json:"field,omitempty"`
+	// ContentType defaults to field:content_type, application/octet-stream without such a field
+	ContentType string `yaml:"content_type" json:"content_type,omitempty"`
+	// Filename the name the file is saved as, defaults to field:filename
+	Filename string `yaml:"filename" json:"filename,omitempty"`
 }
 
 type Md struct {
 	Authorization bool `yaml:"authorization"`
+	// Timeout default timeout of the method in milliseconds
+	Timeout int64 `yaml:"timeout"`
+	// MaxTimeout the largest timeout a client may ask for in milliseconds
+	MaxTimeout int64 `yaml:"max_timeout"`
+	// Idempotent calls may be retried by the gateway
+	Idempotent bool         `yaml:"idempotent"`
+	Retry      *RetryPolicy `yaml:"retry"`
+	// HashKey sends calls with the same key to the same instance: user for the id of the logged in
+	// user, header:<name> for a request header or field:<path> for a field of the json body
+	HashKey string `yaml:"hash_key"`
+	// Download answers with the bytes of a response field as a file, methods answering
+	// google.api.HttpBody do so without it
+	Download *DownloadConfig `yaml:"download"`
 }
 
 func ParseConfig(filepath string, cfg interface{}) error {
@@ -0,0 +1,132 @@
+package balancer
+
+import (
+	"errors"
+	"github.com/wuranxu/light/conf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerFailures = 10
+	defaultCooldown        = 5 * time.Second
+)
+
+var (
+	// ErrCircuitOpen a call rejected by the circuit breaker of its service
+	ErrCircuitOpen = status.Error(codes.Unavailable, "circuit breaker is open")
+	// ErrNoHealthyBackend every address of the service is ejected
+	ErrNoHealthyBackend = status.Error(codes.Unavailable, "no healthy backend available")
+)
+
+// Rejected tells whether err comes from the gateway refusing to call the service at all
+func Rejected(err error) bool {
+	return errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrNoHealthyBackend) || errors.Is(err, ErrDrained) || errors.Is(err, ErrNoVersion)
+}
+
+type breakerState int
+
+const (
+	Closed breakerState = iota
+	Open
+	HalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// Breaker the circuit breaker of a service. It opens after too many failures in a row and rejects
+// every call until the cooldown passed, then a single probe call decides whether it closes again.
+type Breaker struct {
+	lock     sync.Mutex
+	config   func() conf.BreakerConfig
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	now      func() time.Time
+}
+
+func NewBreaker(config func() conf.BreakerConfig) *Breaker {
+	return &Breaker{config: config, now: time.Now}
+}
+
+func (b *Breaker) settings() (bool, int, time.Duration) {
+	cfg := b.config()
+	failures, cooldown := cfg.ConsecutiveFailures, millis(cfg.Cooldown)
+	if failures <= 0 {
+		failures = defaultBreakerFailures
+	}
+	if cooldown <= 0 {
+		cooldown = defaultCooldown
+	}
+	return cfg.Disabled, failures, cooldown
+}
+
+// Allow tells whether a call may go ahead, every allowed call must be followed by Record
+func (b *Breaker) Allow() bool {
+	disabled, _, cooldown := b.settings()
+	if disabled {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case Open:
+		if b.now().Sub(b.openedAt) < cooldown {
+			return false
+		}
+		b.state = HalfOpen
+		b.probing = true
+		return true
+	case HalfOpen:
+		// one probe at a time
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// Record accounts the result of an allowed call
+func (b *Breaker) Record(err error) {
+	disabled, threshold, _ := b.settings()
+	if disabled {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !Failed(err) {
+		b.state, b.failures, b.probing = Closed, 0, false
+		return
+	}
+	b.failures++
+	if b.state == HalfOpen || b.failures >= threshold {
+		b.state, b.openedAt, b.probing = Open, b.now(), false
+	}
+}
+
+// Abandon ends an allowed call without accounting it, its result says nothing about the service
+func (b *Breaker) Abandon() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probing = false
+}
+
+// State returns the current state of the breaker
+func (b *Breaker) State() breakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
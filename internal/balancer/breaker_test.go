@@ -0,0 +1,76 @@
+package balancer
+
+import (
+	"github.com/wuranxu/light/conf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	c := &clock{t: time.Unix(1600000000, 0)}
+	cfg := conf.BreakerConfig{ConsecutiveFailures: 3, Cooldown: 1000}
+	b := NewBreaker(func() conf.BreakerConfig { return cfg })
+	b.now = c.now
+
+	for i := 0; i < 2; i++ {
+		if !b.Allow() {
+			t.Fatal("expected a closed breaker")
+		}
+		b.Record(unavailable)
+	}
+	b.Allow()
+	b.Record(status.Error(codes.InvalidArgument, "bad request"))
+	for i := 0; i < 3; i++ {
+		b.Allow()
+		b.Record(unavailable)
+	}
+	if b.State() != Open || b.Allow() {
+		t.Fatalf("expected an open breaker, got %v", b.State())
+	}
+
+	c.sleep(time.Second)
+	if !b.Allow() || b.State() != HalfOpen {
+		t.Fatalf("expected a probe after the cooldown, got %v", b.State())
+	}
+	if b.Allow() {
+		t.Fatal("expected a single probe at a time")
+	}
+	b.Record(unavailable)
+	if b.State() != Open || b.Allow() {
+		t.Fatalf("expected a failed probe to open the breaker again, got %v", b.State())
+	}
+
+	c.sleep(time.Second)
+	b.Allow()
+	b.Record(nil)
+	if b.State() != Closed || !b.Allow() {
+		t.Fatalf("expected a successful probe to close the breaker, got %v", b.State())
+	}
+
+	cfg.Disabled = true
+	for i := 0; i < 10; i++ {
+		b.Record(unavailable)
+	}
+	if !b.Allow() {
+		t.Fatal("expected a disabled breaker to let everything through")
+	}
+}
+
+func TestBreaker_Abandon(t *testing.T) {
+	c := &clock{t: time.Unix(1600000000, 0)}
+	b := NewBreaker(func() conf.BreakerConfig { return conf.BreakerConfig{ConsecutiveFailures: 1, Cooldown: 1000} })
+	b.now = c.now
+	b.Allow()
+	b.Record(unavailable)
+	c.sleep(time.Second)
+	if !b.Allow() {
+		t.Fatal("expected a probe after the cooldown")
+	}
+	// the probe ran out of the deadline of its client, the next call probes instead
+	b.Abandon()
+	if !b.Allow() || b.State() != HalfOpen {
+		t.Fatalf("expected another probe, got %v", b.State())
+	}
+}
@@ -0,0 +1,24 @@
+package balancer
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type clientDeadlineKey struct{}
+
+// WithClientDeadline marks the deadline of ctx as shortened by the client. Calls running out of it are
+// left out of the health accounting, any client could eject healthy backends otherwise.
+func WithClientDeadline(ctx context.Context) context.Context {
+	return context.WithValue(ctx, clientDeadlineKey{}, true)
+}
+
+// ClientDeadline tells whether err is the deadline of the client running out
+func ClientDeadline(ctx context.Context, err error) bool {
+	if ctx == nil || status.Code(err) != codes.DeadlineExceeded {
+		return false
+	}
+	marked, _ := ctx.Value(clientDeadlineKey{}).(bool)
+	return marked
+}
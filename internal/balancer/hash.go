@@ -0,0 +1,81 @@
+package balancer
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// replicas points every backend gets on the ring, enough to spread the keys evenly
+const replicas = 160
+
+type hashKey struct{}
+
+// WithHashKey returns a context whose calls go to the backend owning key on the hash ring, calls with
+// the same key keep going to the same backend while it is available
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKey{}, key)
+}
+
+func hashKeyFrom(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	key, ok := ctx.Value(hashKey{}).(string)
+	return key, ok
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// fnv alone clusters similar strings like addr#1 and addr#2, mix the bits once more
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+type point struct {
+	hash    uint64
+	backend *backend
+}
+
+// ring a consistent hash ring, points only depend on the address of their backend so a backend
+// joining or leaving only moves the keys it owns
+type ring []point
+
+func newRing(backends []*backend) ring {
+	r := make(ring, 0, len(backends)*replicas)
+	for _, b := range backends {
+		for i := 0; i < replicas; i++ {
+			r = append(r, point{hash: hash(b.addr + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].hash < r[j].hash })
+	return r
+}
+
+// get returns the first backend clockwise from key that is available
+func (r ring) get(key string, available func(*backend) bool) *backend {
+	if len(r) == 0 {
+		return nil
+	}
+	h := hash(key)
+	start := sort.Search(len(r), func(i int) bool { return r[i].hash >= h })
+	tried := make(map[*backend]bool)
+	for i := 0; i < len(r); i++ {
+		b := r[(start+i)%len(r)].backend
+		if tried[b] {
+			continue
+		}
+		if available(b) {
+			return b
+		}
+		tried[b] = true
+	}
+	return nil
+}
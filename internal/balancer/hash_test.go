@@ -0,0 +1,65 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/service/etcd"
+	gb "google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/resolver"
+	"testing"
+)
+
+func owners(t *testing.T, p gb.Picker, keys int) map[string]string {
+	owner := make(map[string]string, keys)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		res, err := p.Pick(gb.PickInfo{Ctx: WithHashKey(context.Background(), key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		owner[key] = res.SubConn.(*fakeSubConn).addr
+		res.Done(gb.DoneInfo{})
+	}
+	return owner
+}
+
+func TestPicker_ConsistentHash(t *testing.T) {
+	detector, _ := newDetector(conf.OutlierConfig{})
+	var addrs []resolver.Address
+	for i := 0; i < 5; i++ {
+		addrs = append(addrs, etcd.Instance{Addr: fmt.Sprintf("10.0.0.%d:8080", i), Weight: 100}.Address())
+	}
+	before := owners(t, buildPicker(detector, conf.LocalityConfig{}, addrs...), 1000)
+	if again := owners(t, buildPicker(detector, conf.LocalityConfig{}, addrs...), 1000); fmt.Sprint(again) != fmt.Sprint(before) {
+		t.Fatal("expected every key to keep its backend")
+	}
+	share := make(map[string]int)
+	for _, addr := range before {
+		share[addr]++
+	}
+	for addr, n := range share {
+		if n < 100 || n > 300 {
+			t.Fatalf("expected an even spread, %s owns %d of 1000 keys", addr, n)
+		}
+	}
+
+	// only the keys of a leaving backend move
+	after := owners(t, buildPicker(detector, conf.LocalityConfig{}, addrs[1:]...), 1000)
+	for key, addr := range before {
+		if addr != addrs[0].Addr && after[key] != addr {
+			t.Fatalf("expected %s to stay on %s, moved to %s", key, addr, after[key])
+		}
+	}
+
+	// the keys of an ejected backend are served by the next one on the ring meanwhile
+	p := buildPicker(detector, conf.LocalityConfig{}, addrs...)
+	for i := 0; i < defaultConsecutiveFailures; i++ {
+		detector.Record(addrs[0].Addr, unavailable, 0)
+	}
+	for key, addr := range owners(t, p, 1000) {
+		if addr == addrs[0].Addr || (before[key] != addrs[0].Addr && addr != before[key]) {
+			t.Fatalf("expected only the keys of the ejected backend to move, %s went to %s", key, addr)
+		}
+	}
+}
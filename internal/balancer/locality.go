@@ -0,0 +1,84 @@
+package balancer
+
+import (
+	"context"
+	"sync"
+)
+
+const defaultMinHealthy = 0.5
+
+// Served the backend that served a call, the last attempt wins
+type Served struct {
+	lock    sync.Mutex
+	addr    string
+	zone    string
+	version string
+}
+
+type servedKey struct{}
+
+// WithServed returns a context whose calls report the backend that served them in Served
+func WithServed(ctx context.Context) (context.Context, *Served) {
+	s := new(Served)
+	return context.WithValue(ctx, servedKey{}, s), s
+}
+
+func servedFrom(ctx context.Context) *Served {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(servedKey{}).(*Served)
+	return s
+}
+
+func (s *Served) set(addr, zone, version string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.addr, s.zone, s.version = addr, zone, version
+}
+
+// Addr the address of the backend, empty when no backend was picked
+func (s *Served) Addr() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.addr
+}
+
+// Version the version the backend served, empty for untagged backends of calls asking for none
+func (s *Served) Version() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.version
+}
+
+// Zone the zone the backend is registered in
+func (s *Served) Zone() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.zone
+}
+
+// local narrows available down to the backends of zone, as long as at least minHealthy of the weight
+// of the zone is available. Otherwise it returns nil and calls spill over to every zone.
+func local(backends, available []*backend, zone string, minHealthy float64) []*backend {
+	if minHealthy <= 0 {
+		minHealthy = defaultMinHealthy
+	}
+	total, healthy := 0, 0
+	for _, b := range backends {
+		if b.zone == zone {
+			total += b.weight
+		}
+	}
+	var candidates []*backend
+	for _, b := range available {
+		if b.zone == zone {
+			healthy += b.weight
+			candidates = append(candidates, b)
+		}
+	}
+	if healthy == 0 || float64(healthy) < minHealthy*float64(total) {
+		return nil
+	}
+	return candidates
+}
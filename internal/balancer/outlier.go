@@ -0,0 +1,247 @@
+package balancer
+
+import (
+	"errors"
+	"github.com/wuranxu/light/conf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConsecutiveFailures = 5
+	defaultErrorRate           = 0.5
+	defaultMinRequests         = 20
+	defaultInterval            = 10 * time.Second
+	defaultBaseEjection        = 30 * time.Second
+	defaultMaxEjection         = 5 * time.Minute
+	// latencyWeight weight of the newest sample in the latency average
+	latencyWeight = 0.2
+)
+
+var (
+	// Outliers health accounting of every backend address the gateway talks to
+	Outliers = NewOutlierDetector(func() conf.OutlierConfig { return conf.Conf.Outlier })
+)
+
+// Failed tells whether err says something about the health of the backend, business errors like
+// NotFound mean the backend is doing fine
+func Failed(err error) bool {
+	if errors.Is(err, ErrNoVersion) {
+		// a split to a version nobody serves, the backends are fine
+		return false
+	}
+	stat, ok := status.FromError(err)
+	if err == nil || !ok {
+		// nil, or an error of the gateway itself
+		return false
+	}
+	switch stat.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown, codes.DataLoss:
+		return true
+	}
+	return false
+}
+
+type outlierSettings struct {
+	consecutive  int
+	errorRate    float64
+	minRequests  int
+	slowLatency  time.Duration
+	interval     time.Duration
+	baseEjection time.Duration
+	maxEjection  time.Duration
+}
+
+func settingsOf(cfg conf.OutlierConfig) outlierSettings {
+	s := outlierSettings{
+		consecutive:  cfg.ConsecutiveFailures,
+		errorRate:    cfg.ErrorRate,
+		minRequests:  cfg.MinRequests,
+		slowLatency:  millis(cfg.SlowLatency),
+		interval:     millis(cfg.Interval),
+		baseEjection: millis(cfg.BaseEjection),
+		maxEjection:  millis(cfg.MaxEjection),
+	}
+	if s.consecutive <= 0 {
+		s.consecutive = defaultConsecutiveFailures
+	}
+	if s.errorRate <= 0 {
+		s.errorRate = defaultErrorRate
+	}
+	if s.minRequests <= 0 {
+		s.minRequests = defaultMinRequests
+	}
+	if s.interval <= 0 {
+		s.interval = defaultInterval
+	}
+	if s.baseEjection <= 0 {
+		s.baseEjection = defaultBaseEjection
+	}
+	if s.maxEjection <= 0 {
+		s.maxEjection = defaultMaxEjection
+	}
+	return s
+}
+
+func millis(ms int64) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+// AddrStats a snapshot of the health of an address
+type AddrStats struct {
+	Requests    int
+	Failures    int
+	Consecutive int
+	Latency     time.Duration
+	Ejected     bool
+	Ejections   int
+}
+
+type addrStats struct {
+	windowStart  time.Time
+	requests     int
+	failures     int
+	consecutive  int
+	latency      float64
+	ejectedUntil time.Time
+	ejections    int
+	// probing an ejected address whose ejection has run out, its next result decides
+	probing bool
+	// users the balancers resolving the address, a process may serve several services
+	users int
+}
+
+// OutlierDetector counts results per address and ejects addresses that fail too often. An ejected
+// address comes back half open once its ejection ran out: the next call decides whether it stays.
+type OutlierDetector struct {
+	lock   sync.Mutex
+	config func() conf.OutlierConfig
+	addrs  map[string]*addrStats
+	now    func() time.Time
+}
+
+func NewOutlierDetector(config func() conf.OutlierConfig) *OutlierDetector {
+	return &OutlierDetector{config: config, addrs: make(map[string]*addrStats), now: time.Now}
+}
+
+func (o *OutlierDetector) stats(addr string) *addrStats {
+	s, ok := o.addrs[addr]
+	if !ok {
+		s = &addrStats{windowStart: o.now()}
+		o.addrs[addr] = s
+	}
+	return s
+}
+
+// Available tells whether addr may receive calls
+func (o *OutlierDetector) Available(addr string) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	s, ok := o.addrs[addr]
+	if !ok || s.ejectedUntil.IsZero() {
+		return true
+	}
+	if o.now().Before(s.ejectedUntil) {
+		return false
+	}
+	// half open, let calls through until one of them reports back
+	s.probing = true
+	return true
+}
+
+// Record accounts the result of a call to addr
+func (o *OutlierDetector) Record(addr string, err error, latency time.Duration) {
+	settings := settingsOf(o.config())
+	failed := Failed(err)
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	now := o.now()
+	s := o.stats(addr)
+	if now.Sub(s.windowStart) >= settings.interval {
+		if s.failures == 0 && s.ejectedUntil.IsZero() {
+			// a clean window forgives earlier ejections
+			s.ejections = 0
+		}
+		s.windowStart, s.requests, s.failures = now, 0, 0
+	}
+	s.requests++
+	if s.latency == 0 {
+		s.latency = float64(latency)
+	} else {
+		s.latency = (1-latencyWeight)*s.latency + latencyWeight*float64(latency)
+	}
+	if !failed {
+		s.consecutive = 0
+		if s.probing {
+			// the address recovered
+			s.probing = false
+			s.ejectedUntil = time.Time{}
+		}
+		if settings.slowLatency > 0 && s.requests >= settings.minRequests && time.Duration(s.latency) > settings.slowLatency {
+			o.eject(s, settings, now)
+		}
+		return
+	}
+	s.failures++
+	s.consecutive++
+	switch {
+	case s.probing:
+	case s.consecutive >= settings.consecutive:
+	case s.requests >= settings.minRequests && float64(s.failures)/float64(s.requests) >= settings.errorRate:
+	default:
+		return
+	}
+	o.eject(s, settings, now)
+}
+
+func (o *OutlierDetector) eject(s *addrStats, settings outlierSettings, now time.Time) {
+	s.ejections++
+	ejection := settings.baseEjection * time.Duration(s.ejections)
+	if ejection > settings.maxEjection {
+		ejection = settings.maxEjection
+	}
+	s.ejectedUntil = now.Add(ejection)
+	s.probing = false
+	s.consecutive = 0
+	s.windowStart, s.requests, s.failures = now, 0, 0
+	s.latency = 0
+}
+
+// Stats returns the health of addr
+func (o *OutlierDetector) Stats(addr string) AddrStats {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	s, ok := o.addrs[addr]
+	if !ok {
+		return AddrStats{}
+	}
+	return AddrStats{
+		Requests:    s.requests,
+		Failures:    s.failures,
+		Consecutive: s.consecutive,
+		Latency:     time.Duration(s.latency),
+		Ejected:     !s.ejectedUntil.IsZero() && o.now().Before(s.ejectedUntil),
+		Ejections:   s.ejections,
+	}
+}
+
+// Track tells that a balancer resolves addr, what is known about it is kept until the last of them forgets it
+func (o *OutlierDetector) Track(addr string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.stats(addr).users++
+}
+
+// Forget drops everything known about addr once no balancer resolves it any more, like when it is deregistered
+func (o *OutlierDetector) Forget(addr string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if s, ok := o.addrs[addr]; ok {
+		if s.users--; s.users > 0 {
+			return
+		}
+		delete(o.addrs, addr)
+	}
+}
@@ -0,0 +1,220 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"github.com/wuranxu/light/conf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// clock a fake time source the tests move by hand
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func (c *clock) sleep(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newDetector(cfg conf.OutlierConfig) (*OutlierDetector, *clock) {
+	c := &clock{t: time.Unix(1600000000, 0)}
+	o := NewOutlierDetector(func() conf.OutlierConfig { return cfg })
+	o.now = c.now
+	return o, c
+}
+
+var unavailable = status.Error(codes.Unavailable, "connection refused")
+
+func TestFailed(t *testing.T) {
+	cases := map[error]bool{
+		nil:                                      false,
+		unavailable:                              true,
+		status.Error(codes.DeadlineExceeded, ""): true,
+		status.Error(codes.NotFound, "no user"):  false,
+		errors.New("malformed json"):             false,
+	}
+	for err, expected := range cases {
+		if Failed(err) != expected {
+			t.Fatalf("%v: expected %v", err, expected)
+		}
+	}
+}
+
+func TestOutlierDetector_Consecutive(t *testing.T) {
+	o, c := newDetector(conf.OutlierConfig{ConsecutiveFailures: 3, BaseEjection: 1000, MaxEjection: 1500})
+	addr := "10.0.0.1:8080"
+	for i := 0; i < 2; i++ {
+		o.Record(addr, unavailable, time.Millisecond)
+	}
+	o.Record(addr, status.Error(codes.NotFound, "no user"), time.Millisecond)
+	o.Record(addr, unavailable, time.Millisecond)
+	if !o.Available(addr) {
+		t.Fatal("business errors break a streak of failures")
+	}
+	o.Record(addr, unavailable, time.Millisecond)
+	o.Record(addr, unavailable, time.Millisecond)
+	if o.Available(addr) || !o.Stats(addr).Ejected {
+		t.Fatal("expected the address to be ejected")
+	}
+
+	c.sleep(time.Second)
+	if !o.Available(addr) {
+		t.Fatal("expected the address to be half open after its ejection")
+	}
+	// a failed probe ejects again, for longer but never beyond the max ejection
+	o.Record(addr, unavailable, time.Millisecond)
+	c.sleep(time.Second)
+	if o.Available(addr) {
+		t.Fatal("expected a longer second ejection")
+	}
+	c.sleep(500 * time.Millisecond)
+	if !o.Available(addr) {
+		t.Fatal("expected the ejection to be capped")
+	}
+	o.Record(addr, nil, time.Millisecond)
+	if !o.Available(addr) || o.Stats(addr).Ejected {
+		t.Fatal("expected a successful probe to bring the address back")
+	}
+}
+
+func TestOutlierDetector_ErrorRate(t *testing.T) {
+	o, c := newDetector(conf.OutlierConfig{ConsecutiveFailures: 100, ErrorRate: 0.5, MinRequests: 10, Interval: 1000})
+	addr := "10.0.0.2:8080"
+	// below the minimum number of requests nothing happens
+	for i := 0; i < 4; i++ {
+		o.Record(addr, unavailable, time.Millisecond)
+		o.Record(addr, nil, time.Millisecond)
+	}
+	if !o.Available(addr) {
+		t.Fatal("expected too few requests to keep the address")
+	}
+	// a new window forgets the old results
+	c.sleep(time.Second)
+	o.Record(addr, nil, time.Millisecond)
+	if s := o.Stats(addr); s.Requests != 1 || s.Failures != 0 {
+		t.Fatalf("expected a fresh window, got %+v", s)
+	}
+	for i := 0; i < 9; i++ {
+		o.Record(addr, unavailable, time.Millisecond)
+	}
+	if o.Available(addr) {
+		t.Fatal("expected the error rate to eject the address")
+	}
+}
+
+func TestOutlierDetector_SlowLatency(t *testing.T) {
+	o, _ := newDetector(conf.OutlierConfig{SlowLatency: 100, MinRequests: 5})
+	addr := "10.0.0.3:8080"
+	for i := 0; i < 5; i++ {
+		o.Record(addr, nil, 20*time.Millisecond)
+	}
+	if !o.Available(addr) {
+		t.Fatal("expected a fast address to stay")
+	}
+	for i := 0; i < 10; i++ {
+		o.Record(addr, nil, time.Second)
+	}
+	if o.Available(addr) {
+		t.Fatal("expected a slow address to be ejected")
+	}
+}
+
+// switchHealth fails every Check while down is set
+type switchHealth struct {
+	*health.Server
+	down  int32
+	calls int32
+}
+
+func (s *switchHealth) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	atomic.AddInt32(&s.calls, 1)
+	if atomic.LoadInt32(&s.down) == 1 {
+		return nil, status.Error(codes.Unavailable, "shutting down")
+	}
+	return s.Server.Check(ctx, req)
+}
+
+func startBackend(t *testing.T) (*bufconn.Listener, *switchHealth) {
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	backend := &switchHealth{Server: health.NewServer()}
+	healthpb.RegisterHealthServer(srv, backend)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis, backend
+}
+
+func TestPicker_EjectsFailingAddress(t *testing.T) {
+	listeners := make(map[string]*bufconn.Listener)
+	backends := make(map[string]*switchHealth)
+	for _, addr := range []string{"backend-a:1", "backend-b:1"} {
+		listeners[addr], backends[addr] = startBackend(t)
+		defer Outliers.Forget(addr)
+	}
+	r := manual.NewBuilderWithScheme("outlier")
+	r.InitialState(resolver.State{Addresses: []resolver.Address{{Addr: "backend-a:1"}, {Addr: "backend-b:1"}}})
+	conn, err := grpc.Dial(r.Scheme()+":///health",
+		grpc.WithResolvers(r),
+		grpc.WithDefaultServiceConfig(ServiceConfig),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return listeners[addr].Dial()
+		}),
+		grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	check := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		return err
+	}
+	// wait for both addresses to be ready
+	for atomic.LoadInt32(&backends["backend-a:1"].calls) == 0 || atomic.LoadInt32(&backends["backend-b:1"].calls) == 0 {
+		if err := check(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	atomic.StoreInt32(&backends["backend-a:1"].down, 1)
+	for i := 0; i < 2*defaultConsecutiveFailures; i++ {
+		check()
+	}
+	if !Outliers.Stats("backend-a:1").Ejected {
+		t.Fatalf("expected backend-a to be ejected, got %+v", Outliers.Stats("backend-a:1"))
+	}
+	calls := atomic.LoadInt32(&backends["backend-a:1"].calls)
+	for i := 0; i < 10; i++ {
+		if err := check(); err != nil {
+			t.Fatalf("expected the healthy backend to answer, got %v", err)
+		}
+	}
+	if got := atomic.LoadInt32(&backends["backend-a:1"].calls); got != calls {
+		t.Fatalf("expected no calls to the ejected backend, got %d more", got-calls)
+	}
+
+	atomic.StoreInt32(&backends["backend-b:1"].down, 1)
+	for i := 0; i < 2*defaultConsecutiveFailures; i++ {
+		check()
+	}
+	if err := check(); !errors.Is(err, ErrNoHealthyBackend) {
+		t.Fatalf("expected no healthy backend, got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package balancer
+
+import (
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/service/etcd"
+	gb "google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"time"
+)
+
+// Name the name of the weighted, outlier aware round robin balancer
+const Name = "light_weighted_round_robin"
+
+// ServiceConfig the service config a connection needs to balance with this package
+var ServiceConfig = `{"loadBalancingConfig": [ { "` + Name + `": {} } ]}`
+
+// ErrDrained every ready instance of the service has a weight of 0
+var ErrDrained = status.Error(codes.Unavailable, "every instance of the service is drained")
+
+func init() {
+	builder := &pickerBuilder{detector: Outliers, locality: func() conf.LocalityConfig { return conf.Conf.Locality }}
+	gb.Register(&balancerBuilder{Builder: base.NewBalancerBuilder(Name, builder, base.Config{HealthCheck: true}), detector: Outliers})
+}
+
+// balancerBuilder builds base balancers that keep the detector to the addresses they resolve
+type balancerBuilder struct {
+	gb.Builder
+	detector *OutlierDetector
+}
+
+func (b *balancerBuilder) Build(cc gb.ClientConn, opts gb.BuildOptions) gb.Balancer {
+	return &trackingBalancer{Balancer: b.Builder.Build(cc, opts), detector: b.detector, addrs: make(map[string]bool)}
+}
+
+// trackingBalancer makes the detector forget the addresses the resolver dropped, the health of
+// instances that are gone would be kept forever and given to the next instance taking their address
+type trackingBalancer struct {
+	gb.Balancer
+	detector *OutlierDetector
+	addrs    map[string]bool
+}
+
+func (b *trackingBalancer) UpdateClientConnState(state gb.ClientConnState) error {
+	addrs := make(map[string]bool, len(state.ResolverState.Addresses))
+	for _, addr := range state.ResolverState.Addresses {
+		if addrs[addr.Addr] {
+			continue
+		}
+		addrs[addr.Addr] = true
+		if !b.addrs[addr.Addr] {
+			b.detector.Track(addr.Addr)
+		}
+	}
+	for addr := range b.addrs {
+		if !addrs[addr] {
+			b.detector.Forget(addr)
+		}
+	}
+	b.addrs = addrs
+	return b.Balancer.UpdateClientConnState(state)
+}
+
+func (b *trackingBalancer) Close() {
+	for addr := range b.addrs {
+		b.detector.Forget(addr)
+	}
+	b.addrs = nil
+	b.Balancer.Close()
+}
+
+type backend struct {
+	sc      gb.SubConn
+	addr    string
+	weight  int
+	zone    string
+	version string
+	// current the running weight of the smooth weighted round robin
+	current int
+}
+
+type pickerBuilder struct {
+	detector *OutlierDetector
+	locality func() conf.LocalityConfig
+}
+
+// Build takes the weights of the instances from the metadata the etcd resolver attached to their
+// addresses, addresses without metadata get the default weight and a weight of 0 drains an address.
+func (b *pickerBuilder) Build(info base.PickerBuildInfo) gb.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(gb.ErrNoSubConnAvailable)
+	}
+	backends := make([]*backend, 0, len(info.ReadySCs))
+	for sc, scInfo := range info.ReadySCs {
+		b := &backend{sc: sc, addr: scInfo.Address.Addr, weight: etcd.DefaultWeight}
+		if ins, ok := etcd.InstanceOf(scInfo.Address); ok {
+			b.weight, b.zone, b.version = ins.Weight, ins.Zone, ins.Version
+		}
+		if b.weight <= 0 {
+			continue
+		}
+		backends = append(backends, b)
+	}
+	if len(backends) == 0 {
+		return base.NewErrPicker(ErrDrained)
+	}
+	return &picker{detector: b.detector, locality: b.locality, backends: backends, ring: newRing(backends)}
+}
+
+// picker a smooth weighted round robin over the ready addresses that are not ejected, every address
+// gets its share of the traffic without bursts. With a zone configured the addresses of that zone are
+// preferred while enough of them are healthy. Calls with a hash key go to their backend on the ring.
+// Calls asking for a version only go to the instances serving it.
+type picker struct {
+	detector *OutlierDetector
+	locality func() conf.LocalityConfig
+	backends []*backend
+	ring     ring
+
+	lock sync.Mutex
+}
+
+func (p *picker) Pick(info gb.PickInfo) (gb.PickResult, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	serves := func(*backend) bool { return true }
+	if wanted, ok := versionFrom(info.Ctx); ok {
+		match, found := serving(p.backends, wanted.version)
+		switch {
+		case found:
+			serves = match
+		case wanted.strict:
+			return gb.PickResult{}, ErrNoVersion
+		}
+		// services none of whose instances matches, like ones tagging their instances with build
+		// numbers, are not filtered at all
+	}
+	if key, ok := hashKeyFrom(info.Ctx); ok {
+		b := p.ring.get(key, func(b *backend) bool { return serves(b) && p.detector.Available(b.addr) })
+		if b == nil {
+			return gb.PickResult{}, ErrNoHealthyBackend
+		}
+		return p.result(info, b), nil
+	}
+	backends := make([]*backend, 0, len(p.backends))
+	available := make([]*backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if !serves(b) {
+			continue
+		}
+		backends = append(backends, b)
+		if p.detector.Available(b.addr) {
+			available = append(available, b)
+		}
+	}
+	if locality := p.locality(); locality.Zone != "" {
+		if candidates := local(backends, available, locality.Zone, locality.MinHealthy); candidates != nil {
+			available = candidates
+		}
+	}
+	var best *backend
+	total := 0
+	for _, b := range available {
+		b.current += b.weight
+		total += b.weight
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	if best == nil {
+		return gb.PickResult{}, ErrNoHealthyBackend
+	}
+	best.current -= total
+	return p.result(info, best), nil
+}
+
+func (p *picker) result(info gb.PickInfo, b *backend) gb.PickResult {
+	if served := servedFrom(info.Ctx); served != nil {
+		version := b.version
+		if wanted, ok := versionFrom(info.Ctx); ok && version == "" {
+			// untagged instances serve whatever version they are asked for
+			version = wanted.version
+		}
+		served.set(b.addr, b.zone, version)
+	}
+	start := time.Now()
+	return gb.PickResult{SubConn: b.sc, Done: func(done gb.DoneInfo) {
+		if ClientDeadline(info.Ctx, done.Err) {
+			return
+		}
+		p.detector.Record(b.addr, done.Err, time.Since(start))
+	}}
+}
@@ -0,0 +1,243 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/service/etcd"
+	gb "google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+type fakeSubConn struct {
+	addr string
+}
+
+func (f *fakeSubConn) UpdateAddresses([]resolver.Address) {}
+
+func (f *fakeSubConn) Connect() {}
+
+func buildPicker(detector *OutlierDetector, locality conf.LocalityConfig, addrs ...resolver.Address) gb.Picker {
+	info := base.PickerBuildInfo{ReadySCs: make(map[gb.SubConn]base.SubConnInfo)}
+	for _, addr := range addrs {
+		info.ReadySCs[&fakeSubConn{addr: addr.Addr}] = base.SubConnInfo{Address: addr}
+	}
+	return (&pickerBuilder{detector: detector, locality: func() conf.LocalityConfig { return locality }}).Build(info)
+}
+
+// pick counts the picks of every address
+func pick(t *testing.T, p gb.Picker, n int) map[string]int {
+	picked := make(map[string]int)
+	for i := 0; i < n; i++ {
+		res, err := p.Pick(gb.PickInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[res.SubConn.(*fakeSubConn).addr]++
+		res.Done(gb.DoneInfo{})
+	}
+	return picked
+}
+
+func TestPicker_Weighted(t *testing.T) {
+	detector, _ := newDetector(conf.OutlierConfig{})
+	p := buildPicker(detector, conf.LocalityConfig{},
+		etcd.Instance{Addr: "a", Weight: 300}.Address(),
+		etcd.Instance{Addr: "b", Weight: 100}.Address(),
+		etcd.Instance{Addr: "drained", Weight: 0}.Address(),
+		// registered by an older version without metadata
+		resolver.Address{Addr: "legacy"},
+	)
+	picked := pick(t, p, 500)
+	if picked["a"] != 300 || picked["b"] != 100 || picked["legacy"] != 100 || picked["drained"] != 0 {
+		t.Fatalf("expected picks by weight, got %v", picked)
+	}
+
+	// ejected addresses leave their share to the others
+	for i := 0; i < defaultConsecutiveFailures; i++ {
+		detector.Record("a", unavailable, 0)
+	}
+	picked = pick(t, p, 200)
+	if picked["a"] != 0 || picked["b"] != 100 || picked["legacy"] != 100 {
+		t.Fatalf("expected the ejected address to be skipped, got %v", picked)
+	}
+}
+
+func TestPicker_Drained(t *testing.T) {
+	detector, _ := newDetector(conf.OutlierConfig{})
+	p := buildPicker(detector, conf.LocalityConfig{}, etcd.Instance{Addr: "a", Weight: 0}.Address())
+	if _, err := p.Pick(gb.PickInfo{}); !errors.Is(err, ErrDrained) || !Rejected(err) {
+		t.Fatalf("expected a drained service, got %v", err)
+	}
+}
+
+func TestPicker_Locality(t *testing.T) {
+	detector, _ := newDetector(conf.OutlierConfig{})
+	addrs := []resolver.Address{
+		etcd.Instance{Addr: "sh-1", Weight: 100, Zone: "sh"}.Address(),
+		etcd.Instance{Addr: "sh-2", Weight: 100, Zone: "sh"}.Address(),
+		etcd.Instance{Addr: "bj-1", Weight: 100, Zone: "bj"}.Address(),
+	}
+	p := buildPicker(detector, conf.LocalityConfig{Zone: "sh"}, addrs...)
+	if picked := pick(t, p, 100); picked["sh-1"] != 50 || picked["sh-2"] != 50 {
+		t.Fatalf("expected the local zone only, got %v", picked)
+	}
+
+	ctx, served := WithServed(context.Background())
+	res, err := p.Pick(gb.PickInfo{Ctx: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if served.Zone() != "sh" || served.Addr() != res.SubConn.(*fakeSubConn).addr {
+		t.Fatalf("expected the serving backend, got %s in %s", served.Addr(), served.Zone())
+	}
+
+	// half of the local weight is still enough
+	for i := 0; i < defaultConsecutiveFailures; i++ {
+		detector.Record("sh-1", unavailable, 0)
+	}
+	if picked := pick(t, p, 10); picked["sh-2"] != 10 {
+		t.Fatalf("expected the healthy local instance, got %v", picked)
+	}
+	p = buildPicker(detector, conf.LocalityConfig{Zone: "sh", MinHealthy: 0.75}, addrs...)
+	if picked := pick(t, p, 10); picked["sh-2"] != 5 || picked["bj-1"] != 5 {
+		t.Fatalf("expected calls to spill over, got %v", picked)
+	}
+
+	// an unknown zone balances over every zone
+	p = buildPicker(detector, conf.LocalityConfig{Zone: "gz"}, addrs...)
+	if picked := pick(t, p, 10); picked["sh-2"] != 5 || picked["bj-1"] != 5 {
+		t.Fatalf("expected every zone, got %v", picked)
+	}
+}
+
+func TestPicker_Version(t *testing.T) {
+	detector, _ := newDetector(conf.OutlierConfig{})
+	p := buildPicker(detector, conf.LocalityConfig{},
+		etcd.Instance{Addr: "v1", Weight: 100, Version: "v1"}.Address(),
+		etcd.Instance{Addr: "v2", Weight: 100, Version: "v2"}.Address(),
+		etcd.Instance{Addr: "any", Weight: 100}.Address(),
+	)
+	versioned := func(version string) map[string]int {
+		picked := make(map[string]int)
+		for i := 0; i < 10; i++ {
+			res, err := p.Pick(gb.PickInfo{Ctx: WithVersion(context.Background(), version)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			picked[res.SubConn.(*fakeSubConn).addr]++
+		}
+		return picked
+	}
+	if picked := versioned("v2"); picked["v2"] != 5 || picked["any"] != 5 {
+		t.Fatalf("expected v2 and untagged instances, got %v", picked)
+	}
+	if picked := pick(t, p, 9); picked["v1"] != 3 || picked["v2"] != 3 {
+		t.Fatalf("expected calls without a version to go anywhere, got %v", picked)
+	}
+
+	// the served version is the one of the instance, untagged instances serve the one asked for
+	for i := 0; i < 2; i++ {
+		ctx, served := WithServed(WithSplitVersion(context.Background(), "v2"))
+		res, err := p.Pick(gb.PickInfo{Ctx: ctx})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if served.Version() != "v2" {
+			t.Fatalf("expected v2 to be served by %s, got %q", res.SubConn.(*fakeSubConn).addr, served.Version())
+		}
+	}
+
+	p = buildPicker(detector, conf.LocalityConfig{}, etcd.Instance{Addr: "build-17", Weight: 100, Version: "1.4.17"}.Address())
+	if picked := versioned("v1"); picked["build-17"] != 10 {
+		t.Fatalf("expected instances with foreign tags to serve every version, got %v", picked)
+	}
+	ctx, served := WithServed(WithVersion(context.Background(), "v1"))
+	if _, err := p.Pick(gb.PickInfo{Ctx: ctx}); err != nil || served.Version() != "1.4.17" {
+		t.Fatalf("expected the tag of the instance, got %q, %v", served.Version(), err)
+	}
+	// a split does not go to instances of another version
+	if _, err := p.Pick(gb.PickInfo{Ctx: WithSplitVersion(context.Background(), "v2")}); err != ErrNoVersion {
+		t.Fatalf("expected %v, got %v", ErrNoVersion, err)
+	}
+	if Failed(ErrNoVersion) {
+		t.Fatal("expected a split to a missing version to leave the health of the service alone")
+	}
+}
+
+func TestPicker_ClientDeadline(t *testing.T) {
+	detector, _ := newDetector(conf.OutlierConfig{})
+	p := buildPicker(detector, conf.LocalityConfig{}, etcd.Instance{Addr: "a", Weight: 100}.Address())
+	expired := status.Error(codes.DeadlineExceeded, "context deadline exceeded")
+	// a client asking for a tiny timeout says nothing about the backend
+	ctx := WithClientDeadline(context.Background())
+	for i := 0; i < 2*defaultConsecutiveFailures; i++ {
+		res, err := p.Pick(gb.PickInfo{Ctx: ctx})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Done(gb.DoneInfo{Err: expired})
+	}
+	if !detector.Available("a") {
+		t.Fatal("expected deadlines of the client to be left out")
+	}
+	for i := 0; i < defaultConsecutiveFailures; i++ {
+		res, err := p.Pick(gb.PickInfo{Ctx: context.Background()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Done(gb.DoneInfo{Err: expired})
+	}
+	if detector.Available("a") {
+		t.Fatal("expected deadlines of the gateway to eject the address")
+	}
+}
+
+type fakeBalancer struct {
+	gb.Balancer
+}
+
+func (fakeBalancer) UpdateClientConnState(gb.ClientConnState) error { return nil }
+
+func (fakeBalancer) Close() {}
+
+func TestTrackingBalancer_ForgetsRemovedAddress(t *testing.T) {
+	detector, _ := newDetector(conf.OutlierConfig{ConsecutiveFailures: 100})
+	state := func(addrs ...string) gb.ClientConnState {
+		var s gb.ClientConnState
+		for _, addr := range addrs {
+			s.ResolverState.Addresses = append(s.ResolverState.Addresses, resolver.Address{Addr: addr})
+		}
+		return s
+	}
+	first := &trackingBalancer{Balancer: fakeBalancer{}, detector: detector, addrs: make(map[string]bool)}
+	second := &trackingBalancer{Balancer: fakeBalancer{}, detector: detector, addrs: make(map[string]bool)}
+	if err := first.UpdateClientConnState(state("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	// another service served by the process of b
+	if err := second.UpdateClientConnState(state("b")); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"a", "b"} {
+		detector.Record(addr, unavailable, 0)
+	}
+	if err := first.UpdateClientConnState(state("b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := detector.addrs["a"]; ok {
+		t.Fatalf("expected the state of the removed address to be gone, got %+v", detector.Stats("a"))
+	}
+	first.Close()
+	if stats := detector.Stats("b"); stats.Failures != 1 {
+		t.Fatalf("expected the address still resolved by another balancer to be kept, got %+v", stats)
+	}
+	second.Close()
+	if len(detector.addrs) != 0 {
+		t.Fatalf("expected nothing to be left once the balancers closed, got %v", detector.addrs)
+	}
+}
@@ -0,0 +1,49 @@
+package balancer
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrNoVersion no instance of the service serves the version a split sends the call to
+var ErrNoVersion = status.Error(codes.Unavailable, "no instance serves the version")
+
+type versionKey struct{}
+
+type versionWanted struct {
+	version string
+	// strict calls fail instead of going to any instance when none serves the version
+	strict bool
+}
+
+// WithVersion returns a context whose calls only go to instances registered with version, or without
+// any version
+func WithVersion(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, versionKey{}, versionWanted{version: version})
+}
+
+// WithSplitVersion is WithVersion for the version a split sends the call to, the call fails with
+// ErrNoVersion when no instance serves it rather than going to one that does not
+func WithSplitVersion(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, versionKey{}, versionWanted{version: version, strict: true})
+}
+
+func versionFrom(ctx context.Context) (versionWanted, bool) {
+	if ctx == nil {
+		return versionWanted{}, false
+	}
+	wanted, ok := ctx.Value(versionKey{}).(versionWanted)
+	return wanted, ok
+}
+
+// serving tells which backends serve version, ok is false when none of them does
+func serving(backends []*backend, version string) (match func(*backend) bool, ok bool) {
+	match = func(b *backend) bool { return b.version == "" || b.version == version }
+	for _, b := range backends {
+		if match(b) {
+			return match, true
+		}
+	}
+	return match, false
+}
@@ -0,0 +1,217 @@
+package openapi
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/wuranxu/light/internal/rest"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"net/http"
+	"strings"
+)
+
+const (
+	// TokenScheme the security scheme of methods registered with authorization
+	TokenScheme = "token"
+	// ErrorSchema the schema of the error envelope of the gateway
+	ErrorSchema = "light.Error"
+	contentJson = "application/json"
+)
+
+// Method a registered method to document
+type Method struct {
+	Registration etcd.Registration
+	Descriptor   *desc.MethodDescriptor
+	// Download the method answers a file instead of json
+	Download bool
+	// Routes the REST routes of its google.api.http options
+	Routes []*rest.Route
+}
+
+// Builder collects the methods of a document
+type Builder struct {
+	doc      *Document
+	schemas  *schemas
+	services map[string]bool
+}
+
+func NewBuilder(info Info) *Builder {
+	doc := &Document{
+		OpenAPI: Version,
+		Info:    info,
+		Paths:   make(map[string]*PathItem),
+		Components: Components{
+			Schemas: map[string]*Schema{
+				ErrorSchema: {Type: "object", Properties: map[string]*Schema{
+					"code": {Type: "integer", Format: "int32"},
+					"msg":  {Type: "string"},
+					"data": {Description: "the status of the backend: code, message and details"},
+				}},
+			},
+			SecuritySchemes: map[string]*SecurityScheme{
+				TokenScheme: {Type: "apiKey", In: "header", Name: "token", Description: "the jwt of the user, a scheme like Bearer in front is allowed"},
+			},
+		},
+	}
+	return &Builder{doc: doc, schemas: newSchemas(doc.Components.Schemas), services: make(map[string]bool)}
+}
+
+// Add documents the gateway path /version/service/method of a method and its REST routes
+func (b *Builder) Add(m Method) {
+	reg := m.Registration
+	b.schemas.version = reg.Version
+	if !b.services[reg.Service] {
+		b.services[reg.Service] = true
+		b.doc.Tags = append(b.doc.Tags, Tag{Name: reg.Service, Description: comments(m.Descriptor.GetService())})
+	}
+	op := b.operation(m, reg.Key())
+	md := m.Descriptor
+	contentType := contentJson
+	switch {
+	case md.IsClientStreaming() && md.IsServerStreaming():
+		op.Description = appendLine(op.Description, "Bidirectional streaming, every websocket text frame carries one message.")
+	case md.IsClientStreaming():
+		op.Description = appendLine(op.Description, "Client streaming, files of the multipart form are sent in chunks.")
+		contentType = "multipart/form-data"
+	}
+	op.RequestBody = &RequestBody{Content: map[string]*MediaType{contentType: {Schema: b.schemas.message(md.GetInputType())}}}
+	op.Responses["200"] = b.response(m, "")
+	b.set(fmt.Sprintf("/%s/%s/%s", reg.Version, reg.Service, reg.Name), http.MethodPost, op)
+	for i, route := range m.Routes {
+		b.addRoute(m, route, fmt.Sprintf("%s.%d", reg.Key(), i))
+	}
+}
+
+// addRoute documents a REST route, path variables are parameters and the fields left out by the body
+// may be passed in the query
+func (b *Builder) addRoute(m Method, route *rest.Route, id string) {
+	in := m.Descriptor.GetInputType()
+	op := b.operation(m, id)
+	bound := make(map[string]bool)
+	for _, field := range route.Template.Variables() {
+		bound[field] = true
+		param := &Parameter{Name: field, In: "path", Required: true, Schema: &Schema{Type: "string"}}
+		if fd := fieldAt(in, field); fd != nil {
+			param.Schema, param.Description = b.schemas.value(fd), comments(fd)
+		}
+		op.Parameters = append(op.Parameters, param)
+	}
+	switch route.Body {
+	case "":
+		op.Parameters = append(op.Parameters, b.queryParameters(in, bound)...)
+	case "*":
+		op.RequestBody = &RequestBody{Content: map[string]*MediaType{contentJson: {Schema: b.schemas.message(in)}}}
+	default:
+		bound[route.Body] = true
+		if fd := fieldAt(in, route.Body); fd != nil {
+			op.RequestBody = &RequestBody{Content: map[string]*MediaType{contentJson: {Schema: b.schemas.field(fd)}}}
+		}
+		op.Parameters = append(op.Parameters, b.queryParameters(in, bound)...)
+	}
+	op.Responses["200"] = b.response(m, route.ResponseBody)
+	b.set(route.Template.Pattern(), route.HTTPMethod, op)
+}
+
+// queryParameters the top level fields of the request that can be bound from the query
+func (b *Builder) queryParameters(md *desc.MessageDescriptor, bound map[string]bool) []*Parameter {
+	var params []*Parameter
+	for _, fd := range md.GetFields() {
+		if bound[fd.GetName()] || bound[fd.GetJSONName()] || fd.IsMap() {
+			continue
+		}
+		if mt := fd.GetMessageType(); mt != nil {
+			if _, ok := wellKnown[mt.GetFullyQualifiedName()]; !ok {
+				continue
+			}
+		}
+		params = append(params, &Parameter{Name: fd.GetJSONName(), In: "query", Description: comments(fd), Schema: b.schemas.field(fd)})
+	}
+	return params
+}
+
+func (b *Builder) operation(m Method, id string) *Operation {
+	op := &Operation{
+		OperationID: id,
+		Tags:        []string{m.Registration.Service},
+		Responses: map[string]*Response{
+			"default": {Description: "the call failed", Content: map[string]*MediaType{contentJson: {Schema: &Schema{Ref: "#/components/schemas/" + ErrorSchema}}}},
+		},
+		Deprecated: m.Descriptor.GetMethodOptions().GetDeprecated(),
+	}
+	if c := comments(m.Descriptor); c != "" {
+		op.Summary = strings.SplitN(c, "\n", 2)[0]
+		op.Description = c
+	}
+	if m.Registration.Method.Authorization {
+		op.Security = []map[string][]string{{TokenScheme: {}}}
+	}
+	return op
+}
+
+// response the answer of a method, field narrows it to a field of the response
+func (b *Builder) response(m Method, field string) *Response {
+	md := m.Descriptor
+	if m.Download {
+		return &Response{Description: "the file", Content: map[string]*MediaType{
+			"application/octet-stream": {Schema: &Schema{Type: "string", Format: "binary"}},
+		}}
+	}
+	schema := b.schemas.message(md.GetOutputType())
+	if fd := fieldAt(md.GetOutputType(), field); field != "" && fd != nil {
+		schema = b.schemas.field(fd)
+	}
+	if md.IsServerStreaming() {
+		return &Response{Description: "the stream, one message per line or event", Content: map[string]*MediaType{
+			"application/x-ndjson": {Schema: schema},
+			"text/event-stream":    {Schema: schema},
+		}}
+	}
+	return &Response{Description: "the answer", Content: map[string]*MediaType{contentJson: {Schema: schema}}}
+}
+
+// set adds the operation, routes of unknown http methods are left out
+func (b *Builder) set(path, method string, op *Operation) {
+	item, ok := b.doc.Paths[path]
+	if !ok {
+		item = new(PathItem)
+	}
+	slot := item.operation(method)
+	if slot == nil {
+		return
+	}
+	*slot = op
+	b.doc.Paths[path] = item
+}
+
+// Document the document of the methods added so far
+func (b *Builder) Document() *Document {
+	return b.doc
+}
+
+// fieldAt finds the field at a dotted path of proto or json names, nil when there is none
+func fieldAt(md *desc.MessageDescriptor, path string) *desc.FieldDescriptor {
+	var fd *desc.FieldDescriptor
+	for _, name := range strings.Split(path, ".") {
+		if md == nil {
+			return nil
+		}
+		if fd = md.FindFieldByName(name); fd == nil {
+			fd = md.FindFieldByJSONName(name)
+		}
+		if fd == nil {
+			return nil
+		}
+		md = nil
+		if fd.GetType() == descriptor.FieldDescriptorProto_TYPE_MESSAGE && !fd.IsRepeated() {
+			md = fd.GetMessageType()
+		}
+	}
+	return fd
+}
+
+func appendLine(text, line string) string {
+	if text == "" {
+		return line
+	}
+	return text + "\n\n" + line
+}
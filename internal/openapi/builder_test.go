@@ -0,0 +1,169 @@
+package openapi
+
+import (
+	"encoding/json"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/wuranxu/light/internal/rest"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"reflect"
+	"testing"
+)
+
+const libraryProto = `syntax = "proto3";
+package library;
+
+import "google/api/annotations.proto";
+import "google/protobuf/timestamp.proto";
+
+// Library keeps the books
+service Library {
+  // GetBook returns a book.
+  // Unknown books are not found.
+  rpc GetBook(GetBookRequest) returns (Book) {
+    option (google.api.http) = { get: "/v1/{name=shelves/*/books/*}" };
+  }
+  rpc UpdateBook(UpdateBookRequest) returns (Book) {
+    option (google.api.http) = { patch: "/v1/books/{book.name}" body: "book" response_body: "title" };
+  }
+  rpc WatchBooks(GetBookRequest) returns (stream Book);
+  rpc ImportBooks(stream Book) returns (Book);
+}
+
+enum Kind {
+  KIND_UNSPECIFIED = 0;
+  NOVEL = 1;
+}
+
+message Book {
+  // the resource name
+  string name = 1;
+  string title = 2;
+  int64 pages = 3;
+  Kind kind = 4;
+  repeated Book related = 5;
+  map<string, int32> ratings = 6;
+  google.protobuf.Timestamp published = 7;
+  bytes cover = 8;
+}
+
+message GetBookRequest {
+  string name = 1;
+  bool with_related = 2;
+  Book template = 3;
+}
+
+message UpdateBookRequest {
+  Book book = 1;
+  bool force = 2;
+}
+`
+
+func parseLibrary(t *testing.T, contents string) *desc.ServiceDescriptor {
+	parser := protoparse.Parser{
+		Accessor:              protoparse.FileContentsFromMap(map[string]string{"library.proto": contents}),
+		LookupImport:          desc.LoadFileDescriptor,
+		IncludeSourceCodeInfo: true,
+	}
+	fds, err := parser.ParseFiles("library.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fds[0].FindService("library.Library")
+}
+
+func addService(t *testing.T, b *Builder, sd *desc.ServiceDescriptor, version string, auth bool) {
+	for _, md := range sd.GetMethods() {
+		reg := etcd.Registration{Version: version, Service: "library", Name: etcd.LowerFirst(md.GetName()), Method: etcd.Method{Authorization: auth}}
+		rules, err := rest.Rules(md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := Method{Registration: reg, Descriptor: md}
+		for _, rule := range rules {
+			route, err := rest.NewRoute(rule, reg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Routes = append(m.Routes, route)
+		}
+		b.Add(m)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	b := NewBuilder(Info{Title: "library", Version: "v1"})
+	addService(t, b, parseLibrary(t, libraryProto), "v1", true)
+	doc := b.Document()
+	if _, err := json.Marshal(doc); err != nil {
+		t.Fatal(err)
+	}
+
+	get := doc.Paths["/v1/library/getBook"].Post
+	if get == nil || get.OperationID != "v1.library.getBook" || get.Summary != "GetBook returns a book." || len(get.Security) != 1 {
+		t.Fatalf("unexpected operation %+v", get)
+	}
+	if ref := get.RequestBody.Content[contentJson].Schema.Ref; ref != "#/components/schemas/library.GetBookRequest" {
+		t.Fatalf("unexpected request %s", ref)
+	}
+	if len(doc.Tags) != 1 || doc.Tags[0].Description != "Library keeps the books" {
+		t.Fatalf("unexpected tags %+v", doc.Tags)
+	}
+
+	book := doc.Components.Schemas["library.Book"]
+	expected := map[string]*Schema{
+		"name":      {Type: "string", Description: "the resource name"},
+		"title":     {Type: "string"},
+		"pages":     {Type: "string", Format: "int64"},
+		"kind":      {Type: "string", Enum: []string{"KIND_UNSPECIFIED", "NOVEL"}},
+		"related":   {Type: "array", Items: &Schema{Ref: "#/components/schemas/library.Book"}},
+		"ratings":   {Type: "object", AdditionalProperties: &Schema{Type: "integer", Format: "int32"}},
+		"published": {Type: "string", Format: "date-time"},
+		"cover":     {Type: "string", Format: "byte"},
+	}
+	if !reflect.DeepEqual(book.Properties, expected) {
+		got, _ := json.Marshal(book.Properties)
+		t.Fatalf("unexpected book schema %s", got)
+	}
+
+	// REST routes take their parameters from the path, the query and the body field
+	route := doc.Paths["/v1/{name}"].Get
+	if route == nil || len(route.Parameters) != 2 || route.Parameters[0].In != "path" || route.Parameters[1].Name != "withRelated" || route.RequestBody != nil {
+		t.Fatalf("unexpected route %+v", route)
+	}
+	update := doc.Paths["/v1/books/{book.name}"].Patch
+	if update == nil || update.RequestBody.Content[contentJson].Schema.Ref != "#/components/schemas/library.Book" ||
+		update.Responses["200"].Content[contentJson].Schema.Type != "string" || len(update.Parameters) != 2 {
+		t.Fatalf("unexpected route %+v", update)
+	}
+
+	watch := doc.Paths["/v1/library/watchBooks"].Post.Responses["200"]
+	if _, ok := watch.Content["application/x-ndjson"]; !ok {
+		t.Fatalf("unexpected stream %+v", watch)
+	}
+	if _, ok := doc.Paths["/v1/library/importBooks"].Post.RequestBody.Content["multipart/form-data"]; !ok {
+		t.Fatal("expected client streams to take uploads")
+	}
+}
+
+func TestBuilder_Versions(t *testing.T) {
+	b := NewBuilder(Info{Title: "library", Version: "v1, v2"})
+	addService(t, b, parseLibrary(t, libraryProto), "v1", false)
+	// the same messages of another backend share their schemas
+	addService(t, b, parseLibrary(t, libraryProto), "v1beta", false)
+	if _, ok := b.Document().Components.Schemas["v1beta.library.Book"]; ok {
+		t.Fatal("expected equal messages to share their schema")
+	}
+	changed := parseLibrary(t, libraryProto[:len(libraryProto)-2]+"  string isbn = 3;\n}\n")
+	addService(t, b, changed, "v2", false)
+	doc := b.Document()
+	if _, ok := doc.Components.Schemas["v2.library.UpdateBookRequest"].Properties["isbn"]; !ok {
+		t.Fatal("expected the changed message under its version")
+	}
+	if _, ok := doc.Components.Schemas["v2.library.Book"]; ok {
+		t.Fatal("expected the unchanged message to be shared")
+	}
+	if get := doc.Paths["/v2/library/getBook"].Post; get == nil || len(get.Security) != 0 {
+		t.Fatalf("unexpected operation %+v", get)
+	}
+}
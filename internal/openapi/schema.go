@@ -0,0 +1,121 @@
+package openapi
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"strings"
+)
+
+// wellKnown the schemas of the well known types, they have a json form of their own
+var wellKnown = map[string]func() *Schema{
+	"google.protobuf.Timestamp": func() *Schema { return &Schema{Type: "string", Format: "date-time"} },
+	"google.protobuf.Duration":  func() *Schema { return &Schema{Type: "string", Description: "seconds with an s suffix, like 1.5s"} },
+	"google.protobuf.FieldMask": func() *Schema { return &Schema{Type: "string", Description: "comma separated field paths"} },
+	"google.protobuf.Struct":    func() *Schema { return &Schema{Type: "object", AdditionalProperties: &Schema{}} },
+	"google.protobuf.Value":     func() *Schema { return &Schema{} },
+	"google.protobuf.ListValue": func() *Schema { return &Schema{Type: "array", Items: &Schema{}} },
+	"google.protobuf.Empty":     func() *Schema { return &Schema{Type: "object"} },
+	"google.protobuf.Any": func() *Schema {
+		return &Schema{Type: "object", Properties: map[string]*Schema{"@type": {Type: "string"}}, AdditionalProperties: &Schema{}}
+	},
+	"google.protobuf.DoubleValue": func() *Schema { return &Schema{Type: "number", Format: "double", Nullable: true} },
+	"google.protobuf.FloatValue":  func() *Schema { return &Schema{Type: "number", Format: "float", Nullable: true} },
+	"google.protobuf.Int64Value":  func() *Schema { return &Schema{Type: "string", Format: "int64", Nullable: true} },
+	"google.protobuf.UInt64Value": func() *Schema { return &Schema{Type: "string", Format: "uint64", Nullable: true} },
+	"google.protobuf.Int32Value":  func() *Schema { return &Schema{Type: "integer", Format: "int32", Nullable: true} },
+	"google.protobuf.UInt32Value": func() *Schema { return &Schema{Type: "integer", Format: "uint32", Nullable: true} },
+	"google.protobuf.BoolValue":   func() *Schema { return &Schema{Type: "boolean", Nullable: true} },
+	"google.protobuf.StringValue": func() *Schema { return &Schema{Type: "string", Nullable: true} },
+	"google.protobuf.BytesValue":  func() *Schema { return &Schema{Type: "string", Format: "byte", Nullable: true} },
+}
+
+// schemas names the schemas of messages in the components of a document. Messages of the same name
+// may differ between versions of a service, a differing one is named after its version too.
+type schemas struct {
+	components map[string]*Schema
+	messages   map[string]*desc.MessageDescriptor
+	version    string
+}
+
+func newSchemas(components map[string]*Schema) *schemas {
+	return &schemas{components: components, messages: make(map[string]*desc.MessageDescriptor)}
+}
+
+// message the schema of a message, a reference to its component unless it is a well known type
+func (s *schemas) message(md *desc.MessageDescriptor) *Schema {
+	if wk, ok := wellKnown[md.GetFullyQualifiedName()]; ok {
+		return wk()
+	}
+	name := md.GetFullyQualifiedName()
+	if known, ok := s.messages[name]; ok && known != md && !proto.Equal(known.AsDescriptorProto(), md.AsDescriptorProto()) {
+		name = s.version + "." + name
+	}
+	ref := &Schema{Ref: "#/components/schemas/" + name}
+	if _, ok := s.messages[name]; ok {
+		return ref
+	}
+	// registered before its fields, recursive messages refer to it
+	s.messages[name] = md
+	schema := &Schema{Type: "object", Description: comments(md), Properties: make(map[string]*Schema)}
+	s.components[name] = schema
+	for _, fd := range md.GetFields() {
+		schema.Properties[fd.GetJSONName()] = s.field(fd)
+	}
+	return ref
+}
+
+// field the schema of a field in the json mapping of proto3, 64 bit integers are strings
+func (s *schemas) field(fd *desc.FieldDescriptor) *Schema {
+	if fd.IsMap() {
+		return &Schema{Type: "object", AdditionalProperties: s.value(fd.GetMapValueType()), Description: comments(fd)}
+	}
+	schema := s.value(fd)
+	if fd.IsRepeated() {
+		schema = &Schema{Type: "array", Items: schema}
+	}
+	// siblings of $ref are ignored
+	if schema.Ref == "" {
+		if c := comments(fd); c != "" {
+			schema.Description = c
+		}
+		schema.Deprecated = fd.GetFieldOptions().GetDeprecated()
+	}
+	return schema
+}
+
+// value the schema of a single value of fd
+func (s *schemas) value(fd *desc.FieldDescriptor) *Schema {
+	switch fd.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_STRING:
+		return &Schema{Type: "string"}
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		return &Schema{Type: "boolean"}
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE:
+		return &Schema{Type: "number", Format: "double"}
+	case descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		return &Schema{Type: "number", Format: "float"}
+	case descriptor.FieldDescriptorProto_TYPE_INT32, descriptor.FieldDescriptorProto_TYPE_SINT32, descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case descriptor.FieldDescriptorProto_TYPE_UINT32, descriptor.FieldDescriptorProto_TYPE_FIXED32:
+		return &Schema{Type: "integer", Format: "uint32"}
+	case descriptor.FieldDescriptorProto_TYPE_INT64, descriptor.FieldDescriptorProto_TYPE_SINT64, descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		return &Schema{Type: "string", Format: "int64"}
+	case descriptor.FieldDescriptorProto_TYPE_UINT64, descriptor.FieldDescriptorProto_TYPE_FIXED64:
+		return &Schema{Type: "string", Format: "uint64"}
+	case descriptor.FieldDescriptorProto_TYPE_BYTES:
+		return &Schema{Type: "string", Format: "byte"}
+	case descriptor.FieldDescriptorProto_TYPE_ENUM:
+		schema := &Schema{Type: "string"}
+		for _, ev := range fd.GetEnumType().GetValues() {
+			schema.Enum = append(schema.Enum, ev.GetName())
+		}
+		return schema
+	}
+	return s.message(fd.GetMessageType())
+}
+
+// comments the leading comments of a descriptor, descriptors fetched by reflection usually have none
+func comments(d desc.Descriptor) string {
+	return strings.TrimSpace(d.GetSourceInfo().GetLeadingComments())
+}
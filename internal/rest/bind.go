@@ -0,0 +1,193 @@
+package rest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrUnknownField the message has no field of that name
+var ErrUnknownField = errors.New("unknown field")
+
+// fieldOf finds a field by its proto or json name
+func fieldOf(md *desc.MessageDescriptor, name string) *desc.FieldDescriptor {
+	if fd := md.FindFieldByName(name); fd != nil {
+		return fd
+	}
+	return md.FindFieldByJSONName(name)
+}
+
+// Bind sets the field at path, field names separated by dots, from its text form like it appears in
+// urls. Repeated fields take every value, other fields the last one. Messages on the way are created.
+func Bind(msg *dynamic.Message, path string, values ...string) error {
+	if len(values) == 0 {
+		return nil
+	}
+	msg, fd, err := leaf(msg, path)
+	if err != nil {
+		return err
+	}
+	if !fd.IsRepeated() {
+		value, err := parseValue(fd, values[len(values)-1])
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		return msg.TrySetField(fd, value)
+	}
+	for _, v := range values {
+		value, err := parseValue(fd, v)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		if err = msg.TryAddRepeatedField(fd, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leaf finds the field at path and the message holding it, creating the messages on the way
+func leaf(msg *dynamic.Message, path string) (*dynamic.Message, *desc.FieldDescriptor, error) {
+	names := strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		fd := fieldOf(msg.GetMessageDescriptor(), name)
+		if fd == nil {
+			return nil, nil, fmt.Errorf("%w %s of %s", ErrUnknownField, path, msg.GetMessageDescriptor().GetFullyQualifiedName())
+		}
+		if fd.GetMessageType() == nil || fd.IsRepeated() {
+			return nil, nil, fmt.Errorf("%s of %s is no message", name, path)
+		}
+		var child *dynamic.Message
+		if msg.HasField(fd) {
+			child, _ = msg.GetField(fd).(*dynamic.Message)
+		}
+		if child == nil {
+			child = dynamic.NewMessage(fd.GetMessageType())
+			if err := msg.TrySetField(fd, child); err != nil {
+				return nil, nil, err
+			}
+		}
+		msg = child
+	}
+	fd := fieldOf(msg.GetMessageDescriptor(), names[len(names)-1])
+	if fd == nil {
+		return nil, nil, fmt.Errorf("%w %s of %s", ErrUnknownField, path, msg.GetMessageDescriptor().GetFullyQualifiedName())
+	}
+	if fd.IsMap() {
+		return nil, nil, fmt.Errorf("map field %s can not be bound", path)
+	}
+	return msg, fd, nil
+}
+
+// wrappers the well known wrapper types, their text form is the one of their value
+var wrappers = map[string]bool{
+	"google.protobuf.DoubleValue": true,
+	"google.protobuf.FloatValue":  true,
+	"google.protobuf.Int64Value":  true,
+	"google.protobuf.UInt64Value": true,
+	"google.protobuf.Int32Value":  true,
+	"google.protobuf.UInt32Value": true,
+	"google.protobuf.BoolValue":   true,
+	"google.protobuf.StringValue": true,
+	"google.protobuf.BytesValue":  true,
+}
+
+// stringTypes the well known types whose json form is a string, like 2006-01-02T15:04:05Z for
+// Timestamp and 1.5s for Duration
+var stringTypes = map[string]bool{
+	"google.protobuf.Timestamp": true,
+	"google.protobuf.Duration":  true,
+}
+
+// parseValue parses the text form of a value of fd, enums by name or number
+func parseValue(fd *desc.FieldDescriptor, v string) (interface{}, error) {
+	switch fd.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_STRING:
+		return v, nil
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		return strconv.ParseBool(v)
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE:
+		return strconv.ParseFloat(v, 64)
+	case descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		f, err := strconv.ParseFloat(v, 32)
+		return float32(f), err
+	case descriptor.FieldDescriptorProto_TYPE_INT64, descriptor.FieldDescriptorProto_TYPE_SINT64, descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		return strconv.ParseInt(v, 10, 64)
+	case descriptor.FieldDescriptorProto_TYPE_INT32, descriptor.FieldDescriptorProto_TYPE_SINT32, descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		i, err := strconv.ParseInt(v, 10, 32)
+		return int32(i), err
+	case descriptor.FieldDescriptorProto_TYPE_UINT64, descriptor.FieldDescriptorProto_TYPE_FIXED64:
+		return strconv.ParseUint(v, 10, 64)
+	case descriptor.FieldDescriptorProto_TYPE_UINT32, descriptor.FieldDescriptorProto_TYPE_FIXED32:
+		u, err := strconv.ParseUint(v, 10, 32)
+		return uint32(u), err
+	case descriptor.FieldDescriptorProto_TYPE_BYTES:
+		if b, err := base64.StdEncoding.DecodeString(v); err == nil {
+			return b, nil
+		}
+		return base64.URLEncoding.DecodeString(v)
+	case descriptor.FieldDescriptorProto_TYPE_ENUM:
+		if ev := fd.GetEnumType().FindValueByName(v); ev != nil {
+			return ev.GetNumber(), nil
+		}
+		i, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unknown value %q of %s", v, fd.GetEnumType().GetFullyQualifiedName())
+		}
+		return int32(i), nil
+	case descriptor.FieldDescriptorProto_TYPE_MESSAGE:
+		return parseMessage(fd.GetMessageType(), v)
+	}
+	return nil, fmt.Errorf("%s fields can not be bound from text", fd.GetType())
+}
+
+// parseMessage parses the text form of the well known types, other messages have none
+func parseMessage(md *desc.MessageDescriptor, v string) (interface{}, error) {
+	name := md.GetFullyQualifiedName()
+	msg := dynamic.NewMessage(md)
+	switch {
+	case wrappers[name]:
+		value, err := parseValue(md.FindFieldByName("value"), v)
+		if err != nil {
+			return nil, err
+		}
+		if err = msg.TrySetFieldByName("value", value); err != nil {
+			return nil, err
+		}
+	case stringTypes[name]:
+		data, _ := json.Marshal(v)
+		if err := msg.UnmarshalJSON(data); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %s", name, v, err)
+		}
+	case name == "google.protobuf.FieldMask":
+		// a comma separated list of paths, in json names like the json form
+		for _, path := range strings.Split(v, ",") {
+			if err := msg.TryAddRepeatedFieldByName("paths", snakeCase(path)); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%s fields can not be bound from text", name)
+	}
+	return msg, nil
+}
+
+// snakeCase turns the json name path minPages.bookId into min_pages.book_id
+func snakeCase(path string) string {
+	var sb strings.Builder
+	for _, r := range path {
+		if unicode.IsUpper(r) {
+			sb.WriteByte('_')
+			r = unicode.ToLower(r)
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,103 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+// File an uploaded file, Content may be a chunk of it when the file is streamed
+type File struct {
+	Name        string
+	ContentType string
+	// Size the size of the whole file, 0 when it is not known upfront
+	Size    int64
+	Content []byte
+}
+
+// nameFields and typeFields the string fields of a file message taking its name and content type
+var (
+	nameFields = map[string]bool{"filename": true, "file_name": true, "name": true}
+	typeFields = map[string]bool{"content_type": true, "mime_type": true}
+)
+
+// BindFile sets the file field at path. A bytes field takes the content, a message field a file
+// message: its first bytes field takes the content, fields named like filename, content_type and size
+// take the rest. Repeated fields get the file appended, other fields are replaced.
+func BindFile(msg *dynamic.Message, path string, f File) error {
+	msg, fd, err := leaf(msg, path)
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	switch {
+	case fd.GetType() == descriptor.FieldDescriptorProto_TYPE_BYTES:
+		value = f.Content
+	case fd.GetMessageType() != nil:
+		if value, err = fileMessage(fd.GetMessageType(), f); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	default:
+		return fmt.Errorf("%s is no bytes or file field", path)
+	}
+	if fd.IsRepeated() {
+		return msg.TryAddRepeatedField(fd, value)
+	}
+	return msg.TrySetField(fd, value)
+}
+
+func fileMessage(md *desc.MessageDescriptor, f File) (*dynamic.Message, error) {
+	msg := dynamic.NewMessage(md)
+	content := false
+	for _, fd := range md.GetFields() {
+		if fd.IsRepeated() {
+			continue
+		}
+		if fd.GetType() == descriptor.FieldDescriptorProto_TYPE_BYTES && !content {
+			content = true
+			if err := msg.TrySetField(fd, f.Content); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		name, isString := fd.GetName(), fd.GetType() == descriptor.FieldDescriptorProto_TYPE_STRING
+		var value interface{}
+		switch {
+		case isString && nameFields[name]:
+			value = f.Name
+		case isString && typeFields[name]:
+			value = f.ContentType
+		case name == "size" && f.Size > 0:
+			size, ok := integer(fd, f.Size)
+			if !ok {
+				continue
+			}
+			value = size
+		default:
+			continue
+		}
+		if err := msg.TrySetField(fd, value); err != nil {
+			return nil, err
+		}
+	}
+	if !content {
+		return nil, fmt.Errorf("%s has no bytes field", md.GetFullyQualifiedName())
+	}
+	return msg, nil
+}
+
+// integer converts n to the type of the integer field fd, false when fd is no integer
+func integer(fd *desc.FieldDescriptor, n int64) (interface{}, bool) {
+	switch fd.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_INT64, descriptor.FieldDescriptorProto_TYPE_SINT64, descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		return n, true
+	case descriptor.FieldDescriptorProto_TYPE_INT32, descriptor.FieldDescriptorProto_TYPE_SINT32, descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		return int32(n), true
+	case descriptor.FieldDescriptorProto_TYPE_UINT64, descriptor.FieldDescriptorProto_TYPE_FIXED64:
+		return uint64(n), true
+	case descriptor.FieldDescriptorProto_TYPE_UINT32, descriptor.FieldDescriptorProto_TYPE_FIXED32:
+		return uint32(n), true
+	}
+	return nil, false
+}
@@ -0,0 +1,125 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Route a REST binding of a registered method, from its google.api.http option
+type Route struct {
+	HTTPMethod string
+	Template   *Template
+	// Body the field the request body goes to, * for the whole message, empty for none
+	Body string
+	// ResponseBody the field of the answer written as the response body, empty for the whole answer
+	ResponseBody string
+	Registration etcd.Registration
+}
+
+// Rules returns the google.api.http rule of a method followed by its additional bindings
+func Rules(md *desc.MethodDescriptor) ([]*annotations.HttpRule, error) {
+	opts := md.GetMethodOptions()
+	if opts == nil {
+		return nil, nil
+	}
+	// options of descriptors built at runtime may keep the extension as unknown bytes
+	data, err := proto.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+	parsed := new(descriptorpb.MethodOptions)
+	if err = proto.Unmarshal(data, parsed); err != nil {
+		return nil, err
+	}
+	if !proto.HasExtension(parsed, annotations.E_Http) {
+		return nil, nil
+	}
+	ext, err := proto.GetExtension(parsed, annotations.E_Http)
+	if err != nil {
+		return nil, err
+	}
+	rule := ext.(*annotations.HttpRule)
+	return append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...), nil
+}
+
+// NewRoute builds the route of a rule of the registered method
+func NewRoute(rule *annotations.HttpRule, reg etcd.Registration) (*Route, error) {
+	var method, path string
+	switch p := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		method, path = http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		method, path = http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		method, path = http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		method, path = http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		method, path = http.MethodPatch, p.Patch
+	case *annotations.HttpRule_Custom:
+		method, path = p.Custom.GetKind(), p.Custom.GetPath()
+	default:
+		return nil, fmt.Errorf("http rule of %s without pattern", reg.Key())
+	}
+	template, err := Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Route{HTTPMethod: method, Template: template, Body: rule.GetBody(), ResponseBody: rule.GetResponseBody(), Registration: reg}, nil
+}
+
+// Table routes by http method, a request goes to the matching route with the most literal segments
+type Table struct {
+	lock   sync.RWMutex
+	routes map[string][]*Route
+}
+
+func NewTable() *Table {
+	return &Table{routes: make(map[string][]*Route)}
+}
+
+// Add adds a route, a route with the same method and template as a known one is refused
+func (t *Table) Add(r *Route) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	routes := t.routes[r.HTTPMethod]
+	for _, known := range routes {
+		if known.Template.String() == r.Template.String() {
+			return fmt.Errorf("%s %s of %s is taken by %s", r.HTTPMethod, r.Template, r.Registration.Key(), known.Registration.Key())
+		}
+	}
+	routes = append(routes, r)
+	sort.SliceStable(routes, func(i, j int) bool { return routes[i].Template.literals() > routes[j].Template.literals() })
+	t.routes[r.HTTPMethod] = routes
+	return nil
+}
+
+// Match returns the route of a request with the values of its path variables, nil when no route matches
+func (t *Table) Match(method, path string) (*Route, map[string]string) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	for _, r := range t.routes[method] {
+		if values, ok := r.Template.Match(path); ok {
+			return r, values
+		}
+	}
+	return nil, nil
+}
+
+// Len the number of routes
+func (t *Table) Len() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	n := 0
+	for _, routes := range t.routes {
+		n += len(routes)
+	}
+	return n
+}
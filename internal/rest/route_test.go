@@ -0,0 +1,188 @@
+package rest
+
+import (
+	"errors"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"net/http"
+	"testing"
+)
+
+const libraryProto = `syntax = "proto3";
+package library;
+
+import "google/api/annotations.proto";
+import "google/protobuf/duration.proto";
+import "google/protobuf/field_mask.proto";
+import "google/protobuf/timestamp.proto";
+import "google/protobuf/wrappers.proto";
+
+enum Kind {
+  KIND_UNSPECIFIED = 0;
+  NOVEL = 1;
+}
+
+message Filter {
+  int64 min_pages = 1;
+  bool available = 2;
+}
+
+message Book {
+  string name = 1;
+  string title = 2;
+  int32 pages = 3;
+}
+
+message GetBookRequest {
+  string name = 1;
+  Kind kind = 2;
+  repeated string tags = 3;
+  Filter filter = 4;
+  map<string, string> labels = 5;
+  google.protobuf.Timestamp published_after = 6;
+  google.protobuf.Duration max_age = 7;
+  google.protobuf.Int32Value min_rating = 8;
+  google.protobuf.FieldMask read_mask = 9;
+  repeated google.protobuf.Timestamp dates = 10;
+}
+
+message UpdateBookRequest {
+  string name = 1;
+  Book book = 2;
+}
+
+service Library {
+  rpc GetBook(GetBookRequest) returns (Book) {
+    option (google.api.http) = {
+      get: "/v1/{name=shelves/*/books/*}"
+      additional_bindings { get: "/v1/books/{name}" }
+    };
+  }
+  rpc UpdateBook(UpdateBookRequest) returns (Book) {
+    option (google.api.http) = { patch: "/v1/books/{name}" body: "book" response_body: "title" };
+  }
+  rpc ListBooks(GetBookRequest) returns (Book);
+}
+`
+
+func parseLibrary(t *testing.T) *desc.ServiceDescriptor {
+	parser := protoparse.Parser{
+		Accessor:     protoparse.FileContentsFromMap(map[string]string{"library.proto": libraryProto}),
+		LookupImport: desc.LoadFileDescriptor,
+	}
+	fds, err := parser.ParseFiles("library.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fds[0].FindService("library.Library")
+}
+
+func TestRules(t *testing.T) {
+	sd := parseLibrary(t)
+	table := NewTable()
+	for _, md := range sd.GetMethods() {
+		rules, err := Rules(md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rule := range rules {
+			route, err := NewRoute(rule, etcd.Registration{Version: "v1", Service: "library", Name: md.GetName()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = table.Add(route); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if table.Len() != 3 {
+		t.Fatalf("expected 3 routes, got %d", table.Len())
+	}
+
+	route, values := table.Match(http.MethodGet, "/v1/books/b1")
+	if route == nil || route.Registration.Name != "GetBook" || values["name"] != "b1" {
+		t.Fatalf("unexpected route %+v with %v", route, values)
+	}
+	route, _ = table.Match(http.MethodPatch, "/v1/books/b1")
+	if route == nil || route.Registration.Name != "UpdateBook" || route.Body != "book" || route.ResponseBody != "title" {
+		t.Fatalf("unexpected route %+v", route)
+	}
+	if route, _ = table.Match(http.MethodDelete, "/v1/books/b1"); route != nil {
+		t.Fatalf("expected no route, got %+v", route)
+	}
+
+	// the same route of another version is refused
+	rules, _ := Rules(sd.FindMethodByName("GetBook"))
+	route, _ = NewRoute(rules[1], etcd.Registration{Version: "v2", Service: "library", Name: "GetBook"})
+	if err := table.Add(route); err == nil {
+		t.Fatal("expected a taken route to be refused")
+	}
+}
+
+func TestTable_Specific(t *testing.T) {
+	table := NewTable()
+	for _, template := range []string{"/v1/books/{name}", "/v1/books/latest"} {
+		parsed, err := Parse(template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = table.Add(&Route{HTTPMethod: http.MethodGet, Template: parsed, Registration: etcd.Registration{Name: template}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if route, _ := table.Match(http.MethodGet, "/v1/books/latest"); route.Registration.Name != "/v1/books/latest" {
+		t.Fatalf("expected the literal route to win, got %s", route.Registration.Name)
+	}
+	if route, _ := table.Match(http.MethodGet, "/v1/books/b1"); route.Registration.Name != "/v1/books/{name}" {
+		t.Fatalf("expected the variable route, got %s", route.Registration.Name)
+	}
+}
+
+func TestBind(t *testing.T) {
+	md := parseLibrary(t).FindMethodByName("GetBook").GetInputType()
+	msg := dynamic.NewMessage(md)
+	binds := []struct {
+		path   string
+		values []string
+	}{
+		{"name", []string{"b1"}},
+		{"kind", []string{"NOVEL"}},
+		{"tags", []string{"a", "b"}},
+		{"filter.minPages", []string{"100"}},
+		{"filter.available", []string{"true"}},
+		{"published_after", []string{"2022-05-01T08:30:00.5Z"}},
+		{"maxAge", []string{"90s"}},
+		{"minRating", []string{"4"}},
+		{"readMask", []string{"name,filter.minPages"}},
+		{"dates", []string{"2022-01-01T00:00:00Z", "2022-01-02T00:00:00+08:00"}},
+	}
+	for _, b := range binds {
+		if err := Bind(msg, b.path, b.values...); err != nil {
+			t.Fatalf("%s: %v", b.path, err)
+		}
+	}
+	json, err := msg.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"name":"b1","kind":"NOVEL","tags":["a","b"],"filter":{"minPages":"100","available":true},` +
+		`"publishedAfter":"2022-05-01T08:30:00.500Z","maxAge":"90s","minRating":4,"readMask":{"paths":["name","filter.min_pages"]},` +
+		`"dates":["2022-01-01T00:00:00Z","2022-01-01T16:00:00Z"]}`
+	if string(json) != expected {
+		t.Fatalf("expected %s, got %s", expected, json)
+	}
+
+	if err = Bind(msg, "kind", "1"); err != nil || msg.GetFieldByName("kind") != int32(1) {
+		t.Fatalf("expected enums by number, got %v: %v", msg.GetFieldByName("kind"), err)
+	}
+	if err = Bind(msg, "author", "x"); !errors.Is(err, ErrUnknownField) {
+		t.Fatalf("expected an unknown field, got %v", err)
+	}
+	for _, path := range []string{"filter.minPages", "kind", "labels", "name.first", "filter", "publishedAfter", "maxAge", "minRating"} {
+		if err = Bind(msg, path, "many"); err == nil || errors.Is(err, ErrUnknownField) {
+			t.Fatalf("%s: expected a bind error, got %v", path, err)
+		}
+	}
+}
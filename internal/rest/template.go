@@ -0,0 +1,241 @@
+package rest
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+type segmentKind int
+
+const (
+	literal segmentKind = iota
+	// wildcard * matches a single segment
+	wildcard
+	// deepWildcard ** matches the rest of the path
+	deepWildcard
+)
+
+type segment struct {
+	kind  segmentKind
+	value string
+}
+
+// variable a field bound to the segments from start to end of the template
+type variable struct {
+	field      string
+	start, end int
+}
+
+// Template a google.api.http path template like /v1/{name=shelves/*}/books:publish
+type Template struct {
+	raw       string
+	segments  []segment
+	variables []variable
+	verb      string
+}
+
+// Parse parses a path template, see google/api/http.proto for the syntax
+func Parse(template string) (*Template, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("template %q does not start with /", template)
+	}
+	t := &Template{raw: template}
+	rest := template[1:]
+	// the verb follows the last segment, colons inside variables are no verb
+	if i := strings.LastIndex(rest, ":"); i >= 0 && !strings.Contains(rest[i:], "}") && !strings.Contains(rest[i:], "/") {
+		rest, t.verb = rest[:i], rest[i+1:]
+	}
+	p := &parser{input: rest, template: t}
+	if err := p.segments(false); err != nil {
+		return nil, fmt.Errorf("template %q: %s", template, err)
+	}
+	for i, s := range t.segments {
+		if s.kind == deepWildcard && i != len(t.segments)-1 {
+			return nil, fmt.Errorf("template %q: ** must be the last segment", template)
+		}
+	}
+	return t, nil
+}
+
+type parser struct {
+	input    string
+	template *Template
+}
+
+func (p *parser) segments(inVariable bool) error {
+	for {
+		if err := p.segment(inVariable); err != nil {
+			return err
+		}
+		if p.input == "" || p.input[0] != '/' {
+			return nil
+		}
+		p.input = p.input[1:]
+	}
+}
+
+func (p *parser) segment(inVariable bool) error {
+	t := p.template
+	switch {
+	case strings.HasPrefix(p.input, "**"):
+		t.segments = append(t.segments, segment{kind: deepWildcard})
+		p.input = p.input[2:]
+	case strings.HasPrefix(p.input, "*"):
+		t.segments = append(t.segments, segment{kind: wildcard})
+		p.input = p.input[1:]
+	case strings.HasPrefix(p.input, "{"):
+		if inVariable {
+			return fmt.Errorf("nested variable")
+		}
+		end := strings.IndexByte(p.input, '}')
+		if end < 0 {
+			return fmt.Errorf("unclosed variable")
+		}
+		field, pattern := p.input[1:end], "*"
+		if i := strings.IndexByte(field, '='); i >= 0 {
+			field, pattern = field[:i], field[i+1:]
+		}
+		if field == "" {
+			return fmt.Errorf("variable without field")
+		}
+		p.input = p.input[end+1:]
+		start := len(t.segments)
+		sub := &parser{input: pattern, template: t}
+		if err := sub.segments(true); err != nil {
+			return err
+		}
+		if sub.input != "" {
+			return fmt.Errorf("unexpected %q in variable %s", sub.input, field)
+		}
+		t.variables = append(t.variables, variable{field: field, start: start, end: len(t.segments)})
+	default:
+		end := strings.IndexAny(p.input, "/{}*")
+		if end < 0 {
+			end = len(p.input)
+		}
+		if end == 0 {
+			return fmt.Errorf("empty segment")
+		}
+		t.segments = append(t.segments, segment{kind: literal, value: p.input[:end]})
+		p.input = p.input[end:]
+	}
+	return nil
+}
+
+func (t *Template) String() string {
+	return t.raw
+}
+
+// Pattern the template with every variable written as {field}, like the paths of OpenAPI
+func (t *Template) Pattern() string {
+	var sb strings.Builder
+	next := 0
+	for i, s := range t.segments {
+		if i < next {
+			continue
+		}
+		sb.WriteByte('/')
+		if v, ok := t.variableAt(i); ok {
+			sb.WriteString("{" + v.field + "}")
+			next = v.end
+			continue
+		}
+		switch s.kind {
+		case literal:
+			sb.WriteString(s.value)
+		case wildcard:
+			sb.WriteString("*")
+		case deepWildcard:
+			sb.WriteString("**")
+		}
+	}
+	if t.verb != "" {
+		sb.WriteString(":" + t.verb)
+	}
+	return sb.String()
+}
+
+func (t *Template) variableAt(segment int) (variable, bool) {
+	for _, v := range t.variables {
+		if v.start == segment {
+			return v, true
+		}
+	}
+	return variable{}, false
+}
+
+// Variables the fields bound by the variables of the template
+func (t *Template) Variables() []string {
+	fields := make([]string, 0, len(t.variables))
+	for _, v := range t.variables {
+		fields = append(fields, v.field)
+	}
+	return fields
+}
+
+// literals the number of literal segments, templates with more of them are more specific
+func (t *Template) literals() int {
+	n := 0
+	for _, s := range t.segments {
+		if s.kind == literal {
+			n++
+		}
+	}
+	return n
+}
+
+// Match matches a request path, it returns the values of the variables by field path
+func (t *Template) Match(path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	path = path[1:]
+	if t.verb != "" {
+		if !strings.HasSuffix(path, ":"+t.verb) {
+			return nil, false
+		}
+		path = strings.TrimSuffix(path, ":"+t.verb)
+	}
+	parts := strings.Split(path, "/")
+	// ends holds where every template segment ends within parts
+	ends := make([]int, len(t.segments))
+	i := 0
+	for n, s := range t.segments {
+		switch s.kind {
+		case deepWildcard:
+			i = len(parts)
+		case wildcard:
+			if i >= len(parts) || parts[i] == "" {
+				return nil, false
+			}
+			i++
+		case literal:
+			if i >= len(parts) || parts[i] != s.value {
+				return nil, false
+			}
+			i++
+		}
+		ends[n] = i
+	}
+	if i != len(parts) {
+		return nil, false
+	}
+	values := make(map[string]string, len(t.variables))
+	for _, v := range t.variables {
+		from := 0
+		if v.start > 0 {
+			from = ends[v.start-1]
+		}
+		captured := make([]string, 0, ends[v.end-1]-from)
+		for _, part := range parts[from:ends[v.end-1]] {
+			value, err := url.PathUnescape(part)
+			if err != nil {
+				return nil, false
+			}
+			captured = append(captured, value)
+		}
+		values[v.field] = strings.Join(captured, "/")
+	}
+	return values, true
+}
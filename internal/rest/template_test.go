@@ -0,0 +1,70 @@
+package rest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	valid := []string{"/v1/books", "/v1/books/{name}", "/v1/{name=shelves/*/books/*}", "/v1/{name=**}", "/v1/books/{name}:publish", "/v1/*/books"}
+	for _, template := range valid {
+		if _, err := Parse(template); err != nil {
+			t.Fatalf("%s: %v", template, err)
+		}
+	}
+	invalid := []string{"v1/books", "/v1/{name", "/v1/{name={id}}", "/v1/**/books", "/v1//books", "/v1/{=*}"}
+	for _, template := range invalid {
+		if _, err := Parse(template); err == nil {
+			t.Fatalf("expected %s to be invalid", template)
+		}
+	}
+}
+
+func TestTemplate_Match(t *testing.T) {
+	cases := []struct {
+		template string
+		path     string
+		values   map[string]string
+		ok       bool
+	}{
+		{"/v1/books", "/v1/books", map[string]string{}, true},
+		{"/v1/books", "/v1/books/1", nil, false},
+		{"/v1/books/{name}", "/v1/books/1", map[string]string{"name": "1"}, true},
+		{"/v1/books/{name}", "/v1/books/a%2Fb", map[string]string{"name": "a/b"}, true},
+		{"/v1/books/{name}", "/v1/books/", nil, false},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/s1/books/b1", map[string]string{"name": "shelves/s1/books/b1"}, true},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/s1/notes/b1", nil, false},
+		{"/v1/{shelf}/books/{book.id}", "/v1/s1/books/7", map[string]string{"shelf": "s1", "book.id": "7"}, true},
+		{"/v1/files/{path=**}", "/v1/files/a/b/c.txt", map[string]string{"path": "a/b/c.txt"}, true},
+		{"/v1/books/{name}:publish", "/v1/books/1:publish", map[string]string{"name": "1"}, true},
+		{"/v1/books/{name}:publish", "/v1/books/1", nil, false},
+	}
+	for _, c := range cases {
+		template, err := Parse(c.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values, ok := template.Match(c.path)
+		if ok != c.ok || ok && !reflect.DeepEqual(values, c.values) {
+			t.Fatalf("%s on %s: expected %v %v, got %v %v", c.template, c.path, c.values, c.ok, values, ok)
+		}
+	}
+}
+
+func TestTemplate_Pattern(t *testing.T) {
+	cases := map[string]string{
+		"/v1/books":                        "/v1/books",
+		"/v1/{name=shelves/*/books/*}":     "/v1/{name}",
+		"/v1/{shelf}/books/{book.id}:move": "/v1/{shelf}/books/{book.id}:move",
+		"/v1/*/files/{path=**}":            "/v1/*/files/{path}",
+	}
+	for template, pattern := range cases {
+		parsed, err := Parse(template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := parsed.Pattern(); got != pattern {
+			t.Fatalf("%s: expected %s, got %s", template, pattern, got)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package rpc
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"sync"
+	"time"
+)
+
+// MethodCache holds the resolved descriptors of a method. It is shared by concurrent
+// calls, so it never stores messages, every call creates its own request and response.
+type MethodCache struct {
+	msgFactory *dynamic.MessageFactory
+	src        *desc.ServiceDescriptor
+	md         *desc.MethodDescriptor
+	expire     time.Time
+}
+
+func (m *MethodCache) Method() *desc.MethodDescriptor {
+	return m.md
+}
+
+func (m *MethodCache) Service() *desc.ServiceDescriptor {
+	return m.src
+}
+
+func (m *MethodCache) MessageFactory() *dynamic.MessageFactory {
+	return m.msgFactory
+}
+
+// NewRequest returns a fresh message of the method input type
+func (m *MethodCache) NewRequest() proto.Message {
+	return m.msgFactory.NewMessage(m.md.GetInputType())
+}
+
+// NewResponse returns a fresh message of the method output type
+func (m *MethodCache) NewResponse() proto.Message {
+	return m.msgFactory.NewMessage(m.md.GetOutputType())
+}
+
+func (m *MethodCache) expired(now time.Time) bool {
+	return !m.expire.IsZero() && now.After(m.expire)
+}
+
+// DescriptorCache caches MethodCache by service/method, entries live for ttl, ttl <= 0 never expires.
+type DescriptorCache struct {
+	lock  sync.RWMutex
+	ttl   time.Duration
+	cache map[string]*MethodCache
+}
+
+func NewDescriptorCache(ttl time.Duration) *DescriptorCache {
+	return &DescriptorCache{ttl: ttl, cache: make(map[string]*MethodCache)}
+}
+
+func cacheKey(service, method string) string {
+	return service + "/" + method
+}
+
+func (r *DescriptorCache) GetCache(service, method string) *MethodCache {
+	r.lock.RLock()
+	c, ok := r.cache[cacheKey(service, method)]
+	r.lock.RUnlock()
+	if !ok {
+		return nil
+	}
+	if c.expired(time.Now()) {
+		r.lock.Lock()
+		// only drop it if nobody refreshed the entry meanwhile
+		if r.cache[cacheKey(service, method)] == c {
+			delete(r.cache, cacheKey(service, method))
+		}
+		r.lock.Unlock()
+		return nil
+	}
+	return c
+}
+
+func (r *DescriptorCache) SetCache(service, method string, cache *MethodCache) {
+	if r.ttl > 0 {
+		cache.expire = time.Now().Add(r.ttl)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cache[cacheKey(service, method)] = cache
+}
+
+// Invalidate drops the cached descriptors of a single method
+func (r *DescriptorCache) Invalidate(service, method string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.cache, cacheKey(service, method))
+}
+
+// Purge drops every cached descriptor
+func (r *DescriptorCache) Purge() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cache = make(map[string]*MethodCache)
+}
+
+func (r *DescriptorCache) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.cache)
+}
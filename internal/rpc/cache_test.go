@@ -0,0 +1,118 @@
+package rpc
+
+import (
+	"fmt"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	healthService = "grpc.health.v1.Health"
+	healthCheck   = "Check"
+)
+
+type countingSource struct {
+	DescriptorSource
+	calls int32
+}
+
+func (c *countingSource) FindSymbol(name string) (desc.Descriptor, error) {
+	atomic.AddInt32(&c.calls, 1)
+	return c.DescriptorSource.FindSymbol(name)
+}
+
+func TestDescriptorCache_TTL(t *testing.T) {
+	cache := NewDescriptorCache(30 * time.Millisecond)
+	cache.SetCache(healthService, healthCheck, &MethodCache{})
+	if cache.GetCache(healthService, healthCheck) == nil {
+		t.Fatal("expected cached entry")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if cache.GetCache(healthService, healthCheck) != nil {
+		t.Fatal("expected entry to expire")
+	}
+	if cache.Len() != 0 {
+		t.Fatal("expected expired entry to be dropped")
+	}
+
+	cache.SetCache(healthService, healthCheck, &MethodCache{})
+	cache.SetCache(healthService, "Watch", &MethodCache{})
+	cache.Invalidate(healthService, healthCheck)
+	if cache.GetCache(healthService, healthCheck) != nil || cache.GetCache(healthService, "Watch") == nil {
+		t.Fatal("expected only the invalidated method to be dropped")
+	}
+	cache.Purge()
+	if cache.Len() != 0 {
+		t.Fatal("expected purge to drop every entry")
+	}
+}
+
+func TestReflectionClient_Args(t *testing.T) {
+	rc := NewReflectionClient(startServer(t))
+	source := &countingSource{DescriptorSource: rc.descSource}
+	rc.descSource = source
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("svc-%d", i)
+			_, req, err := rc.Args(healthService, healthCheck, strings.NewReader(fmt.Sprintf(`{"service": %q}`, name)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			// every call must own its request message
+			if got := req.(*dynamic.Message).GetFieldByName("service"); got != name {
+				t.Errorf("expected %s, got %v", name, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if calls := atomic.LoadInt32(&source.calls); calls == 0 || calls > 20 {
+		t.Fatalf("unexpected descriptor lookups: %d", calls)
+	}
+	before := atomic.LoadInt32(&source.calls)
+	if _, _, err := rc.Args(healthService, healthCheck, strings.NewReader(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&source.calls) != before {
+		t.Fatal("expected descriptors to be served from cache")
+	}
+
+	rc.InvalidateMethod(healthService, healthCheck)
+	if _, _, err := rc.Args(healthService, healthCheck, strings.NewReader(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&source.calls) != before+1 {
+		t.Fatal("expected invalidated method to be resolved again")
+	}
+
+	rc.Invalidate()
+	if rc.cache.Len() != 0 || rc.source() == source {
+		t.Fatal("expected invalidation to drop descriptors and the reflection client")
+	}
+	cache, req, err := rc.Args(healthService, healthCheck, strings.NewReader(`{"service": "user"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.NewRequest() == req {
+		t.Fatal("expected fresh messages")
+	}
+}
+
+func TestReflectionClient_ArgsUnknownMethod(t *testing.T) {
+	rc := NewReflectionClient(startServer(t))
+	if _, _, err := rc.Args(healthService, "Missing", strings.NewReader(`{}`)); err == nil {
+		t.Fatal("expected unknown method error")
+	}
+	if _, _, err := rc.Args("no.such.Service", healthCheck, strings.NewReader(`{}`)); err == nil {
+		t.Fatal("expected unknown service error")
+	}
+}
@@ -0,0 +1,158 @@
+package rpc
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/dynamic"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// FieldDiff a field whose value differs between two messages
+type FieldDiff struct {
+	// Path of the field like user.roles[1].name, map keys are written as labels[key]
+	Path    string
+	Primary interface{}
+	Shadow  interface{}
+}
+
+func (d FieldDiff) String() string {
+	return fmt.Sprintf("%s: %v != %v", d.Path, d.Primary, d.Shadow)
+}
+
+// Diff compares two messages field by field. Fields are matched by name, so the messages may come
+// from different versions of a schema, a field only one of them knows is nil on the other side.
+func Diff(primary, shadow proto.Message) ([]FieldDiff, error) {
+	a, err := dynamic.AsDynamicMessage(primary)
+	if err != nil {
+		return nil, err
+	}
+	b, err := dynamic.AsDynamicMessage(shadow)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []FieldDiff
+	if err = diffMessage("", a, b, &diffs); err != nil {
+		return nil, err
+	}
+	return diffs, nil
+}
+
+func fieldPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func fieldValue(m *dynamic.Message, name string) interface{} {
+	fd := m.GetMessageDescriptor().FindFieldByName(name)
+	if fd == nil {
+		return nil
+	}
+	if fd.GetMessageType() != nil && !fd.IsRepeated() && !m.HasField(fd) {
+		return nil
+	}
+	return m.GetField(fd)
+}
+
+func diffMessage(path string, a, b *dynamic.Message, diffs *[]FieldDiff) error {
+	names := make(map[string]bool)
+	for _, m := range []*dynamic.Message{a, b} {
+		for _, fd := range m.GetKnownFields() {
+			names[fd.GetName()] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		if err := diffValue(fieldPath(path, name), fieldValue(a, name), fieldValue(b, name), diffs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func diffValue(path string, a, b interface{}, diffs *[]FieldDiff) error {
+	switch av := a.(type) {
+	case proto.Message:
+		bv, ok := b.(proto.Message)
+		if !ok || isNil(av) || isNil(bv) {
+			break
+		}
+		am, err := dynamic.AsDynamicMessage(av)
+		if err != nil {
+			return err
+		}
+		bm, err := dynamic.AsDynamicMessage(bv)
+		if err != nil {
+			return err
+		}
+		return diffMessage(path, am, bm, diffs)
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(av) || i < len(bv); i++ {
+			var ai, bi interface{}
+			if i < len(av) {
+				ai = av[i]
+			}
+			if i < len(bv) {
+				bi = bv[i]
+			}
+			if err := diffValue(fmt.Sprintf("%s[%d]", path, i), ai, bi, diffs); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[interface{}]interface{}:
+		bv, ok := b.(map[interface{}]interface{})
+		if !ok {
+			break
+		}
+		keys := make(map[interface{}]bool)
+		for k := range av {
+			keys[k] = true
+		}
+		for k := range bv {
+			keys[k] = true
+		}
+		sorted := make([]interface{}, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Slice(sorted, func(i, j int) bool { return fmt.Sprint(sorted[i]) < fmt.Sprint(sorted[j]) })
+		for _, k := range sorted {
+			if err := diffValue(fmt.Sprintf("%s[%v]", path, k), av[k], bv[k], diffs); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !reflect.DeepEqual(a, b) && !(isNil(a) && isNil(b)) {
+		*diffs = append(*diffs, FieldDiff{Path: path, Primary: render(a), Shadow: render(b)})
+	}
+	return nil
+}
+
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	return rv.Kind() == reflect.Ptr && rv.IsNil()
+}
+
+// render makes messages readable in a log line
+func render(v interface{}) interface{} {
+	if m, ok := v.(proto.Message); ok && !isNil(m) {
+		return strings.TrimSpace(proto.CompactTextString(m))
+	}
+	return v
+}
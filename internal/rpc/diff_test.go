@@ -0,0 +1,91 @@
+package rpc
+
+import (
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+	"testing"
+)
+
+const userProto = `syntax = "proto3";
+package demo;
+
+message Role {
+  string name = 1;
+}
+
+message User {
+  int64 id = 1;
+  string name = 2;
+  repeated Role roles = 3;
+  map<string, string> labels = 4;
+  Role primary = 5;
+}
+`
+
+// userV2 drops name and adds email
+const userV2Proto = `syntax = "proto3";
+package demo;
+
+message Role {
+  string name = 1;
+}
+
+message User {
+  int64 id = 1;
+  repeated Role roles = 3;
+  map<string, string> labels = 4;
+  Role primary = 5;
+  string email = 6;
+}
+`
+
+func parseUser(t *testing.T, source string) *desc.MessageDescriptor {
+	parser := protoparse.Parser{Accessor: protoparse.FileContentsFromMap(map[string]string{"user.proto": source})}
+	fds, err := parser.ParseFiles("user.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fds[0].FindMessage("demo.User")
+}
+
+func newUser(t *testing.T, md *desc.MessageDescriptor, json string) *dynamic.Message {
+	msg := dynamic.NewMessage(md)
+	if err := msg.UnmarshalJSON([]byte(json)); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestDiff(t *testing.T) {
+	v1, v2 := parseUser(t, userProto), parseUser(t, userV2Proto)
+	primary := newUser(t, v1, `{"id": 1, "name": "woody", "roles": [{"name": "admin"}, {"name": "dev"}], "labels": {"team": "qa"}, "primary": {"name": "admin"}}`)
+
+	diffs, err := Diff(primary, newUser(t, v1, `{"id": 1, "name": "woody", "roles": [{"name": "admin"}, {"name": "dev"}], "labels": {"team": "qa"}, "primary": {"name": "admin"}}`))
+	if err != nil || len(diffs) != 0 {
+		t.Fatalf("expected equal messages, got %v, %v", diffs, err)
+	}
+
+	diffs, err = Diff(primary, newUser(t, v2, `{"id": 2, "email": "w@pity.io", "roles": [{"name": "admin"}, {"name": "ops"}, {"name": "dev"}], "labels": {"team": "dev", "zone": "sh"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"email: <nil> != w@pity.io",
+		"id: 1 != 2",
+		"labels[team]: qa != dev",
+		"labels[zone]: <nil> != sh",
+		"name: woody != <nil>",
+		`primary: name:"admin" != <nil>`,
+		"roles[1].name: dev != ops",
+		`roles[2]: <nil> != name:"dev"`,
+	}
+	if len(diffs) != len(expected) {
+		t.Fatalf("expected %d differences, got %v", len(expected), diffs)
+	}
+	for i, d := range diffs {
+		if d.String() != expected[i] {
+			t.Fatalf("expected %s, got %s", expected[i], d)
+		}
+	}
+}
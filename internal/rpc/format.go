@@ -5,6 +5,7 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/jhump/protoreflect/desc"
 	"github.com/jhump/protoreflect/dynamic"
+	"reflect"
 	"strings"
 	"sync"
 )
@@ -47,6 +48,10 @@ func (r *anyResolver) Resolve(typeUrl string) (proto.Message, error) {
 	// use descriptor source to resolve message type
 	d, err := r.source.FindSymbol(mname)
 	if err != nil {
+		// fall back to the types linked into the gateway, like google.rpc error details
+		if mt := proto.MessageType(mname); mt != nil {
+			return reflect.New(mt.Elem()).Interface().(proto.Message), nil
+		}
 		return nil, err
 	}
 	md, ok := d.(*desc.MessageDescriptor)
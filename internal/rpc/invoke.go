@@ -7,9 +7,10 @@ import (
 	"errors"
 	"fmt"
 	"github.com/golang/protobuf/proto"
+	"github.com/wuranxu/light/conf"
 	"github.com/wuranxu/light/internal/auth"
+	"github.com/wuranxu/light/internal/balancer"
 	"github.com/wuranxu/light/internal/service/etcd"
-	"go.etcd.io/etcd/client/v3/naming/resolver"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
 	"io"
@@ -19,17 +20,15 @@ import (
 
 var (
 	MethodNotFound = errors.New("没有找到对应的方法，请检查您的参数")
-	invokeConfig   = `{
-	  "loadBalancingConfig": [ { "round_robin": {} } ],
-	  "methodConfig": []
-	}
-	`
+	invokeConfig   = balancer.ServiceConfig
 )
 
 type GrpcClient struct {
-	cc  *grpc.ClientConn
-	cli *etcd.Client
-	rc  *ReflectionClient
+	cc      *grpc.ClientConn
+	cli     *etcd.Client
+	rc      *ReflectionClient
+	breaker *balancer.Breaker
+	stop    context.CancelFunc
 }
 
 //func (c *GrpcClient) Invoke(method etcd.Method, in *Request, ip string, userInfo *auth.UserInfo, opts ...grpc.CallOption) (*Response, error) {
@@ -47,26 +46,54 @@ type GrpcClient struct {
 //	return out, nil
 //}
 
-func (c *GrpcClient) InvokeWithReflect(method etcd.Method, in io.ReadCloser, ip string, userInfo *auth.UserInfo, opts ...grpc.CallOption) (proto.Message, error) {
-	split := strings.Split(method.Path, "/")
-	service, mth := split[len(split)-2], split[len(split)-1]
+// splitPath splits a grpc path like /package.Service/Method into service and method
+func splitPath(path string) (string, string) {
+	split := strings.Split(path, "/")
+	if len(split) < 2 {
+		return "", path
+	}
+	return split[len(split)-2], split[len(split)-1]
+}
+
+// outgoing builds the metadata every backend call carries
+func outgoing(ip string, userInfo *auth.UserInfo) metadata.MD {
 	md := metadata.New(map[string]string{"host": ip})
 	if userInfo != nil {
 		md.Append("user", base64.StdEncoding.EncodeToString(userInfo.Marshal()))
 	}
+	return md
+}
+
+// Describe returns the descriptors of the method registered in etcd
+func (c *GrpcClient) Describe(method etcd.Method) (*MethodCache, error) {
+	service, mth := splitPath(method.Path)
+	return c.rc.Method(service, mth)
+}
+
+// InvokeWithReflect calls a unary method. The deadline of ctx is propagated to the backend, without
+// one the default timeout of the method applies.
+func (c *GrpcClient) InvokeWithReflect(ctx context.Context, method etcd.Method, in io.ReadCloser, ip string, userInfo *auth.UserInfo, opts ...grpc.CallOption) (proto.Message, error) {
+	return c.InvokeAs(ctx, method, in, JsonFormat, ip, userInfo, opts...)
+}
+
+// InvokeAs calls a unary method like InvokeWithReflect with a request body encoded in format
+func (c *GrpcClient) InvokeAs(ctx context.Context, method etcd.Method, in io.ReadCloser, format Format, ip string, userInfo *auth.UserInfo, opts ...grpc.CallOption) (proto.Message, error) {
+	service, mth := splitPath(method.Path)
+	md := outgoing(ip, userInfo)
 	client := c.rc
-	cache, err := client.Args(service, mth, in)
+	cache, req, err := client.ArgsAs(service, mth, in, format)
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, CallTimeout(method, 0))
+		defer cancel()
+	}
 	ctx = metadata.NewOutgoingContext(ctx, md)
-	defer cancel()
-	err = c.cc.Invoke(ctx, method.Path, cache.req, cache.res, opts...)
-	//unary, err := client.InvokeUnary(ctx, cache.msgFactory, cache.md, cache.req, opts...)
-	//fmt.Println(time.Now().Unix())
-	//return unary, err
-	return cache.res, err
+	res := cache.NewResponse()
+	err = c.invoke(ctx, method, req, res, opts...)
+	return res, err
 }
 
 func (c *GrpcClient) Marshal(w io.Writer, msg proto.Message) error {
@@ -74,13 +101,18 @@ func (c *GrpcClient) Marshal(w io.Writer, msg proto.Message) error {
 }
 
 func (c *GrpcClient) Close() error {
-	//if c != nil {
-	//	return c.po.Close()
-	//}
-	//return nil
+	if c.stop != nil {
+		c.stop()
+	}
+	c.rc.Reset()
 	return c.cc.Close()
 }
 
+// Conn returns the underlying connection shared by all calls of this client
+func (c *GrpcClient) Conn() *grpc.ClientConn {
+	return c.cc
+}
+
 func (c *GrpcClient) SearchCallAddr(version, service, method string) (etcd.Method, error) {
 	var md etcd.Method
 	addr := c.cli.GetSingle(fmt.Sprintf("%s.%s.%s", version, service, method))
@@ -94,21 +126,63 @@ func (c *GrpcClient) SearchCallAddr(version, service, method string) (etcd.Metho
 	return md, nil
 }
 
+// SearchSplit returns the traffic split rule of a method, nil when its calls are not split
+func (c *GrpcClient) SearchSplit(version, service, method string) (*etcd.SplitRule, error) {
+	return c.cli.GetSplit(version, service, method)
+}
+
+// SearchMirror returns the mirror rule of a method, nil when its calls are not mirrored
+func (c *GrpcClient) SearchMirror(version, service, method string) (*etcd.Mirror, error) {
+	return c.cli.GetMirror(version, service, method)
+}
+
 func NewGrpcClient(service string) (*GrpcClient, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
-	//addr := fmt.Sprintf("%s:///%s", etcd.Resolver.Scheme(), service)
-	etcdResolver, err := resolver.NewBuilder(etcd.Cli.Cli())
+	conn, err := grpc.DialContext(ctx, etcd.Resolver.Scheme()+":///"+service,
+		grpc.WithResolvers(etcd.Resolver),
+		grpc.WithDefaultServiceConfig(invokeConfig),
+		grpc.WithInsecure())
 	if err != nil {
 		return nil, err
 	}
-	conn, err := grpc.DialContext(ctx, "etcd:///"+service, grpc.WithResolvers(etcdResolver), grpc.WithInsecure())
-	//conn, err := grpc.DialContext(ctx, addr,
-	//	grpc.WithResolvers(etcd.Resolver),
-	//	grpc.WithDefaultServiceConfig(invokeConfig),
-	//	grpc.WithInsecure())
-	if err != nil {
-		return nil, err
+	client := NewClient(conn, etcd.Cli)
+	if cfg, ok := conf.Conf.Descriptors[service]; ok {
+		files, err := DescriptorSourceFromConfig(cfg)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		client.rc.SetFileSource(cfg.Source, files)
 	}
-	return &GrpcClient{conn, etcd.Cli, NewReflectionClient(conn)}, nil
+	// a changed instance set may come with a new schema, forget what we know about it
+	watchCtx, stop := context.WithCancel(context.Background())
+	client.stop = stop
+	go etcd.Cli.WatchService(watchCtx, service, client.rc.Invalidate)
+	return client, nil
+}
+
+// NewClient wraps an established connection, the client takes ownership of conn
+func NewClient(conn *grpc.ClientConn, cli *etcd.Client) *GrpcClient {
+	breaker := balancer.NewBreaker(func() conf.BreakerConfig { return conf.Conf.Breaker })
+	return &GrpcClient{cc: conn, cli: cli, rc: NewReflectionClient(conn), breaker: breaker}
+}
+
+// record tells the breaker how a call made with ctx went
+func (c *GrpcClient) record(ctx context.Context, err error) {
+	if balancer.ClientDeadline(ctx, err) {
+		c.breaker.Abandon()
+		return
+	}
+	c.breaker.Record(err)
+}
+
+// Breaker returns the circuit breaker guarding the service
+func (c *GrpcClient) Breaker() *balancer.Breaker {
+	return c.breaker
+}
+
+// Reflection returns the reflection client of the backend
+func (c *GrpcClient) Reflection() *ReflectionClient {
+	return c.rc
 }
@@ -1,9 +1,49 @@
 package rpc
 
 import (
+	"bytes"
+	"context"
+	"github.com/golang/protobuf/proto"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/test/bufconn"
+	"io/ioutil"
+	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
+// startServer serves the health and reflection services in process
+func startServer(t *testing.T, register ...func(*grpc.Server)) *grpc.ClientConn {
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	reflection.Register(srv)
+	for _, r := range register {
+		r(srv)
+	}
+	return serve(t, srv)
+}
+
+// serve starts srv on an in memory listener and dials it
+func serve(t *testing.T, srv *grpc.Server) *grpc.ClientConn {
+	lis := bufconn.Listen(1024 * 1024)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return lis.Dial()
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
 func TestGrpcClient_InvokeWithReflect(t *testing.T) {
 	//conf.Init("J:\\projects\\github.com\\wuranxu\\light\\resources\\application.yml")
 	//etcd.Init(conf.Conf.Etcd)
@@ -19,3 +59,38 @@ func TestGrpcClient_InvokeWithReflect(t *testing.T) {
 	//}
 	//fmt.Println(reflect)
 }
+
+func ctxTimeout(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestGrpcClient_InvokeAs(t *testing.T) {
+	srv := grpc.NewServer()
+	hs := health.NewServer()
+	hs.SetServingStatus("user", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(srv, hs)
+	reflection.Register(srv)
+	client := NewClient(serve(t, srv), nil)
+	method := etcd.Method{Path: "/" + healthService + "/" + healthCheck}
+	body, err := proto.Marshal(&healthpb.HealthCheckRequest{Service: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.InvokeAs(ctxTimeout(t), method, ioutil.NopCloser(bytes.NewReader(body)), ProtoFormat, "127.0.0.1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out healthpb.HealthCheckResponse
+	data, _ := proto.Marshal(resp)
+	if err = proto.Unmarshal(data, &out); err != nil || out.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("expected NOT_SERVING, got %v: %v", out.Status, err)
+	}
+
+	// a json body is no protobuf
+	if _, err = client.InvokeAs(ctxTimeout(t), method, ioutil.NopCloser(strings.NewReader(`{"service": "user"}`)), ProtoFormat, "127.0.0.1", nil); err == nil {
+		t.Fatal("expected a json body to fail as protobuf")
+	}
+}
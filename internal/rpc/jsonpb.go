@@ -11,75 +11,115 @@ import (
 	"github.com/jhump/protoreflect/dynamic"
 	"github.com/jhump/protoreflect/dynamic/grpcdynamic"
 	"github.com/jhump/protoreflect/grpcreflect"
+	"github.com/wuranxu/light/conf"
 	"github.com/wuranxu/light/internal/errors"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
-	reflectpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
 	"google.golang.org/grpc/status"
 	"io"
+	"io/ioutil"
 	"sync"
-)
-
-var (
-	MemCache = &MemoryCache{cache: make(map[string]*MethodCache)}
+	"time"
 )
 
 type ReflectionClient struct {
 	conn       *grpc.ClientConn
+	lock       sync.RWMutex
 	client     *grpcreflect.Client
+	stub       *reflectionStub
 	descSource DescriptorSource
-	dec        *json.Decoder
+	files      DescriptorSource
+	mode       string
+	cache      *DescriptorCache
 }
 
 func (r *ReflectionClient) Marshal(w io.Writer, msg proto.Message) error {
-	resolver := &anyResolver{source: r.descSource}
+	resolver := &anyResolver{source: r.source()}
 	m := jsonpb.Marshaler{AnyResolver: resolver, EmitDefaults: true, Indent: "    "}
 	return m.Marshal(w, msg)
 }
 
-type MemoryCache struct {
-	lock  sync.RWMutex
-	cache map[string]*MethodCache
+func (r *ReflectionClient) source() DescriptorSource {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.descSource
+}
+
+func DescriptorSourceFromServer(_ context.Context, refClient *grpcreflect.Client) DescriptorSource {
+	return serverSource{client: refClient}
+}
+
+func NewReflectionClient(conn *grpc.ClientConn) *ReflectionClient {
+	ttl := time.Duration(conf.Conf.Cache.DescriptorTTL) * time.Second
+	r := &ReflectionClient{conn: conn, cache: NewDescriptorCache(ttl), stub: newReflectionStub(conn)}
+	r.connect()
+	return r
+}
+
+func (r *ReflectionClient) connect() {
+	ctx := context.Background()
+	r.client = grpcreflect.NewClient(ctx, r.stub)
+	server := DescriptorSourceFromServer(ctx, r.client)
+	switch {
+	case r.files == nil || r.mode == conf.SourceReflection:
+		r.descSource = server
+	case r.mode == conf.SourceFile:
+		r.descSource = r.files
+	default:
+		r.descSource = DescriptorSourceWithFallback(server, r.files)
+	}
 }
 
-type MethodCache struct {
-	msgFactory *dynamic.MessageFactory
-	src        *desc.ServiceDescriptor
-	md         *desc.MethodDescriptor
-	req        proto.Message
-	res        proto.Message
+// SetFileSource makes the client use descriptors from files, mode is one of the conf.Source* values
+func (r *ReflectionClient) SetFileSource(mode string, files DescriptorSource) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.client != nil {
+		r.client.Reset()
+	}
+	r.mode, r.files = mode, files
+	r.connect()
+	r.cache.Purge()
 }
 
-func (r *MemoryCache) GetCache(service, method string) *MethodCache {
+// Reset releases the reflection stream held by the client
+func (r *ReflectionClient) Reset() {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
-	c, ok := r.cache[service+"/"+method]
-	if !ok {
-		return nil
+	if r.client != nil {
+		r.client.Reset()
 	}
-	return c
 }
 
-func (r *MemoryCache) SetCache(service, method string, cache *MethodCache) {
+// Invalidate forgets every descriptor known about the backend, including the files
+// cached by the reflection client, so the next call fetches the schema again.
+func (r *ReflectionClient) Invalidate() {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	r.cache[service+"/"+method] = cache
+	if r.client != nil {
+		r.client.Reset()
+	}
+	// a redeployed backend may speak another reflection version
+	r.stub = newReflectionStub(r.conn)
+	r.connect()
+	r.cache.Purge()
 }
 
-func DescriptorSourceFromServer(_ context.Context, refClient *grpcreflect.Client) DescriptorSource {
-	return serverSource{client: refClient}
+// ReflectionVersion returns the reflection service negotiated with the backend, empty until the first lookup
+func (r *ReflectionClient) ReflectionVersion() string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.stub.Version()
 }
 
-func NewReflectionClient(conn *grpc.ClientConn) *ReflectionClient {
-	ctx := context.Background()
-	refClient := grpcreflect.NewClient(ctx, reflectpb.NewServerReflectionClient(conn))
-	reflSource := DescriptorSourceFromServer(ctx, refClient)
-	return &ReflectionClient{descSource: reflSource, conn: conn}
+// InvalidateMethod forgets the cached descriptors of a single method
+func (r *ReflectionClient) InvalidateMethod(service, method string) {
+	r.cache.Invalidate(service, method)
 }
 
 func (r *ReflectionClient) FindSymbol(service string) (desc.Descriptor, error) {
-	dsc, err := r.descSource.FindSymbol(service)
+	dsc, err := r.source().FindSymbol(service)
 	if err != nil {
 		errStatus, hasStatus := status.FromError(err)
 		switch {
@@ -88,9 +128,11 @@ func (r *ReflectionClient) FindSymbol(service string) (desc.Descriptor, error) {
 		case hasStatus:
 			return nil, status.Errorf(errStatus.Code(), "failed to query for service descriptor %q: %s", service, errStatus.Message())
 		case errors.IsNotFoundError(err):
-			return nil, fmt.Errorf("target server does not expose service %q", service)
+			return nil, status.Errorf(codes.NotFound, "target server does not expose service %q", service)
+		case err == errors.ErrReflectionNotSupported:
+			return nil, status.Errorf(codes.Unimplemented, "failed to query for service descriptor %q: %v", service, err)
 		}
-		return nil, fmt.Errorf("failed to query for service descriptor %q: %v", service, err)
+		return nil, status.Errorf(codes.Unknown, "failed to query for service descriptor %q: %v", service, err)
 	}
 	return dsc, nil
 }
@@ -98,50 +140,33 @@ func (r *ReflectionClient) FindSymbol(service string) (desc.Descriptor, error) {
 func (r *ReflectionClient) Descriptor(dsc desc.Descriptor, service, method string) (*MethodCache, error) {
 	sd, ok := dsc.(*desc.ServiceDescriptor)
 	if !ok {
-		return nil, fmt.Errorf("target server does not expose service %q", service)
+		return nil, status.Errorf(codes.NotFound, "target server does not expose service %q", service)
 	}
 	mtd := sd.FindMethodByName(method)
 	if mtd == nil {
-		return nil, fmt.Errorf("service %q does not include a method named %q", service, method)
+		return nil, status.Errorf(codes.NotFound, "service %q does not include a method named %q", service, method)
 	}
 	var ext dynamic.ExtensionRegistry
 	alreadyFetched := map[string]bool{}
-	if err := fetchAllExtensions(r.descSource, &ext, mtd.GetInputType(), alreadyFetched); err != nil {
+	source := r.source()
+	if err := fetchAllExtensions(source, &ext, mtd.GetInputType(), alreadyFetched); err != nil {
 		return nil, fmt.Errorf("error resolving server extensions for message %s: %v", mtd.GetInputType().GetFullyQualifiedName(), err)
 	}
-	if err := fetchAllExtensions(r.descSource, &ext, mtd.GetOutputType(), alreadyFetched); err != nil {
+	if err := fetchAllExtensions(source, &ext, mtd.GetOutputType(), alreadyFetched); err != nil {
 		return nil, fmt.Errorf("error resolving server extensions for message %s: %v", mtd.GetOutputType().GetFullyQualifiedName(), err)
 	}
-	msgFactory := dynamic.NewMessageFactoryWithExtensionRegistry(&ext)
-	req := msgFactory.NewMessage(mtd.GetInputType())
-	res := msgFactory.NewMessage(mtd.GetOutputType())
 	return &MethodCache{
 		src:        sd,
 		md:         mtd,
-		req:        req,
-		res:        res,
-		msgFactory: msgFactory,
+		msgFactory: dynamic.NewMessageFactoryWithExtensionRegistry(&ext),
 	}, nil
 }
 
-func (r *ReflectionClient) Stub(msgFactory *dynamic.MessageFactory) grpcdynamic.Stub {
-	return grpcdynamic.NewStubWithMessageFactory(r.conn, msgFactory)
-
-}
-
-func (r *ReflectionClient) Args(service, method string, in io.ReadCloser) (*MethodCache, error) {
-	//cache := MemCache.GetCache(service, method)
-	//if cache == nil {
-	//	dsc, err := r.FindSymbol(service)
-	//	if err != nil {
-	//		return nil, err
-	//	}
-	//	cache, err = r.Descriptor(dsc, service, method)
-	//	if err != nil {
-	//		return nil, err
-	//	}
-	//	MemCache.SetCache(service, method, cache)
-	//}
+// Method returns the descriptors of service/method, from cache when possible
+func (r *ReflectionClient) Method(service, method string) (*MethodCache, error) {
+	if cache := r.cache.GetCache(service, method); cache != nil {
+		return cache, nil
+	}
 	dsc, err := r.FindSymbol(service)
 	if err != nil {
 		return nil, err
@@ -150,16 +175,57 @@ func (r *ReflectionClient) Args(service, method string, in io.ReadCloser) (*Meth
 	if err != nil {
 		return nil, err
 	}
+	r.cache.SetCache(service, method, cache)
+	return cache, nil
+}
+
+func (r *ReflectionClient) Stub(msgFactory *dynamic.MessageFactory) grpcdynamic.Stub {
+	return grpcdynamic.NewStubWithMessageFactory(r.conn, msgFactory)
+
+}
 
+// Format the encoding of the messages in http bodies
+type Format int
+
+const (
+	JsonFormat Format = iota
+	// ProtoFormat binary protobuf
+	ProtoFormat
+)
+
+// Args decodes the json body into a new request message of service/method
+func (r *ReflectionClient) Args(service, method string, in io.Reader) (*MethodCache, proto.Message, error) {
+	return r.ArgsAs(service, method, in, JsonFormat)
+}
+
+// ArgsAs decodes the body in format into a new request message of service/method
+func (r *ReflectionClient) ArgsAs(service, method string, in io.Reader, format Format) (*MethodCache, proto.Message, error) {
+	cache, err := r.Method(service, method)
+	if err != nil {
+		return nil, nil, err
+	}
+	req := cache.NewRequest()
+	if format == ProtoFormat {
+		data, err := ioutil.ReadAll(in)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cache, req, proto.Unmarshal(data, req)
+	}
 	var msg json.RawMessage
 	dec := json.NewDecoder(in)
 	if err := dec.Decode(&msg); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	resolver := &anyResolver{source: r.descSource}
+	err = r.Unmarshal(msg, req)
+	return cache, req, err
+}
+
+// Unmarshal decodes json data into msg, Any fields are resolved through the backend descriptors
+func (r *ReflectionClient) Unmarshal(data []byte, msg proto.Message) error {
+	resolver := &anyResolver{source: r.source()}
 	unmarshaler := jsonpb.Unmarshaler{AnyResolver: resolver, AllowUnknownFields: true}
-	err = unmarshaler.Unmarshal(bytes.NewReader(msg), cache.req)
-	return cache, err
+	return unmarshaler.Unmarshal(bytes.NewReader(data), msg)
 }
 
 func (r *ReflectionClient) InvokeUnary(ctx context.Context, msgFactory *dynamic.MessageFactory, method *desc.MethodDescriptor, req proto.Message, opts ...grpc.CallOption) (proto.Message, error) {
@@ -0,0 +1,113 @@
+package rpc
+
+import (
+	"context"
+	"github.com/wuranxu/light/internal/auth"
+	"github.com/wuranxu/light/internal/balancer"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"io"
+	"strings"
+)
+
+// Frame a message passed through without decoding it
+type Frame struct {
+	payload []byte
+}
+
+// RawCodec moves frames as they are, it keeps the name of the proto codec so backends see the usual
+// content type
+type RawCodec struct{}
+
+func (RawCodec) Marshal(v interface{}) ([]byte, error) {
+	return v.(*Frame).payload, nil
+}
+
+func (RawCodec) Unmarshal(data []byte, v interface{}) error {
+	f := v.(*Frame)
+	// grpc reuses data once Unmarshal returns
+	f.payload = append(f.payload[:0], data...)
+	return nil
+}
+
+func (RawCodec) Name() string {
+	return "proto"
+}
+
+// proxied drops the incoming metadata that must not reach the backend, the gateway sets host and user
+// itself and grpc sets the rest
+func proxied(md metadata.MD) metadata.MD {
+	out := metadata.MD{}
+	for k, v := range md {
+		switch {
+		case k == "host", k == "user", k == "token", k == "authorization", k == "x-api-version", k == "user-agent",
+			strings.HasPrefix(k, ":"), strings.HasPrefix(k, "grpc-"):
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// Proxy relays the stream of a native grpc client to the backend frame by frame. Client metadata is
+// forwarded, host and user are replaced like in InvokeWithReflect. The returned error is the status
+// of the backend.
+func (c *GrpcClient) Proxy(ss grpc.ServerStream, method etcd.Method, ip string, userInfo *auth.UserInfo) (err error) {
+	if !c.breaker.Allow() {
+		return balancer.ErrCircuitOpen
+	}
+	defer func() { c.record(ss.Context(), err) }()
+	md, _ := metadata.FromIncomingContext(ss.Context())
+	md = metadata.Join(proxied(md), outgoing(ip, userInfo))
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(ss.Context(), md))
+	defer cancel()
+	desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+	cs, err := c.cc.NewStream(ctx, desc, method.Path, grpc.ForceCodec(RawCodec{}))
+	if err != nil {
+		return err
+	}
+
+	// requests flow on their own, the backend answer ends the call
+	go func() {
+		for {
+			f := new(Frame)
+			if err := ss.RecvMsg(f); err != nil {
+				if err == io.EOF {
+					cs.CloseSend()
+				} else {
+					cancel()
+				}
+				return
+			}
+			if err := cs.SendMsg(f); err != nil {
+				// the backend failed, RecvMsg below reports why
+				return
+			}
+		}
+	}()
+
+	header, err := cs.Header()
+	if err != nil {
+		// the call failed before any header, the status comes with the trailers
+		err = cs.RecvMsg(new(Frame))
+		ss.SetTrailer(cs.Trailer())
+		return err
+	}
+	if err = ss.SendHeader(header); err != nil {
+		return err
+	}
+	for {
+		f := new(Frame)
+		if err = cs.RecvMsg(f); err != nil {
+			ss.SetTrailer(cs.Trailer())
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err = ss.SendMsg(f); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package rpc
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/wuranxu/light/internal/auth"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+// metadataHealth hands the metadata of every Check call to the test
+type metadataHealth struct {
+	*health.Server
+	md chan metadata.MD
+}
+
+func (m *metadataHealth) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	m.md <- md
+	return m.Server.Check(ctx, req)
+}
+
+func TestGrpcClient_Proxy(t *testing.T) {
+	srv := grpc.NewServer()
+	backend := &metadataHealth{Server: health.NewServer(), md: make(chan metadata.MD, 1)}
+	backend.SetServingStatus("user", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(srv, backend)
+	client := NewClient(serve(t, srv), nil)
+	user := &auth.UserInfo{ID: 7, Name: "woody"}
+
+	proxy := grpc.NewServer(grpc.ForceServerCodec(RawCodec{}), grpc.UnknownServiceHandler(func(_ interface{}, ss grpc.ServerStream) error {
+		path, _ := grpc.MethodFromServerStream(ss)
+		return client.Proxy(ss, etcd.Method{Path: path}, "10.0.0.1", user)
+	}))
+	hc := healthpb.NewHealthClient(serve(t, proxy))
+
+	ctx := metadata.AppendToOutgoingContext(ctxTimeout(t), "token", "secret", "user", "forged", "trace-id", "abc")
+	resp, err := hc.Check(ctx, &healthpb.HealthCheckRequest{Service: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("expected the backend answer, got %v", resp.Status)
+	}
+	md := <-backend.md
+	expected := map[string][]string{
+		"host":     {"10.0.0.1"},
+		"user":     {base64.StdEncoding.EncodeToString(user.Marshal())},
+		"trace-id": {"abc"},
+		"token":    nil,
+	}
+	for k, v := range expected {
+		if got := md.Get(k); len(got) != len(v) || len(v) > 0 && got[0] != v[0] {
+			t.Fatalf("expected %s to be %v, got %v", k, v, got)
+		}
+	}
+
+	// the status of the backend reaches the client
+	_, err = hc.Check(ctx, &healthpb.HealthCheckRequest{Service: "order"})
+	<-backend.md
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+
+	// server streams are relayed message by message
+	stream, err := hc.Watch(ctx, &healthpb.HealthCheckRequest{Service: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = stream.Recv(); err != nil || resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("expected NOT_SERVING, got %v %v", resp, err)
+	}
+	backend.SetServingStatus("user", healthpb.HealthCheckResponse_SERVING)
+	if resp, err = stream.Recv(); err != nil || resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("expected SERVING, got %v %v", resp, err)
+	}
+}
@@ -1,9 +1,20 @@
 package rpc
 
 import (
+	"context"
 	"github.com/jhump/protoreflect/desc"
 	"github.com/jhump/protoreflect/grpcreflect"
 	"github.com/wuranxu/light/internal/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	reflectpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"sync"
+)
+
+const (
+	ReflectionV1      = "grpc.reflection.v1.ServerReflection"
+	ReflectionV1Alpha = "grpc.reflection.v1alpha.ServerReflection"
 )
 
 type DescriptorSource interface {
@@ -52,3 +63,98 @@ func (ss serverSource) AllExtensionsForType(typeName string) ([]*desc.FieldDescr
 	}
 	return exts, nil
 }
+
+// reflectionStub speaks grpc.reflection.v1 or v1alpha, whichever the backend supports. Both versions
+// share the same messages on the wire, only the service name differs. The negotiated version is
+// remembered, so it is probed once per connection.
+type reflectionStub struct {
+	cc          grpc.ClientConnInterface
+	lock        sync.Mutex
+	service     string
+	unsupported bool
+}
+
+func newReflectionStub(cc grpc.ClientConnInterface) *reflectionStub {
+	return &reflectionStub{cc: cc}
+}
+
+// Version returns the negotiated reflection service, empty before negotiation or if none is supported
+func (s *reflectionStub) Version() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.service
+}
+
+func (s *reflectionStub) ServerReflectionInfo(ctx context.Context, opts ...grpc.CallOption) (reflectpb.ServerReflection_ServerReflectionInfoClient, error) {
+	service, err := s.negotiate(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s.open(ctx, service, opts...)
+}
+
+func (s *reflectionStub) negotiate(ctx context.Context, opts ...grpc.CallOption) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.service != "" {
+		return s.service, nil
+	}
+	if s.unsupported {
+		return "", errors.ErrReflectionNotSupported
+	}
+	for _, service := range []string{ReflectionV1, ReflectionV1Alpha} {
+		err := s.probe(ctx, service, opts...)
+		if err == nil {
+			s.service = service
+			return service, nil
+		}
+		if status.Code(err) != codes.Unimplemented {
+			// the backend may just be unreachable, try again next time
+			return "", err
+		}
+	}
+	// neither version is served, remember that as well
+	s.unsupported = true
+	return "", errors.ErrReflectionNotSupported
+}
+
+func (s *reflectionStub) probe(ctx context.Context, service string, opts ...grpc.CallOption) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := s.open(ctx, service, opts...)
+	if err != nil {
+		return err
+	}
+	req := &reflectpb.ServerReflectionRequest{MessageRequest: &reflectpb.ServerReflectionRequest_ListServices{}}
+	if err = stream.Send(req); err != nil {
+		// the real error is only known after Recv
+		_, err = stream.Recv()
+		return err
+	}
+	_, err = stream.Recv()
+	return err
+}
+
+func (s *reflectionStub) open(ctx context.Context, service string, opts ...grpc.CallOption) (reflectpb.ServerReflection_ServerReflectionInfoClient, error) {
+	stream, err := s.cc.NewStream(ctx, &reflectpb.ServerReflection_ServiceDesc.Streams[0], "/"+service+"/ServerReflectionInfo", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &reflectionInfoClient{stream}, nil
+}
+
+type reflectionInfoClient struct {
+	grpc.ClientStream
+}
+
+func (x *reflectionInfoClient) Send(m *reflectpb.ServerReflectionRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *reflectionInfoClient) Recv() (*reflectpb.ServerReflectionResponse, error) {
+	m := new(reflectpb.ServerReflectionResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
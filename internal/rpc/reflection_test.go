@@ -0,0 +1,99 @@
+package rpc
+
+import (
+	"github.com/wuranxu/light/internal/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	reflectpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"io"
+	"strings"
+	"testing"
+)
+
+// registerV1Reflection serves grpc.reflection.v1 by relaying every request to the v1alpha service of
+// alpha, grpc-go of this version has no v1 implementation of its own.
+func registerV1Reflection(srv *grpc.Server, alpha *grpc.ClientConn) {
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: ReflectionV1,
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "ServerReflectionInfo",
+			ServerStreams: true,
+			ClientStreams: true,
+			Handler: func(_ interface{}, stream grpc.ServerStream) error {
+				upstream, err := reflectpb.NewServerReflectionClient(alpha).ServerReflectionInfo(stream.Context())
+				if err != nil {
+					return err
+				}
+				for {
+					req := new(reflectpb.ServerReflectionRequest)
+					if err := stream.RecvMsg(req); err == io.EOF {
+						return nil
+					} else if err != nil {
+						return err
+					}
+					if err := upstream.Send(req); err != nil {
+						return err
+					}
+					resp, err := upstream.Recv()
+					if err != nil {
+						return err
+					}
+					if err := stream.SendMsg(resp); err != nil {
+						return err
+					}
+				}
+			},
+		}},
+		Metadata: "reflection.proto",
+	}, nil)
+}
+
+func TestReflectionClient_Negotiate(t *testing.T) {
+	v1 := grpc.NewServer()
+	healthpb.RegisterHealthServer(v1, health.NewServer())
+	registerV1Reflection(v1, startServer(t))
+
+	bare := grpc.NewServer()
+	healthpb.RegisterHealthServer(bare, health.NewServer())
+
+	cases := []struct {
+		name    string
+		conn    *grpc.ClientConn
+		version string
+	}{
+		{"v1", serve(t, v1), ReflectionV1},
+		{"v1alpha", startServer(t), ReflectionV1Alpha},
+		{"none", serve(t, bare), ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rc := NewReflectionClient(c.conn)
+			_, _, err := rc.Args(healthService, healthCheck, strings.NewReader(`{}`))
+			if c.version == "" {
+				if err == nil || !strings.Contains(err.Error(), errors.ErrReflectionNotSupported.Error()) {
+					t.Fatalf("expected reflection not supported, got %v", err)
+				}
+				if _, err := rc.source().ListServices(); err != errors.ErrReflectionNotSupported {
+					t.Fatalf("expected ErrReflectionNotSupported, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rc.ReflectionVersion(); got != c.version {
+				t.Fatalf("expected %s, got %s", c.version, got)
+			}
+			// the negotiated version survives a reconnect of the reflection stream
+			rc.Reset()
+			if _, err := rc.source().ListServices(); err != nil {
+				t.Fatal(err)
+			}
+			if got := rc.ReflectionVersion(); got != c.version {
+				t.Fatalf("expected %s after reset, got %s", c.version, got)
+			}
+		})
+	}
+}
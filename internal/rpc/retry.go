@@ -0,0 +1,154 @@
+package rpc
+
+import (
+	"context"
+	"github.com/golang/protobuf/proto"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/balancer"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxAttempts       = 3
+	defaultInitialBackoff    = 100 * time.Millisecond
+	defaultMaxBackoff        = time.Second
+	defaultBackoffMultiplier = 2
+)
+
+// retryPolicy a RetryPolicy with every default filled in
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	multiplier     float64
+	retryable      map[codes.Code]bool
+}
+
+// policyFor merges the policy of the method into the gateway policy, methods that are not idempotent
+// get a single attempt
+func policyFor(method etcd.Method) *retryPolicy {
+	p := &retryPolicy{maxAttempts: 1}
+	if !method.Idempotent {
+		return p
+	}
+	merged := conf.Conf.Retry
+	if r := method.Retry; r != nil {
+		if r.MaxAttempts > 0 {
+			merged.MaxAttempts = r.MaxAttempts
+		}
+		if r.InitialBackoff > 0 {
+			merged.InitialBackoff = r.InitialBackoff
+		}
+		if r.MaxBackoff > 0 {
+			merged.MaxBackoff = r.MaxBackoff
+		}
+		if r.BackoffMultiplier > 0 {
+			merged.BackoffMultiplier = r.BackoffMultiplier
+		}
+		if len(r.RetryableCodes) > 0 {
+			merged.RetryableCodes = r.RetryableCodes
+		}
+	}
+	p.maxAttempts = merged.MaxAttempts
+	if p.maxAttempts <= 0 {
+		p.maxAttempts = defaultMaxAttempts
+	}
+	p.initialBackoff = millis(merged.InitialBackoff)
+	if p.initialBackoff <= 0 {
+		p.initialBackoff = defaultInitialBackoff
+	}
+	p.maxBackoff = millis(merged.MaxBackoff)
+	if p.maxBackoff <= 0 {
+		p.maxBackoff = defaultMaxBackoff
+	}
+	p.multiplier = merged.BackoffMultiplier
+	if p.multiplier <= 0 {
+		p.multiplier = defaultBackoffMultiplier
+	}
+	p.retryable = make(map[codes.Code]bool)
+	for _, name := range merged.RetryableCodes {
+		var code codes.Code
+		if err := code.UnmarshalJSON([]byte(strconv.Quote(strings.ToUpper(name)))); err != nil {
+			log.Printf("ignore unknown retryable code %s of %s", name, method.Path)
+			continue
+		}
+		p.retryable[code] = true
+	}
+	if len(p.retryable) == 0 {
+		p.retryable[codes.Unavailable] = true
+	}
+	return p
+}
+
+// backoff the wait before retry n, with 20% jitter so replicas do not retry in lockstep
+func (p *retryPolicy) backoff(n int) time.Duration {
+	wait := float64(p.initialBackoff)
+	for i := 1; i < n; i++ {
+		wait *= p.multiplier
+	}
+	if wait > float64(p.maxBackoff) {
+		wait = float64(p.maxBackoff)
+	}
+	return time.Duration(wait * (0.8 + 0.4*rand.Float64()))
+}
+
+// AttemptsCallOption reports how many attempts a call took
+type AttemptsCallOption struct {
+	grpc.EmptyCallOption
+	Attempts *int
+}
+
+// Attempts returns a CallOption that stores the number of attempts of the call in n
+func Attempts(n *int) grpc.CallOption {
+	return AttemptsCallOption{Attempts: n}
+}
+
+// invoke runs a unary call, idempotent methods are retried according to their policy. Every attempt
+// asks the circuit breaker first, an open breaker fails the call with balancer.ErrCircuitOpen.
+func (c *GrpcClient) invoke(ctx context.Context, method etcd.Method, req, res proto.Message, opts ...grpc.CallOption) error {
+	var attempts *int
+	callOpts := make([]grpc.CallOption, 0, len(opts))
+	for _, opt := range opts {
+		if a, ok := opt.(AttemptsCallOption); ok {
+			attempts = a.Attempts
+			continue
+		}
+		callOpts = append(callOpts, opt)
+	}
+	policy := policyFor(method)
+	var err error
+	for n := 1; ; n++ {
+		if !c.breaker.Allow() {
+			if n == 1 {
+				return balancer.ErrCircuitOpen
+			}
+			// the breaker opened while retrying, the last error says more
+			return err
+		}
+		err = c.cc.Invoke(ctx, method.Path, req, res, callOpts...)
+		c.record(ctx, err)
+		if attempts != nil {
+			*attempts = n
+		}
+		if err == nil || n >= policy.maxAttempts || !policy.retryable[status.Code(err)] {
+			return err
+		}
+		timer := time.NewTimer(policy.backoff(n))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			// the budget is spent, the last error says more than the deadline
+			return err
+		case <-timer.C:
+		}
+		res.Reset()
+	}
+}
@@ -0,0 +1,119 @@
+package rpc
+
+import (
+	"context"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/balancer"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyHealth fails the first failures calls of Check with code
+type flakyHealth struct {
+	*health.Server
+	code     codes.Code
+	failures int32
+	calls    int32
+}
+
+func (f *flakyHealth) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if atomic.AddInt32(&f.calls, 1) <= f.failures {
+		return nil, status.Error(f.code, "rolling restart")
+	}
+	return f.Server.Check(ctx, req)
+}
+
+func TestGrpcClient_Retry(t *testing.T) {
+	fast := &conf.RetryPolicy{InitialBackoff: 1, MaxBackoff: 5}
+	cases := []struct {
+		name     string
+		method   etcd.Method
+		code     codes.Code
+		failures int32
+		attempts int
+		ok       bool
+	}{
+		{"idempotent", etcd.Method{Idempotent: true, Retry: fast}, codes.Unavailable, 2, 3, true},
+		{"not idempotent", etcd.Method{Retry: fast}, codes.Unavailable, 2, 1, false},
+		{"not retryable", etcd.Method{Idempotent: true, Retry: fast}, codes.InvalidArgument, 2, 1, false},
+		{"exhausted", etcd.Method{Idempotent: true, Retry: &conf.RetryPolicy{MaxAttempts: 2, InitialBackoff: 1}}, codes.Unavailable, 5, 2, false},
+		{"custom codes", etcd.Method{Idempotent: true, Retry: &conf.RetryPolicy{InitialBackoff: 1, RetryableCodes: []string{"aborted"}}}, codes.Aborted, 1, 2, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := grpc.NewServer()
+			backend := &flakyHealth{Server: health.NewServer(), code: c.code, failures: c.failures}
+			healthpb.RegisterHealthServer(srv, backend)
+			reflection.Register(srv)
+			client := NewClient(serve(t, srv), nil)
+			c.method.Path = "/" + healthService + "/" + healthCheck
+
+			var attempts int
+			_, err := client.InvokeWithReflect(ctxTimeout(t), c.method, ioutil.NopCloser(strings.NewReader(`{}`)), "127.0.0.1", nil, Attempts(&attempts))
+			if (err == nil) != c.ok {
+				t.Fatalf("expected success %v, got %v", c.ok, err)
+			}
+			if attempts != c.attempts || int(atomic.LoadInt32(&backend.calls)) != c.attempts {
+				t.Fatalf("expected %d attempts, got %d with %d calls", c.attempts, attempts, backend.calls)
+			}
+		})
+	}
+}
+
+func TestGrpcClient_RetryStopsAtDeadline(t *testing.T) {
+	srv := grpc.NewServer()
+	backend := &flakyHealth{Server: health.NewServer(), code: codes.Unavailable, failures: 100}
+	healthpb.RegisterHealthServer(srv, backend)
+	reflection.Register(srv)
+	client := NewClient(serve(t, srv), nil)
+	// warm up the descriptors, so the deadline is spent on retries only
+	if _, err := client.Describe(etcd.Method{Path: "/" + healthService + "/" + healthCheck}); err != nil {
+		t.Fatal(err)
+	}
+	method := etcd.Method{
+		Path:       "/" + healthService + "/" + healthCheck,
+		Idempotent: true,
+		Retry:      &conf.RetryPolicy{MaxAttempts: 100, InitialBackoff: 50, MaxBackoff: 50},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Millisecond)
+	defer cancel()
+	var attempts int
+	_, err := client.InvokeWithReflect(ctx, method, ioutil.NopCloser(strings.NewReader(`{}`)), "127.0.0.1", nil, Attempts(&attempts))
+	if err == nil || attempts >= 100 || attempts < 2 {
+		t.Fatalf("expected the deadline to stop retrying, got %d attempts, %v", attempts, err)
+	}
+}
+
+func TestGrpcClient_CircuitBreaker(t *testing.T) {
+	conf.Conf.Breaker = conf.BreakerConfig{ConsecutiveFailures: 2, Cooldown: 60000}
+	defer func() { conf.Conf.Breaker = conf.BreakerConfig{} }()
+	srv := grpc.NewServer()
+	backend := &flakyHealth{Server: health.NewServer(), code: codes.Unavailable, failures: 100}
+	healthpb.RegisterHealthServer(srv, backend)
+	reflection.Register(srv)
+	client := NewClient(serve(t, srv), nil)
+	method := etcd.Method{Path: "/" + healthService + "/" + healthCheck}
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.InvokeWithReflect(ctxTimeout(t), method, ioutil.NopCloser(strings.NewReader(`{}`)), "127.0.0.1", nil); status.Code(err) != codes.Unavailable {
+			t.Fatalf("expected the backend error, got %v", err)
+		}
+	}
+	_, err := client.InvokeWithReflect(ctxTimeout(t), method, ioutil.NopCloser(strings.NewReader(`{}`)), "127.0.0.1", nil)
+	if err != balancer.ErrCircuitOpen {
+		t.Fatalf("expected an open circuit, got %v", err)
+	}
+	if calls := atomic.LoadInt32(&backend.calls); calls != 2 {
+		t.Fatalf("expected the open circuit to spare the backend, got %d calls", calls)
+	}
+}
@@ -0,0 +1,250 @@
+package rpc
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/errors"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type fileSource struct {
+	files  map[string]*desc.FileDescriptor
+	er     *dynamic.ExtensionRegistry
+	erInit sync.Once
+}
+
+// DescriptorSourceFromProtoSets loads descriptors from compiled protoset files, as produced by
+// protoc --descriptor_set_out --include_imports
+func DescriptorSourceFromProtoSets(fileNames ...string) (DescriptorSource, error) {
+	files := &descpb.FileDescriptorSet{}
+	for _, fileName := range fileNames {
+		b, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("could not load protoset file %q: %v", fileName, err)
+		}
+		var fs descpb.FileDescriptorSet
+		if err = proto.Unmarshal(b, &fs); err != nil {
+			return nil, fmt.Errorf("could not parse contents of protoset file %q: %v", fileName, err)
+		}
+		files.File = append(files.File, fs.File...)
+	}
+	return DescriptorSourceFromFileDescriptorSet(files)
+}
+
+// DescriptorSourceFromProtoFiles parses .proto source files, imports are resolved against importPaths
+func DescriptorSourceFromProtoFiles(importPaths []string, fileNames ...string) (DescriptorSource, error) {
+	p := protoparse.Parser{
+		ImportPaths:           importPaths,
+		InferImportPaths:      len(importPaths) == 0,
+		IncludeSourceCodeInfo: true,
+	}
+	fds, err := p.ParseFiles(fileNames...)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse given files: %v", err)
+	}
+	return DescriptorSourceFromFileDescriptors(fds...)
+}
+
+// DescriptorSourceFromProtoDirs parses every .proto file below dirs, each dir is an import path too
+func DescriptorSourceFromProtoDirs(importPaths []string, dirs ...string) (DescriptorSource, error) {
+	var fileNames []string
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !strings.HasSuffix(path, ".proto") {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			fileNames = append(fileNames, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not list proto files of %q: %v", dir, err)
+		}
+	}
+	if len(fileNames) == 0 {
+		return nil, fmt.Errorf("no proto files found in %v", dirs)
+	}
+	sort.Strings(fileNames)
+	return DescriptorSourceFromProtoFiles(append(append([]string{}, dirs...), importPaths...), fileNames...)
+}
+
+// DescriptorSourceFromFileDescriptorSet creates a source from a set of descriptors, every dependency must be included
+func DescriptorSourceFromFileDescriptorSet(files *descpb.FileDescriptorSet) (DescriptorSource, error) {
+	unresolved := map[string]*descpb.FileDescriptorProto{}
+	for _, fd := range files.File {
+		unresolved[fd.GetName()] = fd
+	}
+	resolved := map[string]*desc.FileDescriptor{}
+	for _, fd := range files.File {
+		_, err := resolveFileDescriptor(unresolved, resolved, fd.GetName())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &fileSource{files: resolved}, nil
+}
+
+func resolveFileDescriptor(unresolved map[string]*descpb.FileDescriptorProto, resolved map[string]*desc.FileDescriptor, filename string) (*desc.FileDescriptor, error) {
+	if r, ok := resolved[filename]; ok {
+		return r, nil
+	}
+	fd, ok := unresolved[filename]
+	if !ok {
+		return nil, fmt.Errorf("no descriptor found for %q", filename)
+	}
+	deps := make([]*desc.FileDescriptor, 0, len(fd.GetDependency()))
+	for _, dep := range fd.GetDependency() {
+		depFd, err := resolveFileDescriptor(unresolved, resolved, dep)
+		if err != nil {
+			return nil, err
+		}
+		deps = append(deps, depFd)
+	}
+	result, err := desc.CreateFileDescriptor(fd, deps...)
+	if err != nil {
+		return nil, err
+	}
+	resolved[filename] = result
+	return result, nil
+}
+
+// DescriptorSourceFromFileDescriptors creates a source from descriptors, dependencies are added implicitly
+func DescriptorSourceFromFileDescriptors(files ...*desc.FileDescriptor) (DescriptorSource, error) {
+	fds := map[string]*desc.FileDescriptor{}
+	for _, fd := range files {
+		if err := addFile(fd, fds); err != nil {
+			return nil, err
+		}
+	}
+	return &fileSource{files: fds}, nil
+}
+
+func addFile(fd *desc.FileDescriptor, fds map[string]*desc.FileDescriptor) error {
+	name := fd.GetName()
+	if existing, ok := fds[name]; ok {
+		// already added this file
+		if existing != fd {
+			// doh! duplicate files provided
+			return fmt.Errorf("given files include multiple copies of %q", name)
+		}
+		return nil
+	}
+	fds[name] = fd
+	for _, dep := range fd.GetDependencies() {
+		if err := addFile(dep, fds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *fileSource) ListServices() ([]string, error) {
+	set := map[string]bool{}
+	for _, fd := range fs.files {
+		for _, svc := range fd.GetServices() {
+			set[svc.GetFullyQualifiedName()] = true
+		}
+	}
+	sl := make([]string, 0, len(set))
+	for svc := range set {
+		sl = append(sl, svc)
+	}
+	sort.Strings(sl)
+	return sl, nil
+}
+
+func (fs *fileSource) FindSymbol(fullyQualifiedName string) (desc.Descriptor, error) {
+	for _, fd := range fs.files {
+		if dsc := fd.FindSymbol(fullyQualifiedName); dsc != nil {
+			return dsc, nil
+		}
+	}
+	return nil, errors.NotFound("Symbol", fullyQualifiedName)
+}
+
+func (fs *fileSource) AllExtensionsForType(typeName string) ([]*desc.FieldDescriptor, error) {
+	fs.erInit.Do(func() {
+		fs.er = &dynamic.ExtensionRegistry{}
+		for _, fd := range fs.files {
+			fs.er.AddExtensionsFromFile(fd)
+		}
+	})
+	return fs.er.AllExtensionsForType(typeName), nil
+}
+
+// fallbackSource asks primary first and falls back to secondary when primary fails
+type fallbackSource struct {
+	primary   DescriptorSource
+	secondary DescriptorSource
+}
+
+// DescriptorSourceWithFallback combines two sources, typically server reflection backed by files
+func DescriptorSourceWithFallback(primary, secondary DescriptorSource) DescriptorSource {
+	return fallbackSource{primary: primary, secondary: secondary}
+}
+
+func (f fallbackSource) ListServices() ([]string, error) {
+	svcs, err := f.primary.ListServices()
+	if err != nil {
+		return f.secondary.ListServices()
+	}
+	return svcs, nil
+}
+
+func (f fallbackSource) FindSymbol(fullyQualifiedName string) (desc.Descriptor, error) {
+	d, err := f.primary.FindSymbol(fullyQualifiedName)
+	if err != nil {
+		return f.secondary.FindSymbol(fullyQualifiedName)
+	}
+	return d, nil
+}
+
+func (f fallbackSource) AllExtensionsForType(typeName string) ([]*desc.FieldDescriptor, error) {
+	exts, err := f.primary.AllExtensionsForType(typeName)
+	if err != nil {
+		return f.secondary.AllExtensionsForType(typeName)
+	}
+	return exts, nil
+}
+
+// DescriptorSourceFromConfig loads the file based source configured for a service, nil if it has none
+func DescriptorSourceFromConfig(cfg conf.DescriptorConfig) (DescriptorSource, error) {
+	var sources []DescriptorSource
+	if len(cfg.ProtoSets) > 0 {
+		src, err := DescriptorSourceFromProtoSets(cfg.ProtoSets...)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, src)
+	}
+	if len(cfg.ProtoDirs) > 0 {
+		src, err := DescriptorSourceFromProtoDirs(cfg.ImportPaths, cfg.ProtoDirs...)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, src)
+	}
+	switch len(sources) {
+	case 0:
+		return nil, nil
+	case 1:
+		return sources[0], nil
+	}
+	return DescriptorSourceWithFallback(sources[0], sources[1]), nil
+}
@@ -0,0 +1,146 @@
+package rpc
+
+import (
+	"github.com/golang/protobuf/proto"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const echoProto = `syntax = "proto3";
+
+package demo;
+
+import "google/protobuf/timestamp.proto";
+
+message EchoRequest {
+  string text = 1;
+  google.protobuf.Timestamp at = 2;
+}
+
+service Echo {
+  rpc Say(EchoRequest) returns (EchoRequest);
+}
+`
+
+// writeProtoSet writes the health proto and its dependencies as a protoset file
+func writeProtoSet(t *testing.T) string {
+	fd, err := desc.LoadFileDescriptor("grpc/health/v1/health.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &descpb.FileDescriptorSet{}
+	for _, dep := range fd.GetDependencies() {
+		set.File = append(set.File, dep.AsFileDescriptorProto())
+	}
+	set.File = append(set.File, fd.AsFileDescriptorProto())
+	b, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "health.protoset")
+	if err := ioutil.WriteFile(name, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestDescriptorSourceFromProtoSets(t *testing.T) {
+	source, err := DescriptorSourceFromProtoSets(writeProtoSet(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svcs, err := source.ListServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svcs) != 1 || svcs[0] != healthService {
+		t.Fatalf("unexpected services: %v", svcs)
+	}
+	d, err := source.FindSymbol(healthService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.(*desc.ServiceDescriptor); !ok {
+		t.Fatalf("expected a service descriptor, got %T", d)
+	}
+	if _, err = source.FindSymbol("no.such.Service"); !errors.IsNotFoundError(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	if _, err = DescriptorSourceFromProtoSets(filepath.Join(t.TempDir(), "missing.protoset")); err == nil {
+		t.Fatal("expected missing protoset error")
+	}
+}
+
+func TestDescriptorSourceFromProtoDirs(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "demo"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "demo", "echo.proto"), []byte(echoProto), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source, err := DescriptorSourceFromConfig(conf.DescriptorConfig{ProtoDirs: []string{dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := source.FindSymbol("demo.Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtd := d.(*desc.ServiceDescriptor).FindMethodByName("Say")
+	if mtd == nil || mtd.GetInputType().FindFieldByName("at") == nil {
+		t.Fatal("expected method Say with a timestamp field")
+	}
+	if _, err = DescriptorSourceFromProtoDirs(nil, t.TempDir()); err == nil {
+		t.Fatal("expected an error for a directory without proto files")
+	}
+}
+
+func TestReflectionClient_FallbackToFiles(t *testing.T) {
+	// a backend without the reflection service
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	rc := NewReflectionClient(serve(t, srv))
+
+	if _, _, err := rc.Args(healthService, healthCheck, strings.NewReader(`{}`)); err == nil {
+		t.Fatal("expected reflection to fail")
+	}
+
+	files, err := DescriptorSourceFromConfig(conf.DescriptorConfig{ProtoSets: []string{writeProtoSet(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []string{conf.SourceFallback, conf.SourceFile} {
+		rc.SetFileSource(mode, files)
+		cache, req, err := rc.Args(healthService, healthCheck, strings.NewReader(`{"service": ""}`))
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		res := cache.NewResponse()
+		if err = rc.conn.Invoke(ctxTimeout(t), "/"+healthService+"/"+healthCheck, req, res); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		var out strings.Builder
+		if err = rc.Marshal(&out, res); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), "SERVING") {
+			t.Fatalf("%s: unexpected response %s", mode, out.String())
+		}
+	}
+
+	rc.SetFileSource(conf.SourceReflection, files)
+	if _, _, err := rc.Args(healthService, healthCheck, strings.NewReader(`{}`)); err == nil {
+		t.Fatal("expected reflection mode to ignore files")
+	}
+}
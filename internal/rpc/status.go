@@ -0,0 +1,31 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/golang/protobuf/jsonpb"
+	"google.golang.org/grpc/status"
+	// google.rpc error details are resolvable even if the backend descriptors do not include them
+	_ "google.golang.org/genproto/googleapis/rpc/errdetails"
+)
+
+// Details renders the google.rpc.Status details of st as json. Detail types unknown to the backend
+// keep their raw bytes under "value".
+func (r *ReflectionClient) Details(st *status.Status) []json.RawMessage {
+	details := st.Proto().GetDetails()
+	if len(details) == 0 {
+		return nil
+	}
+	m := jsonpb.Marshaler{AnyResolver: &anyResolver{source: r.source()}}
+	out := make([]json.RawMessage, 0, len(details))
+	for _, d := range details {
+		var buf bytes.Buffer
+		if err := m.Marshal(&buf, d); err != nil {
+			raw, _ := json.Marshal(map[string]interface{}{"@type": d.GetTypeUrl(), "value": d.GetValue()})
+			out = append(out, raw)
+			continue
+		}
+		out = append(out, buf.Bytes())
+	}
+	return out
+}
@@ -0,0 +1,127 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/wuranxu/light/internal/auth"
+	"github.com/wuranxu/light/internal/balancer"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"io"
+)
+
+// InvokeServerStream calls a server streaming method and hands every response to recv in order.
+// The returned error is the status sent in the stream trailers, or the error returned by recv.
+func (c *GrpcClient) InvokeServerStream(ctx context.Context, method etcd.Method, in io.Reader, ip string, userInfo *auth.UserInfo, recv func(proto.Message) error, opts ...grpc.CallOption) (err error) {
+	service, mth := splitPath(method.Path)
+	cache, req, err := c.rc.Args(service, mth, in)
+	if err != nil {
+		return err
+	}
+	md := cache.Method()
+	if !md.IsServerStreaming() || md.IsClientStreaming() {
+		return fmt.Errorf("method %q is not a server streaming method", md.GetFullyQualifiedName())
+	}
+	if !c.breaker.Allow() {
+		return balancer.ErrCircuitOpen
+	}
+	defer func() { c.record(ctx, err) }()
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(ctx, outgoing(ip, userInfo)))
+	defer cancel()
+	stream, err := c.cc.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, method.Path, opts...)
+	if err != nil {
+		return err
+	}
+	if err = stream.SendMsg(req); err != nil && err != io.EOF {
+		return err
+	}
+	if err = stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		res := cache.NewResponse()
+		if err = stream.RecvMsg(res); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err = recv(res); err != nil {
+			return err
+		}
+	}
+}
+
+// Stream is a client side stream of any kind whose requests arrive as json
+type Stream struct {
+	stream grpc.ClientStream
+	cache  *MethodCache
+	rc     *ReflectionClient
+	cancel context.CancelFunc
+}
+
+// NewStream opens a stream to the method registered in etcd, it stays open until Close or ctx is done
+func (c *GrpcClient) NewStream(ctx context.Context, method etcd.Method, ip string, userInfo *auth.UserInfo, opts ...grpc.CallOption) (*Stream, error) {
+	cache, err := c.Describe(method)
+	if err != nil {
+		return nil, err
+	}
+	md := cache.Method()
+	if !c.breaker.Allow() {
+		return nil, balancer.ErrCircuitOpen
+	}
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(ctx, outgoing(ip, userInfo)))
+	desc := &grpc.StreamDesc{ServerStreams: md.IsServerStreaming(), ClientStreams: md.IsClientStreaming()}
+	stream, err := c.cc.NewStream(ctx, desc, method.Path, opts...)
+	// long lived streams only tell the breaker whether they could be opened
+	c.record(ctx, err)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &Stream{stream: stream, cache: cache, rc: c.rc, cancel: cancel}, nil
+}
+
+func (s *Stream) Method() *MethodCache {
+	return s.cache
+}
+
+// Send decodes a json message into the method input type and sends it
+func (s *Stream) Send(data []byte) error {
+	req := s.cache.NewRequest()
+	if err := s.rc.Unmarshal(data, req); err != nil {
+		return err
+	}
+	return s.stream.SendMsg(req)
+}
+
+// SendMessage sends a request built by the caller, like the chunks of an upload
+func (s *Stream) SendMessage(msg proto.Message) error {
+	return s.stream.SendMsg(msg)
+}
+
+// CloseSend tells the backend no more requests are coming
+func (s *Stream) CloseSend() error {
+	return s.stream.CloseSend()
+}
+
+// Recv returns the next response, io.EOF once the stream finished successfully
+func (s *Stream) Recv() (proto.Message, error) {
+	res := s.cache.NewResponse()
+	if err := s.stream.RecvMsg(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Trailer returns the trailers of the stream, only valid once Recv returned an error
+func (s *Stream) Trailer() metadata.MD {
+	return s.stream.Trailer()
+}
+
+// Close aborts the stream
+func (s *Stream) Close() {
+	s.cancel()
+}
@@ -0,0 +1,96 @@
+package rpc
+
+import (
+	"fmt"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultTimeout budget of a call when nothing else is configured
+	DefaultTimeout = 20 * time.Second
+	// maxTimeoutValue grpc-timeout values have at most 8 digits
+	maxTimeoutValue = 100000000 - 1
+)
+
+// CallTimeout decides the budget of a unary call. A timeout requested by the client is capped by the
+// max timeout of the method, or of the gateway. Without a request the method default applies, then
+// the gateway default.
+func CallTimeout(method etcd.Method, requested time.Duration) time.Duration {
+	gateway := conf.Conf.Gateway
+	if requested > 0 {
+		max := millis(method.MaxTimeout)
+		if max == 0 {
+			max = millis(gateway.MaxTimeout)
+		}
+		if max > 0 && requested > max {
+			return max
+		}
+		return requested
+	}
+	if timeout := millis(method.Timeout); timeout > 0 {
+		return timeout
+	}
+	if timeout := millis(gateway.DefaultTimeout); timeout > 0 {
+		return timeout
+	}
+	return DefaultTimeout
+}
+
+// StreamTimeout caps the timeout requested for a stream, streams without a request never time out
+func StreamTimeout(method etcd.Method, requested time.Duration) time.Duration {
+	if requested <= 0 {
+		return 0
+	}
+	return CallTimeout(method, requested)
+}
+
+func millis(ms int64) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+// ParseGrpcTimeout parses a grpc-timeout header like 100m or 5S
+func ParseGrpcTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 {
+		return 0, fmt.Errorf("malformed grpc-timeout: %q", s)
+	}
+	var unit time.Duration
+	switch s[len(s)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, fmt.Errorf("malformed grpc-timeout unit: %q", s)
+	}
+	v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || v < 0 || v > maxTimeoutValue {
+		return 0, fmt.Errorf("malformed grpc-timeout value: %q", s)
+	}
+	return time.Duration(v) * unit, nil
+}
+
+// ParseRequestTimeout parses a X-Request-Timeout header, either milliseconds or a duration like 1.5s
+func ParseRequestTimeout(s string) (time.Duration, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if ms < 0 {
+			return 0, fmt.Errorf("negative request timeout: %q", s)
+		}
+		return millis(ms), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("malformed request timeout: %q", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,138 @@
+package rpc
+
+import (
+	"context"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCallTimeout(t *testing.T) {
+	conf.Conf.Gateway.DefaultTimeout = 3000
+	conf.Conf.Gateway.MaxTimeout = 10000
+	defer func() { conf.Conf.Gateway = conf.GatewayConfig{} }()
+
+	cases := []struct {
+		method    etcd.Method
+		requested time.Duration
+		expected  time.Duration
+	}{
+		{etcd.Method{}, 0, 3 * time.Second},
+		{etcd.Method{Timeout: 500}, 0, 500 * time.Millisecond},
+		{etcd.Method{}, 5 * time.Second, 5 * time.Second},
+		{etcd.Method{}, time.Minute, 10 * time.Second},
+		{etcd.Method{MaxTimeout: 2000}, 5 * time.Second, 2 * time.Second},
+		{etcd.Method{MaxTimeout: 30000}, 20 * time.Second, 20 * time.Second},
+	}
+	for _, c := range cases {
+		if got := CallTimeout(c.method, c.requested); got != c.expected {
+			t.Fatalf("%+v with %v: expected %v, got %v", c.method, c.requested, c.expected, got)
+		}
+	}
+	if got := StreamTimeout(etcd.Method{}, 0); got != 0 {
+		t.Fatalf("expected streams to be unbounded, got %v", got)
+	}
+
+	conf.Conf.Gateway = conf.GatewayConfig{}
+	if got := CallTimeout(etcd.Method{}, 0); got != DefaultTimeout {
+		t.Fatalf("expected %v, got %v", DefaultTimeout, got)
+	}
+	if got := CallTimeout(etcd.Method{}, time.Hour); got != time.Hour {
+		t.Fatalf("expected no cap without a max timeout, got %v", got)
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	grpcTimeouts := map[string]time.Duration{
+		"1H":   time.Hour,
+		"2M":   2 * time.Minute,
+		"5S":   5 * time.Second,
+		"100m": 100 * time.Millisecond,
+		"30u":  30 * time.Microsecond,
+		"7n":   7,
+	}
+	for s, expected := range grpcTimeouts {
+		if got, err := ParseGrpcTimeout(s); err != nil || got != expected {
+			t.Fatalf("%s: expected %v, got %v, %v", s, expected, got, err)
+		}
+	}
+	for _, s := range []string{"", "5", "5x", "-1S", "123456789S"} {
+		if _, err := ParseGrpcTimeout(s); err == nil {
+			t.Fatalf("%q: expected an error", s)
+		}
+	}
+
+	requestTimeouts := map[string]time.Duration{
+		"1500": 1500 * time.Millisecond,
+		"1.5s": 1500 * time.Millisecond,
+		"2m":   2 * time.Minute,
+	}
+	for s, expected := range requestTimeouts {
+		if got, err := ParseRequestTimeout(s); err != nil || got != expected {
+			t.Fatalf("%s: expected %v, got %v, %v", s, expected, got, err)
+		}
+	}
+	for _, s := range []string{"soon", "-5", "-1s"} {
+		if _, err := ParseRequestTimeout(s); err == nil {
+			t.Fatalf("%q: expected an error", s)
+		}
+	}
+}
+
+// deadlineHealth hands the deadline every Check call received to the test
+type deadlineHealth struct {
+	*health.Server
+	deadline chan time.Duration
+}
+
+func (d *deadlineHealth) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		d.deadline <- time.Until(deadline)
+	} else {
+		d.deadline <- 0
+	}
+	return d.Server.Check(ctx, req)
+}
+
+func TestGrpcClient_InvokeWithReflectDeadline(t *testing.T) {
+	srv := grpc.NewServer()
+	backend := &deadlineHealth{Server: health.NewServer(), deadline: make(chan time.Duration, 1)}
+	healthpb.RegisterHealthServer(srv, backend)
+	reflection.Register(srv)
+	client := NewClient(serve(t, srv), nil)
+	method := etcd.Method{Path: "/" + healthService + "/" + healthCheck}
+	body := func() *strings.Reader { return strings.NewReader(`{"service": ""}`) }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := client.InvokeWithReflect(ctx, method, ioutil.NopCloser(body()), "127.0.0.1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-backend.deadline; got <= 0 || got > 2*time.Second {
+		t.Fatalf("expected the deadline to reach the backend, got %v", got)
+	}
+
+	// without a deadline the method default applies
+	if _, err := client.InvokeWithReflect(context.Background(), etcd.Method{Path: method.Path, Timeout: 700}, ioutil.NopCloser(body()), "127.0.0.1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-backend.deadline; got <= 0 || got > 700*time.Millisecond {
+		t.Fatalf("expected the method default timeout, got %v", got)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err := client.InvokeWithReflect(ctx, method, ioutil.NopCloser(body()), "127.0.0.1", nil)
+	if status.Code(err) != codes.Canceled {
+		t.Fatalf("expected a cancelled call, got %v", err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/wuranxu/light/conf"
 	v3 "go.etcd.io/etcd/client/v3"
 	re "google.golang.org/grpc/resolver"
+	"sync"
 	"time"
 )
 
@@ -12,6 +13,9 @@ type Client struct {
 	kv     v3.KV
 	cli    *v3.Client
 	scheme string
+	lock   sync.Mutex
+	// instances registered by this process by key, kept to register them again after their lease expired
+	instances map[string]Instance
 }
 
 var (
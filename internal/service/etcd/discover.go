@@ -1,14 +1,27 @@
 package etcd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/wuranxu/light/conf"
+	"go.etcd.io/etcd/client/v3"
+	"strings"
 	"unicode"
 )
 
 type Method struct {
 	Authorization bool   `json:"authorization"` // 是否需要登录
 	Path          string `json:"path"`
+	Timeout       int64  `json:"timeout,omitempty"`     // 默认超时时间(毫秒), 0使用网关配置
+	MaxTimeout    int64  `json:"max_timeout,omitempty"` // 客户端可申请的最大超时时间(毫秒), 0使用网关配置
+	Idempotent    bool   `json:"idempotent,omitempty"`  // 幂等方法失败后网关可重试
+	// Retry 重试策略, 为空使用网关配置
+	Retry *conf.RetryPolicy `json:"retry,omitempty"`
+	// HashKey 一致性哈希的键: user, header:<name> 或 field:<path>, 为空不使用一致性哈希
+	HashKey string `json:"hash_key,omitempty"`
+	// Download 以文件形式返回响应中的bytes字段, 为空返回json
+	Download *conf.DownloadConfig `json:"download,omitempty"`
 }
 
 func (m *Method) Marshal() string {
@@ -16,7 +29,8 @@ func (m *Method) Marshal() string {
 	return string(b)
 }
 
-func lowerFirst(str string) string {
+// LowerFirst lowers the first letter, method keys are registered that way to match other languages
+func LowerFirst(str string) string {
 	for i, v := range str {
 		return string(unicode.ToLower(v)) + str[i+1:]
 	}
@@ -24,11 +38,22 @@ func lowerFirst(str string) string {
 }
 
 func RegisterMethod(client *Client, version, service, method string, auth bool) error {
+	return RegisterMethodWith(client, version, service, method, conf.Md{Authorization: auth})
+}
+
+// RegisterMethodWith registers a method with every option of its service.yaml entry
+func RegisterMethodWith(client *Client, version, service, method string, cfg conf.Md) error {
 	md := &Method{
-		Authorization: auth,
+		Authorization: cfg.Authorization,
 		Path:          fmt.Sprintf("/%s/%s", service, method),
+		Timeout:       cfg.Timeout,
+		MaxTimeout:    cfg.MaxTimeout,
+		Idempotent:    cfg.Idempotent,
+		Retry:         cfg.Retry,
+		HashKey:       cfg.HashKey,
+		Download:      cfg.Download,
 	}
-	fullPath := fmt.Sprintf("%s.%s.%s", version, lowerFirst(service), lowerFirst(method))
+	fullPath := fmt.Sprintf("%s.%s.%s", version, LowerFirst(service), LowerFirst(method))
 	_, err := client.cli.Put(client.cli.Ctx(), fullPath, md.Marshal())
 	if err != nil {
 		return err
@@ -37,7 +62,63 @@ func RegisterMethod(client *Client, version, service, method string, auth bool)
 }
 
 func UnRegisterMethod(client *Client, version, service, method string) error {
-	fullPath := fmt.Sprintf("%s.%s.%s", version, lowerFirst(service), lowerFirst(method))
+	fullPath := fmt.Sprintf("%s.%s.%s", version, LowerFirst(service), LowerFirst(method))
 	_, err := client.cli.Delete(client.cli.Ctx(), fullPath)
 	return err
 }
+
+// registrationsFrom the first key a registration may have. Registrations share no prefix, but the keys
+// sorting before it start with a slash like the instances and are left out of listing and watching.
+const registrationsFrom = "0"
+
+// Registration a method registered in etcd under version.service.method
+type Registration struct {
+	Version string
+	Service string
+	Name    string
+	Method  Method
+}
+
+func (r Registration) Key() string {
+	return fmt.Sprintf("%s.%s.%s", r.Version, r.Service, r.Name)
+}
+
+// Methods lists every registered method sorted by key, split and mirror rules are skipped
+func (cl *Client) Methods() ([]Registration, error) {
+	resp, err := cl.cli.Get(context.Background(), registrationsFrom, clientv3.WithFromKey(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+	var regs []Registration
+	for _, kv := range resp.Kvs {
+		reg, ok := registrationOf(string(kv.Key))
+		if !ok {
+			continue
+		}
+		if err = json.Unmarshal(kv.Value, &reg.Method); err != nil || reg.Method.Path == "" {
+			continue
+		}
+		regs = append(regs, reg)
+	}
+	return regs, nil
+}
+
+// registrationOf splits a key like version.service.method, services may have dots in their name
+func registrationOf(key string) (Registration, bool) {
+	first, last := strings.IndexByte(key, '.'), strings.LastIndexByte(key, '.')
+	if first <= 0 || last <= first+1 || last == len(key)-1 {
+		return Registration{}, false
+	}
+	if version := key[:first]; version == "split" || version == "mirror" {
+		return Registration{}, false
+	}
+	return Registration{Version: key[:first], Service: key[first+1 : last], Name: key[last+1:]}, true
+}
+
+// WatchMethods calls onChange every time a method is registered, changed or removed, until ctx is done
+func (cl *Client) WatchMethods(ctx context.Context, onChange func()) {
+	cl.watchKeys(ctx, registrationsFrom, clientv3.WithFromKey(), 0, func(key []byte) bool {
+		_, ok := registrationOf(string(key))
+		return ok
+	}, onChange)
+}
@@ -0,0 +1,80 @@
+package etcd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClient_Methods(t *testing.T) {
+	cli := startEtcd(t)
+	if err := RegisterMethod(cli, "v1", "user", "Login", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterMethod(cli, "v1", "user", "Info", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterMethod(cli, "v2", "shop.order", "Create", false); err != nil {
+		t.Fatal(err)
+	}
+	cli.Set("v1.user.broken", `{}`)
+	// registered by hand or by services in other languages, nothing but the key of the method is written
+	cli.Set("v1.user.legacy", `{"path": "/user/Legacy"}`)
+	cli.Set(cli.instanceKey("user", "127.0.0.1:9000"), Instance{Addr: "127.0.0.1:9000", Weight: DefaultWeight}.Marshal())
+	if err := SetMirror(cli, "v1", "user", "login", &Mirror{Version: "v2", Percent: 10}); err != nil {
+		t.Fatal(err)
+	}
+	regs, err := cli.Methods()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Registration{
+		{Version: "v1", Service: "user", Name: "info", Method: Method{Path: "/user/Info", Authorization: true}},
+		{Version: "v1", Service: "user", Name: "legacy", Method: Method{Path: "/user/Legacy"}},
+		{Version: "v1", Service: "user", Name: "login", Method: Method{Path: "/user/Login"}},
+		{Version: "v2", Service: "shop.order", Name: "create", Method: Method{Path: "/shop.order/Create"}},
+	}
+	if !reflect.DeepEqual(regs, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, regs)
+	}
+	if err = UnRegisterMethod(cli, "v1", "user", "Login"); err != nil {
+		t.Fatal(err)
+	}
+	if regs, err = cli.Methods(); err != nil || len(regs) != 3 || cli.GetSingle("v1.user.login") != "" {
+		t.Fatalf("expected the method to be removed, got %+v, %v", regs, err)
+	}
+}
+
+func TestClient_WatchMethods(t *testing.T) {
+	cli := startEtcd(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 10)
+	go cli.WatchMethods(ctx, func() { changed <- struct{}{} })
+	// the watch starts in the background, keep registering until it sees one
+	deadline := time.After(5 * time.Second)
+	for seen := false; !seen; {
+		if err := RegisterMethod(cli, "v1", "user", "login", false); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-changed:
+			seen = true
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("registration not seen")
+		}
+	}
+	for len(changed) > 0 {
+		<-changed
+	}
+	if err := UnRegisterMethod(cli, "v1", "user", "login"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("removal not seen")
+	}
+}
@@ -0,0 +1,71 @@
+package etcd
+
+import (
+	"encoding/json"
+	"github.com/wuranxu/light/conf"
+	"google.golang.org/grpc/attributes"
+	re "google.golang.org/grpc/resolver"
+)
+
+// DefaultWeight weight of instances registered without one
+const DefaultWeight = 100
+
+// Instance the value registered under /scheme/name/addr
+type Instance struct {
+	Addr string `json:"addr"`
+	// Weight share of the traffic relative to the other instances, 0 drains the instance
+	Weight  int               `json:"weight"`
+	Zone    string            `json:"zone,omitempty"`
+	Version string            `json:"version,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+type instanceKey struct{}
+
+// NewInstance describes an instance listening on addr with the metadata of its service.yaml
+func NewInstance(addr string, config conf.YamlConfig) Instance {
+	ins := Instance{
+		Addr:    addr,
+		Weight:  DefaultWeight,
+		Zone:    config.Instance.Zone,
+		Version: config.Version,
+		Labels:  config.Instance.Labels,
+	}
+	if config.Instance.Weight != nil {
+		ins.Weight = *config.Instance.Weight
+	}
+	return ins
+}
+
+// ParseInstance decodes the value registered for addr, instances of older versions registered their
+// bare address
+func ParseInstance(addr string, value []byte) Instance {
+	ins := Instance{Addr: addr, Weight: DefaultWeight}
+	if err := json.Unmarshal(value, &ins); err != nil {
+		return Instance{Addr: addr, Weight: DefaultWeight}
+	}
+	if ins.Addr == "" {
+		ins.Addr = addr
+	}
+	return ins
+}
+
+func (i Instance) Marshal() string {
+	b, _ := json.Marshal(i)
+	return string(b)
+}
+
+// Address the resolver address of the instance, the metadata travels in its attributes. Changing
+// the metadata of an address makes grpc reconnect to it.
+func (i Instance) Address() re.Address {
+	return re.Address{Addr: i.Addr, Attributes: attributes.New(instanceKey{}, i)}
+}
+
+// InstanceOf returns the metadata the resolver attached to addr
+func InstanceOf(addr re.Address) (Instance, bool) {
+	if addr.Attributes == nil {
+		return Instance{}, false
+	}
+	ins, ok := addr.Attributes.Value(instanceKey{}).(Instance)
+	return ins, ok
+}
@@ -0,0 +1,57 @@
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Mirror where the calls of a method are shadowed to, the shadow responses are only compared
+type Mirror struct {
+	// Version of the shadow, empty keeps the version of the route
+	Version string `json:"version,omitempty"`
+	// Service of the shadow, empty keeps the service of the route
+	Service string `json:"service,omitempty"`
+	// Percent share of the calls between 0 and 100 that are mirrored, 0 mirrors every call
+	Percent float64 `json:"percent,omitempty"`
+	// Writes mirrors methods that are not idempotent too, the shadow repeats their writes
+	Writes bool `json:"writes,omitempty"`
+}
+
+// Allows tells whether calls of method may be mirrored, only idempotent ones unless Writes is set
+func (m *Mirror) Allows(method Method) bool {
+	return method.Idempotent || m.Writes
+}
+
+func (m *Mirror) Marshal() string {
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+func mirrorKey(version, service, method string) string {
+	return fmt.Sprintf("mirror.%s.%s.%s", version, LowerFirst(service), LowerFirst(method))
+}
+
+// SetMirror stores the mirror rule of a method
+func SetMirror(client *Client, version, service, method string, mirror *Mirror) error {
+	_, err := client.cli.Put(client.cli.Ctx(), mirrorKey(version, service, method), mirror.Marshal())
+	return err
+}
+
+func RemoveMirror(client *Client, version, service, method string) error {
+	_, err := client.cli.Delete(client.cli.Ctx(), mirrorKey(version, service, method))
+	return err
+}
+
+// GetMirror returns the mirror rule of a method, nil when it is not mirrored
+func (cl *Client) GetMirror(version, service, method string) (*Mirror, error) {
+	key := mirrorKey(version, service, method)
+	value := cl.GetSingle(key)
+	if value == "" {
+		return nil, nil
+	}
+	mirror := new(Mirror)
+	if err := json.Unmarshal([]byte(value), mirror); err != nil {
+		return nil, fmt.Errorf("malformed mirror rule %s: %w", key, err)
+	}
+	return mirror, nil
+}
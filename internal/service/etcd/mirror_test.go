@@ -0,0 +1,37 @@
+package etcd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClient_GetMirror(t *testing.T) {
+	cli := startEtcd(t)
+	if mirror, err := cli.GetMirror("v1", "user", "login"); mirror != nil || err != nil {
+		t.Fatalf("expected no mirror, got %+v, %v", mirror, err)
+	}
+	expected := &Mirror{Version: "v2", Percent: 50}
+	if err := SetMirror(cli, "v1", "User", "Login", expected); err != nil {
+		t.Fatal(err)
+	}
+	if mirror, err := cli.GetMirror("v1", "user", "login"); err != nil || !reflect.DeepEqual(mirror, expected) {
+		t.Fatalf("expected %+v, got %+v, %v", expected, mirror, err)
+	}
+	if err := RemoveMirror(cli, "v1", "User", "Login"); err != nil {
+		t.Fatal(err)
+	}
+	if mirror, err := cli.GetMirror("v1", "user", "login"); mirror != nil || err != nil {
+		t.Fatalf("expected the mirror to be removed, got %+v, %v", mirror, err)
+	}
+}
+
+func TestMirror_Allows(t *testing.T) {
+	mirror := &Mirror{Version: "v2"}
+	if !mirror.Allows(Method{Idempotent: true}) || mirror.Allows(Method{}) {
+		t.Fatal("expected only idempotent methods to be mirrored")
+	}
+	mirror.Writes = true
+	if !mirror.Allows(Method{}) {
+		t.Fatal("expected writes to be mirrored once allowed")
+	}
+}
@@ -2,7 +2,9 @@ package etcd
 
 import (
 	"context"
+	"fmt"
 	"github.com/wuranxu/light/conf"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"go.etcd.io/etcd/client/v3"
 	"log"
 	"reflect"
@@ -10,15 +12,27 @@ import (
 )
 
 func (cl *Client) RegisterService(name, addr string, ttl int64) error {
+	return cl.RegisterInstance(name, Instance{Addr: addr, Weight: DefaultWeight}, ttl)
+}
+
+// RegisterInstance registers an instance with its metadata, it is registered again whenever its lease expired
+func (cl *Client) RegisterInstance(name string, ins Instance, ttl int64) error {
 	//ticker := time.NewTicker(time.Second * time.Duration(ttl))
+	key := cl.instanceKey(name, ins.Addr)
+	cl.setInstance(key, ins)
 
 	go func() {
 		for {
-			getResp, err := cl.cli.Get(context.Background(), "/"+cl.scheme+"/"+name+"/"+addr)
+			ins, ok := cl.instance(key)
+			if !ok {
+				// unregistered
+				return
+			}
+			getResp, err := cl.cli.Get(context.Background(), key)
 			if err != nil {
 				log.Printf("获取服务信息失败, error: %s", err)
 			} else if getResp.Count == 0 {
-				if err = cl.withAlive(name, addr, ttl); err != nil {
+				if err = cl.withAlive(key, ins, ttl); err != nil {
 					log.Fatalf("注册服务失败, error: %s", err)
 				}
 			} else {
@@ -30,13 +44,55 @@ func (cl *Client) RegisterService(name, addr string, ttl int64) error {
 	return nil
 }
 
-func (cl *Client) withAlive(name, addr string, ttl int64) error {
+func (cl *Client) instanceKey(name, addr string) string {
+	return "/" + cl.scheme + "/" + name + "/" + addr
+}
+
+func (cl *Client) setInstance(key string, ins Instance) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if cl.instances == nil {
+		cl.instances = make(map[string]Instance)
+	}
+	cl.instances[key] = ins
+}
+
+func (cl *Client) instance(key string) (Instance, bool) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	ins, ok := cl.instances[key]
+	return ins, ok
+}
+
+// SetWeight changes the weight of a registered instance, a weight of 0 drains it without deregistering
+func (cl *Client) SetWeight(name, addr string, weight int) error {
+	key := cl.instanceKey(name, addr)
+	resp, err := cl.cli.Get(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	if resp.Count == 0 {
+		return fmt.Errorf("instance %s of %s is not registered", addr, name)
+	}
+	ins := ParseInstance(addr, resp.Kvs[0].Value)
+	ins.Weight = weight
+	cl.lock.Lock()
+	if _, ok := cl.instances[key]; ok {
+		cl.instances[key] = ins
+	}
+	cl.lock.Unlock()
+	// keep the lease, the instance goes away with its process as before
+	_, err = cl.cli.Put(context.Background(), key, ins.Marshal(), clientv3.WithIgnoreLease())
+	return err
+}
+
+func (cl *Client) withAlive(key string, ins Instance, ttl int64) error {
 	leaseResp, err := cl.cli.Grant(context.Background(), ttl)
 	if err != nil {
 		return err
 	}
-	log.Printf("service alive:%v\n", "/"+cl.scheme+"/"+name+"/"+addr)
-	if _, err := cl.cli.Put(context.Background(), "/"+cl.scheme+"/"+name+"/"+addr, addr, clientv3.WithLease(leaseResp.ID)); err != nil {
+	log.Printf("service alive:%v\n", key)
+	if _, err := cl.cli.Put(context.Background(), key, ins.Marshal(), clientv3.WithLease(leaseResp.ID)); err != nil {
 		return err
 	}
 
@@ -46,9 +102,67 @@ func (cl *Client) withAlive(name, addr string, ttl int64) error {
 	return nil
 }
 
+// WatchService blocks until ctx is done, calling onChange whenever an instance of service comes or goes
+func (cl *Client) WatchService(ctx context.Context, name string, onChange func()) {
+	cl.watchKeys(ctx, "/"+cl.scheme+"/"+name+"/", clientv3.WithPrefix(), 0, nil, onChange)
+}
+
+// WatchInstances blocks like WatchService, for the instances of every service
+func (cl *Client) WatchInstances(ctx context.Context, onChange func()) {
+	cl.watchKeys(ctx, "/"+cl.scheme+"/", clientv3.WithPrefix(), 0, nil, onChange)
+}
+
+// watchKeys calls onChange when the keys of key and scope, like clientv3.WithPrefix(), accepted by
+// match change after rev, nil matches every key. A broken watch is opened again where it stopped, a
+// compacted one from the current revision, the changes it missed count as one.
+func (cl *Client) watchKeys(ctx context.Context, key string, scope clientv3.OpOption, rev int64, match func(key []byte) bool, onChange func()) {
+	for ctx.Err() == nil {
+		if rev == 0 {
+			resp, err := cl.cli.Get(ctx, key, scope, clientv3.WithCountOnly())
+			if err != nil {
+				log.Printf("get %s failed, error: %s", key, err)
+				waitRewatch(ctx)
+				continue
+			}
+			rev = resp.Header.Revision
+		}
+		rev = cl.followKeys(ctx, key, scope, rev, match, onChange)
+	}
+}
+
+// followKeys runs a single watch after rev, it returns the revision seen last or 0 when it was compacted
+func (cl *Client) followKeys(ctx context.Context, key string, scope clientv3.OpOption, rev int64, match func(key []byte) bool, onChange func()) int64 {
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for resp := range cl.cli.Watch(wctx, key, scope, clientv3.WithRev(rev+1)) {
+		if err := resp.Err(); err != nil {
+			if err == rpctypes.ErrCompacted {
+				log.Printf("watch %s compacted at revision %d, get again", key, resp.CompactRevision)
+				onChange()
+				return 0
+			}
+			log.Printf("watch %s failed, error: %s", key, err)
+			break
+		}
+		for _, ev := range resp.Events {
+			if match == nil || match(ev.Kv.Key) {
+				onChange()
+				break
+			}
+		}
+		rev = resp.Header.Revision
+	}
+	waitRewatch(ctx)
+	return rev
+}
+
 func (cl *Client) UnRegister(name, addr string) error {
 	if cl.cli != nil {
-		_, err := cl.cli.Delete(context.Background(), "/"+cl.scheme+"/"+name+"/"+addr)
+		key := cl.instanceKey(name, addr)
+		cl.lock.Lock()
+		delete(cl.instances, key)
+		cl.lock.Unlock()
+		_, err := cl.cli.Delete(context.Background(), key)
 		return err
 	}
 	return nil
@@ -63,7 +177,10 @@ func (cl *Client) RegisterApi(name string, data interface{}, config conf.YamlCon
 			// 说明配置文件没有包含此方法
 			log.Fatal("注册Api失败, service.yaml文件未包含此方法: ", methodName)
 		}
-		err := RegisterMethod(cl, config.Version, name, methodName, md.Authorization)
+		if md.HashKey == "" {
+			md.HashKey = config.HashKey
+		}
+		err := RegisterMethodWith(cl, config.Version, name, methodName, md)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,47 @@
+package etcd
+
+import (
+	"context"
+	"go.etcd.io/etcd/client/v3"
+	"testing"
+	"time"
+)
+
+func TestClient_WatchKeysCompacted(t *testing.T) {
+	cli := startEtcd(t)
+	resp, err := cli.cli.Get(context.Background(), "compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the watch falls behind a compaction and goes on from the current revision
+	put(t, cli, "user", "10.0.0.1:8080")
+	put(t, cli, "user", "10.0.0.2:8080")
+	if _, err = cli.cli.Compact(context.Background(), resp.Header.Revision+2); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 10)
+	go cli.watchKeys(ctx, "/"+cli.scheme+"/user/", clientv3.WithPrefix(), resp.Header.Revision, nil, func() { changed <- struct{}{} })
+	expectChange := func(what string) {
+		t.Helper()
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not seen", what)
+		}
+	}
+	expectChange("compaction")
+	// the watch is open again once the compaction was reported, keep changing until it sees one
+	deadline := time.After(5 * time.Second)
+	for seen := false; !seen; {
+		put(t, cli, "user", "10.0.0.3:8080")
+		select {
+		case <-changed:
+			seen = true
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("change after the compaction not seen")
+		}
+	}
+}
@@ -3,115 +3,178 @@ package etcd
 import (
 	"context"
 	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"go.etcd.io/etcd/client/v3"
 	re "google.golang.org/grpc/resolver"
+	"log"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
-type resolver struct {
-	scheme  string
-	client  *Client
-	cc      re.ClientConn
-	lock    sync.RWMutex
-	watcher map[string]bool
-}
-
-func NewResolver(client *Client, scheme string) re.Builder {
-	return &resolver{client: client, scheme: scheme, watcher: make(map[string]bool)}
-}
+// rewatchDelay the wait before a broken watch is opened again
+const rewatchDelay = time.Second
 
-func (r *resolver) Get(key string) bool {
-	r.lock.RLock()
-	defer r.lock.RUnlock()
-	_, ok := r.watcher[key]
-	return ok
+type builder struct {
+	scheme string
+	client *Client
 }
 
-func (r *resolver) Set(key string) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	r.watcher[key] = true
+// NewResolver returns a builder resolving /scheme/name/addr keys of etcd, every target gets its own
+// resolver watching the instances of its service. The metadata of every instance is attached to its
+// address, see InstanceOf.
+func NewResolver(client *Client, scheme string) re.Builder {
+	return &builder{client: client, scheme: scheme}
 }
 
-func (r *resolver) Build(target re.Target, cc re.ClientConn, opt re.BuildOptions) (re.Resolver, error) {
-	r.cc = cc
-	key := "/" + target.Scheme + "/" + target.Endpoint + "/"
-	address := r.addr(key)
-	if !r.Get(key) {
-		go r.watch(key, &address)
-		r.Set(key)
+func (b *builder) Build(target re.Target, cc re.ClientConn, opt re.BuildOptions) (re.Resolver, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &resolver{
+		client:     b.client,
+		cc:         cc,
+		prefix:     "/" + b.scheme + "/" + target.Endpoint + "/",
+		ctx:        ctx,
+		cancel:     cancel,
+		resolveNow: make(chan struct{}, 1),
 	}
+	if err := r.list(); err != nil {
+		cancel()
+		return nil, err
+	}
+	r.wg.Add(1)
+	go r.watch()
 	return r, nil
 }
 
-func (r *resolver) Scheme() string {
-	return r.scheme
+func (b *builder) Scheme() string {
+	return b.scheme
 }
 
-func (r *resolver) ResolveNow(rn re.ResolveNowOptions) {
+// resolver keeps the addresses of one service up to date
+type resolver struct {
+	client *Client
+	cc     re.ClientConn
+	prefix string
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// resolveNow asks the watch loop to list the instances again
+	resolveNow chan struct{}
+	// addrs instances by key, only touched by Build and the watch loop
+	addrs map[string]Instance
+	// rev the etcd revision addrs is up to date with
+	rev int64
+}
 
+// ResolveNow lists the instances again, it never blocks
+func (r *resolver) ResolveNow(re.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
 }
 
+// Close stops watching etcd and waits for the watch loop to finish
 func (r *resolver) Close() {
-
+	r.cancel()
+	r.wg.Wait()
 }
 
-func (r *resolver) addr(keyPrefix string) []re.Address {
-	var addrList []re.Address
-	getResp, err := r.client.cli.Get(context.Background(), keyPrefix, clientv3.WithPrefix())
+// list replaces the known instances with the ones currently in etcd
+func (r *resolver) list() error {
+	resp, err := r.client.cli.Get(r.ctx, r.prefix, clientv3.WithPrefix())
 	if err != nil {
-		// TODO
-		return nil
+		return err
+	}
+	r.addrs = make(map[string]Instance, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		r.addrs[string(kv.Key)] = ParseInstance(strings.TrimPrefix(string(kv.Key), r.prefix), kv.Value)
 	}
-	for i := range getResp.Kvs {
-		addrList = append(addrList, re.Address{Addr: strings.TrimPrefix(string(getResp.Kvs[i].Key), keyPrefix)})
+	r.rev = resp.Header.Revision
+	r.update()
+	return nil
+}
+
+func (r *resolver) update() {
+	addrList := make([]re.Address, 0, len(r.addrs))
+	for _, ins := range r.addrs {
+		addrList = append(addrList, ins.Address())
+	}
+	sort.Slice(addrList, func(i, j int) bool { return addrList[i].Addr < addrList[j].Addr })
+	if err := r.cc.UpdateState(re.State{Addresses: addrList}); err != nil {
+		log.Printf("update addresses of %s failed, error: %s", r.prefix, err)
 	}
-	state := re.State{Addresses: addrList}
-	r.cc.UpdateState(state)
-	return addrList
 }
 
-func (r *resolver) watch(keyPrefix string, addrList *[]re.Address) {
-	rch := r.client.cli.Watch(context.Background(), keyPrefix, clientv3.WithPrefix())
+// watch follows the changes after rev until the resolver is closed. A compacted revision cannot be
+// resumed from, the instances are listed again and the watch goes on from there.
+func (r *resolver) watch() {
+	defer r.wg.Done()
+	for r.ctx.Err() == nil {
+		r.follow()
+	}
+}
+
+// follow runs a single watch, it returns when the watch has to be opened again
+func (r *resolver) follow() {
+	ctx, cancel := context.WithCancel(r.ctx)
+	defer cancel()
+	wch := r.client.cli.Watch(ctx, r.prefix, clientv3.WithPrefix(), clientv3.WithRev(r.rev+1))
 	for {
 		select {
-		case n := <-rch:
-			for _, ev := range n.Events {
-				addr := strings.TrimPrefix(string(ev.Kv.Key), keyPrefix)
+		case <-r.ctx.Done():
+			return
+		case <-r.resolveNow:
+			if err := r.list(); err != nil {
+				r.cc.ReportError(err)
+				continue
+			}
+			// pick up after the listed revision
+			return
+		case resp, ok := <-wch:
+			if !ok {
+				r.wait()
+				return
+			}
+			if err := resp.Err(); err != nil {
+				if err == rpctypes.ErrCompacted {
+					log.Printf("watch %s compacted at revision %d, list again", r.prefix, resp.CompactRevision)
+					if err = r.list(); err == nil {
+						return
+					}
+				}
+				log.Printf("watch %s failed, error: %s", r.prefix, err)
+				r.wait()
+				return
+			}
+			if len(resp.Events) == 0 {
+				continue
+			}
+			for _, ev := range resp.Events {
+				key := string(ev.Kv.Key)
 				switch ev.Type {
 				case mvccpb.PUT:
-					if !exist(*addrList, addr) {
-						*addrList = append(*addrList, re.Address{Addr: addr})
-					}
+					r.addrs[key] = ParseInstance(strings.TrimPrefix(key, r.prefix), ev.Kv.Value)
 				case mvccpb.DELETE:
-					if s, ok := remove(*addrList, addr); ok {
-						addrList = &s
-						r.cc.UpdateState(re.State{Addresses: *addrList})
-					}
-
+					delete(r.addrs, key)
 				}
 			}
+			r.rev = resp.Header.Revision
+			r.update()
 		}
 	}
-
 }
 
-func exist(l []re.Address, addr string) bool {
-	for _, item := range l {
-		if item.Addr == addr {
-			return true
-		}
-	}
-	return false
+// wait pauses before the watch is opened again, unless the resolver is closed
+func (r *resolver) wait() {
+	waitRewatch(r.ctx)
 }
 
-func remove(l []re.Address, addr string) ([]re.Address, bool) {
-	for i, item := range l {
-		if item.Addr == addr {
-			l[i] = l[len(l)-1]
-			return l[:len(l)-1], true
-		}
+// waitRewatch pauses before a broken watch is opened again, unless ctx is done
+func waitRewatch(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(rewatchDelay):
 	}
-	return nil, false
 }
@@ -0,0 +1,272 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"github.com/wuranxu/light/conf"
+	"go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	re "google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"net"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// freeURL returns a local url nobody listens on yet
+func freeURL(t *testing.T) url.URL {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return url.URL{Scheme: "http", Host: lis.Addr().String()}
+}
+
+// startEtcd runs a single node etcd for the test and returns a client of it
+func startEtcd(t *testing.T) *Client {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	client, peer := freeURL(t), freeURL(t)
+	cfg.LCUrls, cfg.ACUrls = []url.URL{client}, []url.URL{client}
+	cfg.LPUrls, cfg.APUrls = []url.URL{peer}, []url.URL{peer}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("etcd did not start")
+	}
+	cli, err := clientv3.New(clientv3.Config{Endpoints: []string{client.String()}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	return &Client{kv: clientv3.NewKV(cli), cli: cli, scheme: "light"}
+}
+
+// stateRecorder a ClientConn handing every state to the test
+type stateRecorder struct {
+	states chan []string
+	lock   sync.Mutex
+	last   re.State
+}
+
+func newStateRecorder() *stateRecorder {
+	return &stateRecorder{states: make(chan []string, 100)}
+}
+
+func (s *stateRecorder) UpdateState(state re.State) error {
+	s.lock.Lock()
+	s.last = state
+	s.lock.Unlock()
+	addrs := make([]string, 0, len(state.Addresses))
+	for _, addr := range state.Addresses {
+		addrs = append(addrs, addr.Addr)
+	}
+	s.states <- addrs
+	return nil
+}
+
+func (s *stateRecorder) instances(t *testing.T) []Instance {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	instances := make([]Instance, 0, len(s.last.Addresses))
+	for _, addr := range s.last.Addresses {
+		ins, ok := InstanceOf(addr)
+		if !ok {
+			t.Fatalf("expected metadata with %s", addr.Addr)
+		}
+		instances = append(instances, ins)
+	}
+	return instances
+}
+
+func (s *stateRecorder) ReportError(error) {}
+
+func (s *stateRecorder) NewAddress([]re.Address) {}
+
+func (s *stateRecorder) NewServiceConfig(string) {}
+
+func (s *stateRecorder) ParseServiceConfig(string) *serviceconfig.ParseResult {
+	return nil
+}
+
+// expect waits for the addresses to become expected
+func (s *stateRecorder) expect(t *testing.T, expected ...string) {
+	t.Helper()
+	if expected == nil {
+		expected = []string{}
+	}
+	timeout := time.After(5 * time.Second)
+	var last []string
+	for {
+		select {
+		case last = <-s.states:
+			if reflect.DeepEqual(last, expected) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("expected addresses %v, last got %v", expected, last)
+		}
+	}
+}
+
+func put(t *testing.T, cli *Client, service, addr string) {
+	if _, err := cli.cli.Put(context.Background(), fmt.Sprintf("/%s/%s/%s", cli.scheme, service, addr), addr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func del(t *testing.T, cli *Client, service, addr string) {
+	if _, err := cli.cli.Delete(context.Background(), fmt.Sprintf("/%s/%s/%s", cli.scheme, service, addr)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	cli := startEtcd(t)
+	builder := NewResolver(cli, cli.scheme)
+	put(t, cli, "user", "10.0.0.1:8080")
+	put(t, cli, "order", "10.0.1.1:8080")
+
+	users, orders := newStateRecorder(), newStateRecorder()
+	ur, err := builder.Build(re.Target{Scheme: cli.scheme, Endpoint: "user"}, users, re.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ur.Close()
+	or, err := builder.Build(re.Target{Scheme: cli.scheme, Endpoint: "order"}, orders, re.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users.expect(t, "10.0.0.1:8080")
+	orders.expect(t, "10.0.1.1:8080")
+
+	// a new instance is used right away
+	put(t, cli, "user", "10.0.0.2:8080")
+	users.expect(t, "10.0.0.1:8080", "10.0.0.2:8080")
+	del(t, cli, "user", "10.0.0.1:8080")
+	users.expect(t, "10.0.0.2:8080")
+	// targets do not clobber each other
+	put(t, cli, "order", "10.0.1.2:8080")
+	orders.expect(t, "10.0.1.1:8080", "10.0.1.2:8080")
+	select {
+	case addrs := <-users.states:
+		t.Fatalf("expected the user target to be left alone, got %v", addrs)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ur.ResolveNow(re.ResolveNowOptions{})
+	users.expect(t, "10.0.0.2:8080")
+
+	// a closed resolver does not report anymore
+	or.Close()
+	put(t, cli, "order", "10.0.1.3:8080")
+	put(t, cli, "user", "10.0.0.3:8080")
+	users.expect(t, "10.0.0.2:8080", "10.0.0.3:8080")
+	select {
+	case addrs := <-orders.states:
+		t.Fatalf("expected a closed resolver to stop watching, got %v", addrs)
+	default:
+	}
+}
+
+func TestResolver_Compacted(t *testing.T) {
+	cli := startEtcd(t)
+	put(t, cli, "user", "10.0.0.1:8080")
+	states := newStateRecorder()
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &resolver{
+		client:     cli,
+		cc:         states,
+		prefix:     "/" + cli.scheme + "/user/",
+		ctx:        ctx,
+		cancel:     cancel,
+		resolveNow: make(chan struct{}, 1),
+	}
+	if err := r.list(); err != nil {
+		t.Fatal(err)
+	}
+	states.expect(t, "10.0.0.1:8080")
+
+	// changes the resolver missed are compacted away before it starts watching
+	del(t, cli, "user", "10.0.0.1:8080")
+	put(t, cli, "user", "10.0.0.2:8080")
+	resp, err := cli.cli.Get(context.Background(), "compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.cli.Compact(context.Background(), resp.Header.Revision); err != nil {
+		t.Fatal(err)
+	}
+	r.wg.Add(1)
+	go r.watch()
+	defer r.Close()
+	states.expect(t, "10.0.0.2:8080")
+
+	put(t, cli, "user", "10.0.0.3:8080")
+	states.expect(t, "10.0.0.2:8080", "10.0.0.3:8080")
+}
+
+func TestParseInstance(t *testing.T) {
+	cases := map[string]Instance{
+		"10.0.0.1:8080": {Addr: "10.0.0.1:8080", Weight: DefaultWeight},
+		`{"addr": "10.0.0.1:8080", "zone": "sh"}`:    {Addr: "10.0.0.1:8080", Weight: DefaultWeight, Zone: "sh"},
+		`{"addr": "10.0.0.1:8080", "weight": 0}`:     {Addr: "10.0.0.1:8080"},
+		`{"weight": 5, "labels": {"canary": "yes"}}`: {Addr: "10.0.0.1:8080", Weight: 5, Labels: map[string]string{"canary": "yes"}},
+		`{"addr": `: {Addr: "10.0.0.1:8080", Weight: DefaultWeight},
+	}
+	for value, expected := range cases {
+		if got := ParseInstance("10.0.0.1:8080", []byte(value)); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("%s: expected %+v, got %+v", value, expected, got)
+		}
+	}
+}
+
+func TestResolver_Instance(t *testing.T) {
+	cli := startEtcd(t)
+	weight := 50
+	ins := NewInstance("10.0.0.1:8080", conf.YamlConfig{
+		Version:  "v1",
+		Instance: conf.InstanceConfig{Weight: &weight, Zone: "sh-a", Labels: map[string]string{"canary": "yes"}},
+	})
+	if err := cli.RegisterInstance("user", ins, 10); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.UnRegister("user", ins.Addr)
+	// an instance of an older version
+	put(t, cli, "user", "10.0.0.2:8080")
+
+	states := newStateRecorder()
+	r, err := NewResolver(cli, cli.scheme).Build(re.Target{Scheme: cli.scheme, Endpoint: "user"}, states, re.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	states.expect(t, "10.0.0.1:8080", "10.0.0.2:8080")
+	expected := []Instance{ins, {Addr: "10.0.0.2:8080", Weight: DefaultWeight}}
+	if got := states.instances(t); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+
+	// draining keeps the instance registered
+	if err = cli.SetWeight("user", ins.Addr, 0); err != nil {
+		t.Fatal(err)
+	}
+	states.expect(t, "10.0.0.1:8080", "10.0.0.2:8080")
+	if got := states.instances(t)[0]; got.Weight != 0 || got.Zone != "sh-a" {
+		t.Fatalf("expected a drained instance, got %+v", got)
+	}
+	if err = cli.SetWeight("user", "10.0.0.9:8080", 0); err == nil {
+		t.Fatal("expected an unknown instance to fail")
+	}
+}
@@ -0,0 +1,64 @@
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Split a share of the calls of a route that goes to another version
+type Split struct {
+	Version string `json:"version"`
+	// Percent share of the calls between 0 and 100, a user always lands on the same side
+	Percent float64 `json:"percent,omitempty"`
+	// Users ids of users whose calls always go to Version
+	Users []int `json:"users,omitempty"`
+	// Headers calls carrying one of these headers with its value always go to Version
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// SplitRule the splits of a route, checked in order. Calls no split claims stay on the version of
+// the route.
+type SplitRule struct {
+	Splits []Split `json:"splits"`
+}
+
+func (r *SplitRule) Marshal() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+// splitKey the key of the split rule of a method, or of the whole service without a method
+func splitKey(version, service, method string) string {
+	if method == "" {
+		return fmt.Sprintf("split.%s.%s", version, LowerFirst(service))
+	}
+	return fmt.Sprintf("split.%s.%s.%s", version, LowerFirst(service), LowerFirst(method))
+}
+
+// SetSplit stores the split rule of a method, an empty method sets the rule of every method of the service
+func SetSplit(client *Client, version, service, method string, rule *SplitRule) error {
+	_, err := client.cli.Put(client.cli.Ctx(), splitKey(version, service, method), rule.Marshal())
+	return err
+}
+
+func RemoveSplit(client *Client, version, service, method string) error {
+	_, err := client.cli.Delete(client.cli.Ctx(), splitKey(version, service, method))
+	return err
+}
+
+// GetSplit returns the split rule of a method, falling back to the rule of its service. Routes without
+// a rule return nil.
+func (cl *Client) GetSplit(version, service, method string) (*SplitRule, error) {
+	for _, key := range []string{splitKey(version, service, method), splitKey(version, service, "")} {
+		value := cl.GetSingle(key)
+		if value == "" {
+			continue
+		}
+		rule := new(SplitRule)
+		if err := json.Unmarshal([]byte(value), rule); err != nil {
+			return nil, fmt.Errorf("malformed split rule %s: %w", key, err)
+		}
+		return rule, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,42 @@
+package etcd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestClient_GetSplit(t *testing.T) {
+	cli := startEtcd(t)
+	if rule, err := cli.GetSplit("v1", "user", "login"); rule != nil || err != nil {
+		t.Fatalf("expected no rule, got %+v, %v", rule, err)
+	}
+
+	service := &SplitRule{Splits: []Split{{Version: "v2", Percent: 1}}}
+	if err := SetSplit(cli, "v1", "User", "", service); err != nil {
+		t.Fatal(err)
+	}
+	if rule, err := cli.GetSplit("v1", "user", "login"); err != nil || !reflect.DeepEqual(rule, service) {
+		t.Fatalf("expected the rule of the service, got %+v, %v", rule, err)
+	}
+	method := &SplitRule{Splits: []Split{{Version: "v2", Percent: 10, Users: []int{1}, Headers: map[string]string{"X-Canary": "1"}}}}
+	if err := SetSplit(cli, "v1", "User", "Login", method); err != nil {
+		t.Fatal(err)
+	}
+	if rule, err := cli.GetSplit("v1", "user", "login"); err != nil || !reflect.DeepEqual(rule, method) {
+		t.Fatalf("expected the rule of the method, got %+v, %v", rule, err)
+	}
+	if err := RemoveSplit(cli, "v1", "User", "Login"); err != nil {
+		t.Fatal(err)
+	}
+	if rule, err := cli.GetSplit("v1", "user", "login"); err != nil || !reflect.DeepEqual(rule, service) {
+		t.Fatalf("expected the rule of the service again, got %+v, %v", rule, err)
+	}
+
+	if _, err := cli.cli.Put(context.Background(), "split.v1.order.create", "10%"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.GetSplit("v1", "order", "create"); err == nil {
+		t.Fatal("expected a malformed rule to fail")
+	}
+}
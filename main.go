@@ -1,14 +1,25 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/wuranxu/light/api"
 	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/rpc"
 	"github.com/wuranxu/light/internal/service/etcd"
+	"github.com/wuranxu/light/middleware"
+	"github.com/wuranxu/light/service"
+	"google.golang.org/grpc"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var (
@@ -25,15 +36,68 @@ func main() {
 	if err := etcd.Init(conf.Conf.Etcd); err != nil {
 		log.Fatal("init etcd error: ", err)
 	}
+	service.Clients = service.NewGrpcCache(rpc.NewGrpcClient, time.Duration(conf.Conf.Pool.IdleTimeout)*time.Second)
 	app := gin.New()
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: []string{"*"},
 		AllowMethods: []string{"OPTION", "GET", "PUT", "POST", "DELETE", "PATCH"},
 		AllowHeaders: []string{"*"},
+		// grpc-web clients read the status of calls answered trailers only from the headers, downloads
+		// tell their file name
+		ExposeHeaders: []string{"grpc-status", "grpc-message", "Content-Disposition"},
 	}))
-	app.Use(gin.Logger())
+	app.Use(gin.LoggerWithFormatter(middleware.AccessLog))
 	app.Use(gin.Recovery())
+	app.Use(service.GrpcWebHandler, service.ConnectHandler)
 	router := api.NewRouter(app)
+	routesCtx, stopRoutes := context.WithCancel(context.Background())
+	defer stopRoutes()
+	router.AddRestRoutes()
+	router.AddOpenAPI()
 	router.AddRoute()
-	app.Run(fmt.Sprintf("%s:%d", *serverHost, *serverPort))
+	router.WatchRegistry(routesCtx)
+	srv := &http.Server{Addr: fmt.Sprintf("%s:%d", *serverHost, *serverPort), Handler: app}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("gateway listen error: ", err)
+		}
+	}()
+	var proxy *grpc.Server
+	if cfg := conf.Conf.Proxy; cfg.Port > 0 {
+		var err error
+		if proxy, err = service.NewProxyServer(cfg); err != nil {
+			log.Fatal("init grpc proxy error: ", err)
+		}
+		lis, err := net.Listen("tcp", fmt.Sprintf("%s:%d", *serverHost, cfg.Port))
+		if err != nil {
+			log.Fatal("grpc proxy listen error: ", err)
+		}
+		go func() {
+			if err := proxy.Serve(lis); err != nil {
+				log.Fatal("grpc proxy serve error: ", err)
+			}
+		}()
+	}
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("gateway shutdown error: ", err)
+	}
+	if proxy != nil {
+		stopped := make(chan struct{})
+		go func() {
+			proxy.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			proxy.Stop()
+		}
+	}
+	service.Clients.Close()
+	etcd.Cli.Close()
 }
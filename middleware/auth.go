@@ -9,6 +9,8 @@ import (
 const (
 	SignKey      = "pityToken"
 	AuthFailCode = 103
+	// TokenQuery the query parameter carrying the token of a websocket handshake
+	TokenQuery = "token"
 )
 
 var (
@@ -17,6 +19,15 @@ var (
 
 func GetUserInfo(ctx *gin.Context) (*auth.UserInfo, error) {
 	token := ctx.GetHeader("token")
+	if token == "" && strings.EqualFold(ctx.GetHeader("Upgrade"), "websocket") {
+		// browsers can not set headers on a websocket handshake
+		token = ctx.Query(TokenQuery)
+	}
+	return ParseToken(token)
+}
+
+// ParseToken returns the user of a token, with or without a scheme like Bearer in front
+func ParseToken(token string) (*auth.UserInfo, error) {
 	if s := strings.Split(token, " "); len(s) == 2 {
 		token = s[1]
 	}
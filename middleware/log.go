@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// ZoneKey context key of the zone of the backend that served the request
+	ZoneKey = "served_zone"
+	// UpstreamKey context key of the address of the backend that served the request
+	UpstreamKey = "served_upstream"
+)
+
+// AccessLog the default gin access log with the zone and address of the serving backend appended
+func AccessLog(param gin.LogFormatterParams) string {
+	var statusColor, methodColor, resetColor string
+	if param.IsOutputColor() {
+		statusColor = param.StatusCodeColor()
+		methodColor = param.MethodColor()
+		resetColor = param.ResetColor()
+	}
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	zone, upstream := "-", "-"
+	if v, ok := param.Keys[ZoneKey].(string); ok && v != "" {
+		zone = v
+	}
+	if v, ok := param.Keys[UpstreamKey].(string); ok && v != "" {
+		upstream = v
+	}
+	return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v | zone=%s upstream=%s\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		statusColor, param.StatusCode, resetColor,
+		param.Latency,
+		param.ClientIP,
+		methodColor, param.Method, resetColor,
+		redact(param.Path),
+		zone, upstream,
+		param.ErrorMessage,
+	)
+}
+
+// redact hides the token a websocket handshake carries in the query
+func redact(path string) string {
+	i := strings.IndexByte(path, '?')
+	if i < 0 {
+		return path
+	}
+	query, err := url.ParseQuery(path[i+1:])
+	if err != nil {
+		return path[:i] + "?<unparsable>"
+	}
+	if !query.Has(TokenQuery) {
+		return path
+	}
+	query.Set(TokenQuery, "REDACTED")
+	return path[:i] + "?" + query.Encode()
+}
@@ -0,0 +1,257 @@
+package service
+
+import (
+	"errors"
+	"github.com/wuranxu/light/internal/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrCacheClosed = errors.New("grpc client cache is closed")
+	// Clients shared grpc connections, one per service
+	Clients = NewGrpcCache(rpc.NewGrpcClient, 0)
+)
+
+type Dialer func(service string) (*rpc.GrpcClient, error)
+
+type cachedClient struct {
+	client   *rpc.GrpcClient
+	inflight int32
+	lastUsed int64
+	retired  int32
+	once     sync.Once
+}
+
+func (c *cachedClient) acquire() {
+	atomic.AddInt32(&c.inflight, 1)
+	atomic.StoreInt64(&c.lastUsed, time.Now().UnixNano())
+}
+
+func (c *cachedClient) release() {
+	atomic.StoreInt64(&c.lastUsed, time.Now().UnixNano())
+	c.done()
+}
+
+// done ends a use of the client, the last use of a retired client closes it
+func (c *cachedClient) done() {
+	if atomic.AddInt32(&c.inflight, -1) == 0 && atomic.LoadInt32(&c.retired) == 1 {
+		c.close()
+	}
+}
+
+// retire closes the client as soon as its calls in flight are done
+func (c *cachedClient) retire() {
+	atomic.StoreInt32(&c.retired, 1)
+	if atomic.LoadInt32(&c.inflight) == 0 {
+		c.close()
+	}
+}
+
+func (c *cachedClient) close() (err error) {
+	c.once.Do(func() { err = c.client.Close() })
+	return err
+}
+
+func (c *cachedClient) idle(now time.Time, timeout time.Duration) bool {
+	if atomic.LoadInt32(&c.inflight) > 0 {
+		return false
+	}
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastUsed))) >= timeout
+}
+
+// dialCall a dial in progress, callers asking for the same service wait for it
+type dialCall struct {
+	done chan struct{}
+	err  error
+}
+
+// GrpcCache keeps one long-lived GrpcClient per service name. Clients are dialed
+// lazily on first use and closed after staying unused for idleTimeout.
+type GrpcCache struct {
+	lock        sync.RWMutex
+	cache       map[string]*cachedClient
+	dialing     map[string]*dialCall
+	dial        Dialer
+	idleTimeout time.Duration
+	closed      bool
+	done        chan struct{}
+	once        sync.Once
+}
+
+// NewGrpcCache idleTimeout <= 0 disables idle eviction
+func NewGrpcCache(dial Dialer, idleTimeout time.Duration) *GrpcCache {
+	g := &GrpcCache{
+		cache:       make(map[string]*cachedClient),
+		dialing:     make(map[string]*dialCall),
+		dial:        dial,
+		idleTimeout: idleTimeout,
+		done:        make(chan struct{}),
+	}
+	if idleTimeout > 0 {
+		go g.evictLoop()
+	}
+	return g
+}
+
+// GetClient returns the shared client of service, the returned release func must be
+// called once the caller has finished using the client.
+func (g *GrpcCache) GetClient(service string) (*rpc.GrpcClient, func(), error) {
+	for {
+		g.lock.RLock()
+		if g.closed {
+			g.lock.RUnlock()
+			return nil, nil, ErrCacheClosed
+		}
+		entry, ok := g.cache[service]
+		if ok {
+			entry.acquire()
+		}
+		g.lock.RUnlock()
+		if ok {
+			return entry.client, entry.release, nil
+		}
+		// dialed outside the lock, a slow service must not hold up the others
+		if err := g.dialOnce(service); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// dialOnce dials service unless a dial of it is in progress already, then it waits for that one
+func (g *GrpcCache) dialOnce(service string) error {
+	g.lock.Lock()
+	if g.closed {
+		g.lock.Unlock()
+		return ErrCacheClosed
+	}
+	if _, ok := g.cache[service]; ok {
+		g.lock.Unlock()
+		return nil
+	}
+	if call, ok := g.dialing[service]; ok {
+		g.lock.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &dialCall{done: make(chan struct{})}
+	g.dialing[service] = call
+	g.lock.Unlock()
+
+	client, err := g.dial(service)
+	g.lock.Lock()
+	delete(g.dialing, service)
+	_, set := g.cache[service]
+	switch {
+	case err != nil:
+		call.err = err
+	case g.closed:
+		call.err = ErrCacheClosed
+	case !set:
+		g.cache[service] = &cachedClient{client: client, lastUsed: time.Now().UnixNano()}
+		client = nil
+	}
+	g.lock.Unlock()
+	close(call.done)
+	// the cache closed or SetClient won meanwhile
+	if client != nil {
+		client.Close()
+	}
+	return call.err
+}
+
+// Borrow lends the client of service to background work like building the REST routes. A pooled
+// client is lent without counting as used, so it still gets evicted when idle. Otherwise a client is
+// dialed for the caller alone, release closes it.
+func (g *GrpcCache) Borrow(service string) (*rpc.GrpcClient, func(), error) {
+	g.lock.RLock()
+	if g.closed {
+		g.lock.RUnlock()
+		return nil, nil, ErrCacheClosed
+	}
+	entry, ok := g.cache[service]
+	if ok {
+		atomic.AddInt32(&entry.inflight, 1)
+	}
+	g.lock.RUnlock()
+	if ok {
+		return entry.client, entry.done, nil
+	}
+	client, err := g.dial(service)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, func() { client.Close() }, nil
+}
+
+func (g *GrpcCache) SetClient(service string, client *rpc.GrpcClient) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	old, ok := g.cache[service]
+	g.cache[service] = &cachedClient{client: client, lastUsed: time.Now().UnixNano()}
+	if ok && old.client != client {
+		old.retire()
+	}
+}
+
+// Remove drops the client of service, it is closed once its calls are done. The next GetClient
+// dials again.
+func (g *GrpcCache) Remove(service string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if entry, ok := g.cache[service]; ok {
+		delete(g.cache, service)
+		entry.retire()
+	}
+}
+
+func (g *GrpcCache) Len() int {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return len(g.cache)
+}
+
+func (g *GrpcCache) evictLoop() {
+	interval := g.idleTimeout / 2
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case now := <-ticker.C:
+			g.evict(now)
+		}
+	}
+}
+
+func (g *GrpcCache) evict(now time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for service, entry := range g.cache {
+		if entry.idle(now, g.idleTimeout) {
+			delete(g.cache, service)
+			entry.close()
+		}
+	}
+}
+
+// Close stops eviction and closes every cached client
+func (g *GrpcCache) Close() error {
+	g.once.Do(func() { close(g.done) })
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.closed = true
+	var err error
+	for service, entry := range g.cache {
+		if e := entry.close(); e != nil && err == nil {
+			err = e
+		}
+		delete(g.cache, service)
+	}
+	return err
+}
@@ -0,0 +1,263 @@
+package service
+
+import (
+	"context"
+	"github.com/wuranxu/light/internal/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T) *bufconn.Listener {
+	lis, _, _ := startHealthServer(t)
+	return lis
+}
+
+// startHealthServer serves the health and reflection services in process
+func startHealthServer(t *testing.T) (*bufconn.Listener, *health.Server, *grpc.Server) {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer()
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	reflection.Register(srv)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis, hs, srv
+}
+
+func bufDialer(lis *bufconn.Listener, dialed *int32) Dialer {
+	return func(service string) (*rpc.GrpcClient, error) {
+		atomic.AddInt32(dialed, 1)
+		conn, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+			grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+				return lis.Dial()
+			}))
+		if err != nil {
+			return nil, err
+		}
+		return rpc.NewClient(conn, nil), nil
+	}
+}
+
+func TestGrpcCache_GetClientShared(t *testing.T) {
+	lis := startServer(t)
+	var dialed int32
+	cache := NewGrpcCache(bufDialer(lis, &dialed), 0)
+	defer cache.Close()
+
+	var wg sync.WaitGroup
+	clients := make([]*rpc.GrpcClient, 20)
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, release, err := cache.GetClient("user")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer release()
+			clients[i] = client
+		}(i)
+	}
+	wg.Wait()
+	if dialed != 1 {
+		t.Fatalf("expected 1 dial, got %d", dialed)
+	}
+	for _, c := range clients {
+		if c != clients[0] {
+			t.Fatal("expected every caller to share the same client")
+		}
+	}
+
+	client, release, err := cache.GetClient("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(client.Conn()).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("unexpected health status: %v", resp.Status)
+	}
+
+	if _, release, err := cache.GetClient("order"); err != nil {
+		t.Fatal(err)
+	} else {
+		release()
+	}
+	if dialed != 2 || cache.Len() != 2 {
+		t.Fatalf("expected a client per service, dialed %d, cached %d", dialed, cache.Len())
+	}
+}
+
+func TestGrpcCache_EvictIdle(t *testing.T) {
+	lis := startServer(t)
+	var dialed int32
+	cache := NewGrpcCache(bufDialer(lis, &dialed), 50*time.Millisecond)
+	defer cache.Close()
+
+	busy, releaseBusy, err := cache.GetClient("busy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle, release, err := cache.GetClient("idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for cache.Len() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cache.Len() != 1 {
+		t.Fatalf("expected idle client to be evicted, %d cached", cache.Len())
+	}
+	if idle.Conn().GetState() != connectivity.Shutdown {
+		t.Fatal("expected evicted client to be closed")
+	}
+	if busy.Conn().GetState() == connectivity.Shutdown {
+		t.Fatal("client in use must not be evicted")
+	}
+	releaseBusy()
+
+	again, release, err := cache.GetClient("idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if again == idle || dialed != 3 {
+		t.Fatal("expected evicted client to be dialed again")
+	}
+}
+
+func TestGrpcCache_Close(t *testing.T) {
+	lis := startServer(t)
+	var dialed int32
+	cache := NewGrpcCache(bufDialer(lis, &dialed), time.Minute)
+	client, release, err := cache.GetClient("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if client.Conn().GetState() != connectivity.Shutdown {
+		t.Fatal("expected client to be closed")
+	}
+	if _, _, err := cache.GetClient("user"); err != ErrCacheClosed {
+		t.Fatalf("expected ErrCacheClosed, got %v", err)
+	}
+	// closing twice is harmless
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGrpcCache_DialOutsideLock(t *testing.T) {
+	lis := startServer(t)
+	var dialed int32
+	dial := bufDialer(lis, &dialed)
+	unblock := make(chan struct{})
+	cache := NewGrpcCache(func(service string) (*rpc.GrpcClient, error) {
+		if service == "slow" {
+			<-unblock
+		}
+		return dial(service)
+	}, 0)
+	defer cache.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, release, err := cache.GetClient("slow"); err != nil {
+				t.Error(err)
+			} else {
+				release()
+			}
+		}()
+	}
+	// a service stuck dialing does not hold up the others
+	if _, release, err := cache.GetClient("user"); err != nil {
+		t.Fatal(err)
+	} else {
+		release()
+	}
+	close(unblock)
+	wg.Wait()
+	if dialed != 2 {
+		t.Fatalf("expected a single dial per service, got %d", dialed)
+	}
+}
+
+func TestGrpcCache_RemoveInFlight(t *testing.T) {
+	lis := startServer(t)
+	var dialed int32
+	cache := NewGrpcCache(bufDialer(lis, &dialed), 0)
+	defer cache.Close()
+
+	client, release, err := cache.GetClient("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Remove("user")
+	if client.Conn().GetState() == connectivity.Shutdown {
+		t.Fatal("client in use must not be closed")
+	}
+	release()
+	if client.Conn().GetState() != connectivity.Shutdown {
+		t.Fatal("expected removed client to be closed once released")
+	}
+}
+
+func TestGrpcCache_Borrow(t *testing.T) {
+	lis := startServer(t)
+	var dialed int32
+	cache := NewGrpcCache(bufDialer(lis, &dialed), time.Hour)
+	defer cache.Close()
+
+	// services nobody calls are dialed for the borrower alone
+	client, release, err := cache.Borrow("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if cache.Len() != 0 || client.Conn().GetState() != connectivity.Shutdown {
+		t.Fatal("expected a borrowed client to be closed and not pooled")
+	}
+
+	pooled, release, err := cache.GetClient("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	used := atomic.LoadInt64(&cache.cache["user"].lastUsed)
+	if client, release, err = cache.Borrow("user"); err != nil || client != pooled {
+		t.Fatalf("expected the pooled client to be lent, got %v", err)
+	}
+	// lent clients are not evicted, but borrowing does not count as using them
+	cache.evict(time.Now().Add(2 * time.Hour))
+	if cache.Len() != 1 {
+		t.Fatal("client in use must not be evicted")
+	}
+	release()
+	if atomic.LoadInt64(&cache.cache["user"].lastUsed) != used {
+		t.Fatal("expected borrowing to leave the last use alone")
+	}
+}
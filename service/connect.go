@@ -0,0 +1,356 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
+	"github.com/wuranxu/light/internal/balancer"
+	"github.com/wuranxu/light/internal/errors"
+	"github.com/wuranxu/light/internal/rpc"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	ConnectProtocolVersion = "Connect-Protocol-Version"
+	ConnectTimeout         = "Connect-Timeout-Ms"
+	// connectStreamType prefix of the content types of connect streams, followed by the codec
+	connectStreamType = "application/connect+"
+	codecJson         = "json"
+	codecProto        = "proto"
+	// endStreamFlag marks the last frame of a connect stream, it carries the status
+	endStreamFlag byte = 0x02
+)
+
+// connectType tells whether the request is a connect call, whether it is a stream and its codec.
+// Unary calls need the protocol version header, plain json calls of the gateway look the same.
+func connectType(ctx *gin.Context) (ok bool, stream bool, codec string) {
+	contentType := ctx.ContentType()
+	if strings.HasPrefix(contentType, connectStreamType) {
+		codec = strings.TrimPrefix(contentType, connectStreamType)
+		return codec == codecJson || codec == codecProto, true, codec
+	}
+	if ctx.GetHeader(ConnectProtocolVersion) != "1" {
+		return false, false, ""
+	}
+	switch contentType {
+	case "application/" + codecJson:
+		return true, false, codecJson
+	case "application/" + codecProto:
+		return true, false, codecProto
+	}
+	return false, false, ""
+}
+
+// ConnectHandler answers connect calls on /package.Service/Method. Their messages are transcoded with
+// the descriptors of the method and sent to the backend like native grpc calls, other requests pass on.
+func ConnectHandler(ctx *gin.Context) {
+	if ok, _, _ := connectType(ctx); !ok || ctx.Request.Method != http.MethodPost {
+		ctx.Next()
+		return
+	}
+	ctx.Abort()
+	serveConnect(ctx, func(ss grpc.ServerStream) error {
+		return forward(ss, ctx.Request.URL.Path, ctx.ClientIP())
+	})
+}
+
+// serveConnect hands a connect call to call as a grpc stream and writes the answer
+func serveConnect(ctx *gin.Context, call func(ss grpc.ServerStream) error) {
+	_, stream, codec := connectType(ctx)
+	s := &connectStream{gin: ctx, stream: stream, codec: codec}
+	err := s.init()
+	if err == nil {
+		var cancel context.CancelFunc
+		if cancel, err = s.deadline(); err == nil {
+			err = call(s)
+			cancel()
+		}
+	}
+	s.finish(status.Convert(err))
+}
+
+// connectStream a grpc.ServerStream over a connect call. Unary calls answer once the status is known,
+// since it decides the http status, streams answer message by message.
+type connectStream struct {
+	gin    *gin.Context
+	ctx    context.Context
+	stream bool
+	codec  string
+	body   io.Reader
+	// client and cache transcode json messages, set by bind
+	client *rpc.GrpcClient
+	cache  *rpc.MethodCache
+	// request the message of a unary call, read while binding
+	request  []byte
+	received bool
+	// response the message of a unary call
+	response []byte
+	header   metadata.MD
+	trailer  metadata.MD
+	sent     bool
+}
+
+func (s *connectStream) init() error {
+	if encoding := s.encoding(); encoding != "" && encoding != "identity" {
+		return status.Errorf(codes.Unimplemented, "unsupported compression %s", encoding)
+	}
+	md, err := incomingMetadata(s.gin.Request.Header)
+	if err != nil {
+		return err
+	}
+	s.ctx = metadata.NewIncomingContext(s.gin.Request.Context(), md)
+	s.body = s.gin.Request.Body
+	if s.gin.Request.ProtoMajor < 2 {
+		// http/1 bodies cannot be read once the answer started
+		body, err := readBody(s.body)
+		if err != nil {
+			return err
+		}
+		s.body = bytes.NewReader(body)
+	}
+	return nil
+}
+
+func (s *connectStream) encoding() string {
+	if s.stream {
+		return s.gin.GetHeader("Connect-Content-Encoding")
+	}
+	return s.gin.GetHeader("Content-Encoding")
+}
+
+// deadline bounds the call by the Connect-Timeout-Ms header
+func (s *connectStream) deadline() (context.CancelFunc, error) {
+	v := s.gin.GetHeader(ConnectTimeout)
+	if v == "" {
+		return func() {}, nil
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || ms <= 0 || len(v) > 10 {
+		return nil, status.Errorf(codes.InvalidArgument, "malformed %s: %q", ConnectTimeout, v)
+	}
+	var cancel context.CancelFunc
+	s.ctx, cancel = context.WithTimeout(balancer.WithClientDeadline(s.ctx), time.Duration(ms)*time.Millisecond)
+	return cancel, nil
+}
+
+// bind looks up the descriptors of the method, the request of a unary call is decoded right away so
+// a bad request fails before reaching the backend
+func (s *connectStream) bind(client *rpc.GrpcClient, method etcd.Method) error {
+	s.client = client
+	if s.codec == codecJson {
+		cache, err := client.Describe(method)
+		if err != nil {
+			return err
+		}
+		s.cache = cache
+	}
+	if s.stream {
+		return nil
+	}
+	data, err := readBody(s.body)
+	if err != nil {
+		return err
+	}
+	s.request, err = s.decode(data)
+	return err
+}
+
+// decode turns a message of the client into protobuf
+func (s *connectStream) decode(data []byte) ([]byte, error) {
+	if s.codec == codecProto {
+		return data, nil
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		data = []byte("{}")
+	}
+	msg := s.cache.NewRequest()
+	if err := s.client.Reflection().Unmarshal(data, msg); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return proto.Marshal(msg)
+}
+
+// encode turns a message of the backend into the codec of the client
+func (s *connectStream) encode(payload []byte) ([]byte, error) {
+	if s.codec == codecProto {
+		return payload, nil
+	}
+	msg := s.cache.NewResponse()
+	if err := proto.Unmarshal(payload, msg); err != nil {
+		return nil, err
+	}
+	return compactMessage(s.client, msg)
+}
+
+func (s *connectStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *connectStream) SetHeader(md metadata.MD) error {
+	if s.sent {
+		return fmt.Errorf("header already sent")
+	}
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *connectStream) SendHeader(md metadata.MD) error {
+	return s.SetHeader(md)
+}
+
+func (s *connectStream) SetTrailer(md metadata.MD) {
+	s.trailer = metadata.Join(s.trailer, md)
+}
+
+func (s *connectStream) SendMsg(m interface{}) error {
+	payload, err := rpc.RawCodec{}.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if payload, err = s.encode(payload); err != nil {
+		return err
+	}
+	if !s.stream {
+		s.response = payload
+		return nil
+	}
+	if !s.sent {
+		s.writeHeader()
+	}
+	return s.write(dataFlag, payload)
+}
+
+func (s *connectStream) RecvMsg(m interface{}) error {
+	if !s.stream {
+		if s.received {
+			return io.EOF
+		}
+		s.received = true
+		return rpc.RawCodec{}.Unmarshal(s.request, m)
+	}
+	flag, payload, err := readEnvelope(s.body)
+	if err != nil {
+		return err
+	}
+	if flag&compressed != 0 {
+		return status.Error(codes.Unimplemented, "compressed messages are not supported")
+	}
+	if payload, err = s.decode(payload); err != nil {
+		return err
+	}
+	return rpc.RawCodec{}.Unmarshal(payload, m)
+}
+
+func (s *connectStream) writeHeader() {
+	s.sent = true
+	h := s.gin.Writer.Header()
+	writeMetadata(h, "", s.header)
+	h.Set("Content-Type", connectStreamType+s.codec)
+	s.gin.Status(http.StatusOK)
+	s.gin.Writer.WriteHeaderNow()
+	s.gin.Writer.Flush()
+}
+
+func (s *connectStream) write(flag byte, payload []byte) error {
+	if _, err := s.gin.Writer.Write(envelope(flag, payload)); err != nil {
+		return err
+	}
+	s.gin.Writer.Flush()
+	return nil
+}
+
+// connectError the error of a connect call, in the body of unary calls and the end of streams
+type connectError struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message,omitempty"`
+	Details []connectDetail `json:"details,omitempty"`
+}
+
+type connectDetail struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// endStream the last message of a connect stream
+type endStream struct {
+	Error    *connectError       `json:"error,omitempty"`
+	Metadata map[string][]string `json:"metadata,omitempty"`
+}
+
+func newConnectError(stat *status.Status) *connectError {
+	if stat.Code() == codes.OK {
+		return nil
+	}
+	e := &connectError{Code: connectCode(stat.Code()), Message: stat.Message()}
+	for _, d := range stat.Proto().GetDetails() {
+		typ := d.GetTypeUrl()
+		e.Details = append(e.Details, connectDetail{
+			Type:  typ[strings.LastIndex(typ, "/")+1:],
+			Value: base64.RawStdEncoding.EncodeToString(d.GetValue()),
+		})
+	}
+	return e
+}
+
+// connectCode the name of a code in connect, like invalid_argument
+func connectCode(code codes.Code) string {
+	var sb strings.Builder
+	for i, r := range code.String() {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				sb.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// finish ends the call with its status: unary calls map it to the http status and send trailers as
+// headers prefixed with Trailer-, streams end with a frame holding the status and the trailers
+func (s *connectStream) finish(stat *status.Status) {
+	if stat == nil {
+		stat = status.New(codes.OK, "")
+	}
+	if s.stream {
+		if !s.sent {
+			s.writeHeader()
+		}
+		end := endStream{Error: newConnectError(stat)}
+		if len(s.trailer) > 0 {
+			h := http.Header{}
+			writeMetadata(h, "", s.trailer)
+			end.Metadata = make(map[string][]string, len(h))
+			for k, v := range h {
+				end.Metadata[strings.ToLower(k)] = v
+			}
+		}
+		data, _ := json.Marshal(end)
+		s.write(endStreamFlag, data)
+		return
+	}
+	h := s.gin.Writer.Header()
+	writeMetadata(h, "", s.header)
+	writeMetadata(h, "Trailer-", s.trailer)
+	if stat.Code() != codes.OK {
+		data, _ := json.Marshal(newConnectError(stat))
+		s.gin.Data(errors.HTTPStatus(stat.Code()), "application/json", data)
+		return
+	}
+	s.gin.Data(http.StatusOK, "application/"+s.codec, s.response)
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/rpc"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func connectGateway(t *testing.T, client *rpc.GrpcClient) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	app.Use(func(ctx *gin.Context) {
+		serveConnect(ctx, func(ss grpc.ServerStream) error {
+			method := etcd.Method{Path: ctx.Request.URL.Path}
+			if err := ss.(boundStream).bind(client, method); err != nil {
+				return err
+			}
+			return client.Proxy(ss, method, ctx.ClientIP(), nil)
+		})
+	})
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestConnect_Unary(t *testing.T) {
+	lis, hs, _ := startHealthServer(t)
+	var dialed int32
+	client, err := bufDialer(lis, &dialed)("health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	gateway := connectGateway(t, client)
+	hs.SetServingStatus("user", healthpb.HealthCheckResponse_NOT_SERVING)
+	version := []string{ConnectProtocolVersion, "1"}
+
+	resp, body := postRaw(t, gateway.URL+healthCheck, "application/json", []byte(`{"service": "user"}`), version...)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected answer %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if string(body) != `{"status":"NOT_SERVING"}` {
+		t.Fatalf("unexpected body %s", body)
+	}
+
+	req, _ := proto.Marshal(&healthpb.HealthCheckRequest{Service: "user"})
+	resp, body = postRaw(t, gateway.URL+healthCheck, "application/proto", req, version...)
+	var out healthpb.HealthCheckResponse
+	if err = proto.Unmarshal(body, &out); err != nil || resp.StatusCode != http.StatusOK || out.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("unexpected answer %d %v: %v", resp.StatusCode, out.Status, err)
+	}
+
+	// errors map to the http status, the body describes them
+	cases := []struct {
+		body   string
+		status int
+		code   string
+	}{
+		{`{"service": "order"}`, http.StatusNotFound, "not_found"},
+		{`{"service": 1`, http.StatusBadRequest, "invalid_argument"},
+	}
+	for _, c := range cases {
+		resp, body = postRaw(t, gateway.URL+healthCheck, "application/json", []byte(c.body), version...)
+		var e connectError
+		if err = json.Unmarshal(body, &e); err != nil || resp.StatusCode != c.status || e.Code != c.code {
+			t.Fatalf("%s: expected %d %s, got %d %s", c.body, c.status, c.code, resp.StatusCode, body)
+		}
+	}
+
+	defer func(size int64) { conf.Conf.Gateway.MaxBodySize = size }(conf.Conf.Gateway.MaxBodySize)
+	conf.Conf.Gateway.MaxBodySize = 8
+	resp, body = postRaw(t, gateway.URL+healthCheck, "application/json", []byte(`{"service": "user"}`), version...)
+	var e connectError
+	if err = json.Unmarshal(body, &e); err != nil || resp.StatusCode != http.StatusTooManyRequests || e.Code != "resource_exhausted" {
+		t.Fatalf("expected resource_exhausted, got %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestConnect_Stream(t *testing.T) {
+	lis, hs, _ := startHealthServer(t)
+	var dialed int32
+	client, err := bufDialer(lis, &dialed)("health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	gateway := connectGateway(t, client)
+	hs.SetServingStatus("user", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	resp, body := postRaw(t, gateway.URL+healthWatch, "application/connect+json",
+		envelope(dataFlag, []byte(`{"service": "user"}`)), ConnectTimeout, "200")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/connect+json" {
+		t.Fatalf("unexpected answer %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	r := bytes.NewReader(body)
+	flag, msg, err := readEnvelope(r)
+	if err != nil || flag != dataFlag || !strings.Contains(string(msg), "NOT_SERVING") {
+		t.Fatalf("unexpected message %d %s: %v", flag, msg, err)
+	}
+	flag, msg, err = readEnvelope(r)
+	var end endStream
+	if err != nil || flag != endStreamFlag || json.Unmarshal(msg, &end) != nil || end.Error == nil || end.Error.Code != "deadline_exceeded" {
+		t.Fatalf("expected the stream to end with deadline_exceeded, got %d %s: %v", flag, msg, err)
+	}
+}
+
+func TestConnectCode(t *testing.T) {
+	cases := map[codes.Code]string{
+		codes.Canceled:          "canceled",
+		codes.InvalidArgument:   "invalid_argument",
+		codes.DeadlineExceeded:  "deadline_exceeded",
+		codes.ResourceExhausted: "resource_exhausted",
+	}
+	for code, expected := range cases {
+		if got := connectCode(code); got != expected {
+			t.Fatalf("expected %s, got %s", expected, got)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/auth"
+	"github.com/wuranxu/light/internal/rpc"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// httpBody the response type whose methods answer files without being registered as downloads
+	httpBody = "google.api.HttpBody"
+	// byField prefix of download options naming a field of the response
+	byField            = "field:"
+	defaultContentType = "application/octet-stream"
+)
+
+// downloadOf how the answer of the method is written as a file, nil for json answers
+func downloadOf(method etcd.Method, cache *rpc.MethodCache) *conf.DownloadConfig {
+	if method.Download != nil {
+		return method.Download
+	}
+	if cache.Method().GetOutputType().GetFullyQualifiedName() == httpBody {
+		return &conf.DownloadConfig{}
+	}
+	return nil
+}
+
+// file the content of a response and what it is, content may be a chunk of a streamed file
+type file struct {
+	contentType string
+	filename    string
+	content     []byte
+}
+
+// readFile reads the file of a response as cfg describes it
+func readFile(cfg *conf.DownloadConfig, msg proto.Message) (*file, error) {
+	dm, err := dynamic.AsDynamicMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	field := cfg.Field
+	if field == "" {
+		field = "data"
+	}
+	fd := dm.GetMessageDescriptor().FindFieldByName(field)
+	if fd == nil || fd.IsRepeated() || fd.GetType() != descriptor.FieldDescriptorProto_TYPE_BYTES {
+		return nil, fmt.Errorf("%s has no bytes field %s", dm.GetMessageDescriptor().GetFullyQualifiedName(), field)
+	}
+	f := &file{content: dm.GetField(fd).([]byte)}
+	f.contentType = downloadOption(dm, cfg.ContentType, byField+"content_type")
+	f.filename = downloadOption(dm, cfg.Filename, byField+"filename")
+	return f, nil
+}
+
+// downloadOption a fixed value or the value of the string field it names, fallback when it is empty
+func downloadOption(msg *dynamic.Message, option, fallback string) string {
+	if option == "" {
+		option = fallback
+	}
+	if !strings.HasPrefix(option, byField) {
+		return option
+	}
+	fd := msg.GetMessageDescriptor().FindFieldByName(strings.TrimPrefix(option, byField))
+	if fd == nil || fd.IsRepeated() || fd.GetType() != descriptor.FieldDescriptorProto_TYPE_STRING {
+		return ""
+	}
+	return msg.GetField(fd).(string)
+}
+
+// setFileHeader describes the file, browsers save it under its name
+func setFileHeader(h http.Header, f *file) {
+	contentType := f.contentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	h.Set("Content-Type", contentType)
+	disposition := "attachment"
+	if f.filename != "" {
+		// non ascii names are encoded as rfc 2231 asks
+		if d := mime.FormatMediaType(disposition, map[string]string{"filename": f.filename}); d != "" {
+			disposition = d
+		}
+	}
+	h.Set("Content-Disposition", disposition)
+	h.Set("X-Content-Type-Options", "nosniff")
+}
+
+// writeDownload writes the answer of a unary call as a file
+func writeDownload(ctx *gin.Context, cfg *conf.DownloadConfig, msg proto.Message) {
+	f, err := readFile(cfg, msg)
+	if err != nil {
+		failed(ctx, http.StatusInternalServerError, &res{Code: IntervalServerError, Msg: err.Error()})
+		return
+	}
+	setFileHeader(ctx.Writer.Header(), f)
+	ctx.Status(http.StatusOK)
+	ctx.Writer.Write(f.content)
+}
+
+// downloadStream writes the chunks of a server streaming method as one file while they arrive, the
+// first message tells what the file is. Once the file started, the status follows in the Grpc-Status
+// and Grpc-Message trailers, a download cut short by an error is told apart by them.
+func downloadStream(ctx *gin.Context, client *rpc.GrpcClient, method etcd.Method, userInfo *auth.UserInfo, cfg *conf.DownloadConfig) {
+	started := false
+	var (
+		trailer metadata.MD
+		fileErr error
+	)
+	err := client.InvokeServerStream(ctx.Request.Context(), method, ctx.Request.Body, ctx.RemoteIP(), userInfo, func(msg proto.Message) error {
+		f, err := readFile(cfg, msg)
+		if err != nil {
+			fileErr = err
+			return err
+		}
+		if !started {
+			started = true
+			h := ctx.Writer.Header()
+			setFileHeader(h, f)
+			h.Set("Trailer", "Grpc-Status, Grpc-Message")
+			ctx.Status(http.StatusOK)
+		}
+		if _, err = ctx.Writer.Write(f.content); err != nil {
+			return err
+		}
+		ctx.Writer.Flush()
+		return nil
+	}, grpc.Trailer(&trailer))
+	if !started {
+		switch {
+		case err == nil:
+			// an empty stream is an empty file
+			setFileHeader(ctx.Writer.Header(), &file{contentType: fixedOption(cfg.ContentType), filename: fixedOption(cfg.Filename)})
+			ctx.Status(http.StatusOK)
+			ctx.Writer.WriteHeaderNow()
+		case fileErr != nil:
+			failed(ctx, http.StatusInternalServerError, &res{Code: IntervalServerError, Msg: fileErr.Error()})
+		case ctx.Request.Context().Err() != context.Canceled:
+			remoteError(ctx, client, err, trailer)
+		}
+		return
+	}
+	stat := status.Convert(err)
+	if fileErr != nil {
+		stat = status.New(codes.Internal, fileErr.Error())
+	}
+	h := ctx.Writer.Header()
+	h.Set("Grpc-Status", strconv.Itoa(int(stat.Code())))
+	h.Set("Grpc-Message", encodeGrpcMessage(stat.Message()))
+}
+
+// fixedOption the option unless it names a field
+func fixedOption(option string) string {
+	if strings.HasPrefix(option, byField) {
+		return ""
+	}
+	return option
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/rpc"
+	"github.com/wuranxu/light/internal/service/etcd"
+	_ "google.golang.org/genproto/googleapis/api/httpbody"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const reportsProto = `syntax = "proto3";
+package reports;
+
+import "google/api/httpbody.proto";
+
+message ExportRequest {
+  int32 chunks = 1;
+  bool fail = 2;
+}
+
+message ReportFile {
+  string name = 1;
+  bytes content = 2;
+}
+
+service Reports {
+  rpc Export(ExportRequest) returns (google.api.HttpBody);
+  rpc ExportStream(ExportRequest) returns (stream google.api.HttpBody);
+  rpc Report(ExportRequest) returns (ReportFile);
+}
+`
+
+// startReports answers chunks csv lines, one per message of a stream, fail ends the stream with an error
+func startReports(t *testing.T) *rpc.GrpcClient {
+	parser := protoparse.Parser{
+		Accessor:     protoparse.FileContentsFromMap(map[string]string{"reports.proto": reportsProto}),
+		LookupImport: desc.LoadFileDescriptor,
+	}
+	return startDynamicServer(t, parser, "reports.proto", func(md *desc.MethodDescriptor, ss grpc.ServerStream) error {
+		req := dynamic.NewMessage(md.GetInputType())
+		if err := ss.RecvMsg(req); err != nil {
+			return err
+		}
+		chunks := int(req.GetFieldByName("chunks").(int32))
+		if md.GetName() == "Report" {
+			reply := dynamic.NewMessage(md.GetOutputType())
+			reply.SetFieldByName("name", "报表.csv")
+			reply.SetFieldByName("content", []byte(strings.Repeat("a,b\n", chunks)))
+			return ss.SendMsg(reply)
+		}
+		for i := 0; i < chunks; i++ {
+			body := dynamic.NewMessage(md.GetOutputType())
+			body.SetFieldByName("content_type", "text/csv")
+			body.SetFieldByName("data", []byte("a,b\n"))
+			if err := ss.SendMsg(body); err != nil {
+				return err
+			}
+			if !md.IsServerStreaming() {
+				return nil
+			}
+		}
+		if req.GetFieldByName("fail").(bool) {
+			return status.Error(codes.DataLoss, "disk failed")
+		}
+		return nil
+	})
+}
+
+func downloadGateway(t *testing.T, client *rpc.GrpcClient) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	app.POST("/:method", func(ctx *gin.Context) {
+		method := etcd.Method{Path: "/reports.Reports/" + ctx.Param("method")}
+		if ctx.Param("method") == "Report" {
+			method.Download = &conf.DownloadConfig{Field: "content", Filename: "field:name", ContentType: "text/csv"}
+		}
+		cache, err := client.Describe(method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		download := downloadOf(method, cache)
+		if download == nil {
+			t.Fatalf("%s is no download", method.Path)
+		}
+		if cache.Method().IsServerStreaming() {
+			downloadStream(ctx, client, method, nil, download)
+			return
+		}
+		resp, err := client.InvokeWithReflect(ctx, method, ctx.Request.Body, ctx.RemoteIP(), nil)
+		if err != nil {
+			remoteError(ctx, client, err, nil)
+			return
+		}
+		writeDownload(ctx, download, resp)
+	})
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDownload(t *testing.T) {
+	gateway := downloadGateway(t, startReports(t))
+	cases := []struct {
+		method      string
+		body        string
+		disposition string
+		content     string
+		grpcStatus  string
+	}{
+		{"Export", `{"chunks": 1}`, "attachment", "a,b\n", ""},
+		{"Report", `{"chunks": 2}`, "attachment; filename*=utf-8''%E6%8A%A5%E8%A1%A8.csv", "a,b\na,b\n", ""},
+		// the file was cut short, the trailers tell
+		{"ExportStream", `{"chunks": 2, "fail": true}`, "attachment", "a,b\na,b\n", "15"},
+	}
+	for _, c := range cases {
+		resp, err := http.Post(gateway.URL+"/"+c.method, gin.MIMEJSON, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/csv" || resp.Header.Get("Content-Disposition") != c.disposition {
+			t.Fatalf("%s %s: unexpected answer %d %v", c.method, c.body, resp.StatusCode, resp.Header)
+		}
+		if string(content) != c.content || resp.Trailer.Get("Grpc-Status") != c.grpcStatus {
+			t.Fatalf("%s %s: unexpected file %q with status %q", c.method, c.body, content, resp.Trailer.Get("Grpc-Status"))
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"strings"
+	"testing"
+)
+
+// startDynamicServer serves the services of a proto file through serve and returns a client knowing
+// their descriptors from the file
+func startDynamicServer(t *testing.T, parser protoparse.Parser, filename string, serve func(md *desc.MethodDescriptor, ss grpc.ServerStream) error) *rpc.GrpcClient {
+	fds, err := parser.ParseFiles(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer(grpc.UnknownServiceHandler(func(_ interface{}, ss grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(ss)
+		i := strings.LastIndex(method, "/")
+		sd := fds[0].FindService(strings.TrimPrefix(method[:i], "/"))
+		if sd == nil {
+			return status.Errorf(codes.Unimplemented, "unknown method %s", method)
+		}
+		return serve(sd.FindMethodByName(method[i+1:]), ss)
+	}))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.NewClient(conn, nil)
+	t.Cleanup(func() { client.Close() })
+	src, err := rpc.DescriptorSourceFromFileDescriptors(fds...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Reflection().SetFileSource(conf.SourceFile, src)
+	return client
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/balancer"
+	"github.com/wuranxu/light/internal/errors"
+	"github.com/wuranxu/light/internal/rpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"net/http"
+	"strings"
+)
+
+// statusData the data of the envelope of a failed remote call
+type statusData struct {
+	GrpcCode   codes.Code          `json:"grpc_code"`
+	GrpcStatus string              `json:"grpc_status"`
+	Details    []json.RawMessage   `json:"details,omitempty"`
+	Trailers   map[string][]string `json:"trailers,omitempty"`
+}
+
+func newStatusData(client *rpc.GrpcClient, stat *errors.Status, trailer metadata.MD) *statusData {
+	data := &statusData{GrpcCode: stat.Code(), GrpcStatus: stat.Code().String()}
+	if client != nil {
+		data.Details = client.Reflection().Details(stat)
+	}
+	for k, v := range trailer {
+		// binary trailers like grpc-status-details-bin are already rendered as details
+		if strings.HasSuffix(k, "-bin") {
+			continue
+		}
+		if data.Trailers == nil {
+			data.Trailers = make(map[string][]string)
+		}
+		data.Trailers[k] = v
+	}
+	return data
+}
+
+// failed writes an error envelope, in legacy mode the http status is always 200
+func failed(ctx *gin.Context, httpStatus int, r *res) {
+	if conf.Conf.Gateway.LegacyErrors {
+		httpStatus = http.StatusOK
+	}
+	ctx.JSON(httpStatus, r)
+}
+
+// remoteError writes the error of a backend call, the grpc code decides the http status
+func remoteError(ctx *gin.Context, client *rpc.GrpcClient, err error, trailer metadata.MD) {
+	if balancer.Rejected(err) {
+		// the service is known to be down, fail fast like an unknown service
+		failed(ctx, http.StatusServiceUnavailable, &res{Code: NoAvailableService, Msg: err.Error()})
+		return
+	}
+	if conf.Conf.Gateway.LegacyErrors {
+		response(ctx, &res{Code: RemoteCallFailed, Msg: err.Error()})
+		return
+	}
+	stat, fromServer := errors.FromError(err)
+	if !fromServer {
+		// the request never reached the backend, it did not decode
+		failed(ctx, http.StatusBadRequest, &res{Code: ArgsParseFailed, Msg: err.Error()})
+		return
+	}
+	ctx.JSON(errors.HTTPStatus(stat.Code()), &res{
+		Code: RemoteCallFailed,
+		Msg:  stat.Message(),
+		Data: newStatusData(client, stat, trailer),
+	})
+}
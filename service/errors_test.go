@@ -0,0 +1,99 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/balancer"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteError(t *testing.T) {
+	lis := startServer(t)
+	var dialed int32
+	client, err := bufDialer(lis, &dialed)("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stat, err := status.New(codes.InvalidArgument, "bad user").WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: "name", Description: "required"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trailer := metadata.Pairs("x-request-id", "42", "grpc-status-details-bin", "ignored")
+
+	cases := []struct {
+		err    error
+		legacy bool
+		status int
+		code   int32
+	}{
+		{stat.Err(), false, http.StatusBadRequest, RemoteCallFailed},
+		{status.Error(codes.NotFound, "no user"), false, http.StatusNotFound, RemoteCallFailed},
+		{status.Error(codes.PermissionDenied, "denied"), false, http.StatusForbidden, RemoteCallFailed},
+		{status.Error(codes.Unavailable, "down"), false, http.StatusServiceUnavailable, RemoteCallFailed},
+		{fmt.Errorf("unexpected EOF"), false, http.StatusBadRequest, ArgsParseFailed},
+		{status.Error(codes.Unavailable, "down"), true, http.StatusOK, RemoteCallFailed},
+		{balancer.ErrCircuitOpen, false, http.StatusServiceUnavailable, NoAvailableService},
+		{balancer.ErrNoHealthyBackend, true, http.StatusOK, NoAvailableService},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, c := range cases {
+		conf.Conf.Gateway.LegacyErrors = c.legacy
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		remoteError(ctx, client, c.err, trailer)
+		if w.Code != c.status {
+			t.Fatalf("%v: expected http %d, got %d", c.err, c.status, w.Code)
+		}
+		var r struct {
+			Code int32       `json:"code"`
+			Msg  string      `json:"msg"`
+			Data *statusData `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Code != c.code {
+			t.Fatalf("%v: expected code %d, got %d", c.err, c.code, r.Code)
+		}
+		if c.legacy && (r.Msg != c.err.Error() || r.Data != nil) {
+			t.Fatalf("expected the legacy envelope, got %s", w.Body.String())
+		}
+	}
+	conf.Conf.Gateway.LegacyErrors = false
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	remoteError(ctx, client, stat.Err(), trailer)
+	var r struct {
+		Msg  string `json:"msg"`
+		Data struct {
+			GrpcStatus string                   `json:"grpc_status"`
+			Details    []map[string]interface{} `json:"details"`
+			Trailers   map[string][]string      `json:"trailers"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Msg != "bad user" || r.Data.GrpcStatus != "InvalidArgument" {
+		t.Fatalf("unexpected envelope: %s", w.Body.String())
+	}
+	if len(r.Data.Details) != 1 || r.Data.Details[0]["@type"] != "type.googleapis.com/google.rpc.BadRequest" || r.Data.Details[0]["fieldViolations"] == nil {
+		t.Fatalf("unexpected details: %s", w.Body.String())
+	}
+	if len(r.Data.Trailers) != 1 || r.Data.Trailers["x-request-id"][0] != "42" {
+		t.Fatalf("unexpected trailers: %v", r.Data.Trailers)
+	}
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wuranxu/light/internal/rpc"
+	"net/http"
+)
+
+// ContentProtobuf the content type of binary protobuf bodies, json stays the default
+const ContentProtobuf = "application/x-protobuf"
+
+// protobufTypes content types accepted for binary protobuf bodies
+var protobufTypes = map[string]bool{ContentProtobuf: true, "application/protobuf": true}
+
+// requestFormat the format of the body by its Content-Type
+func requestFormat(ctx *gin.Context) rpc.Format {
+	if protobufTypes[ctx.ContentType()] {
+		return rpc.ProtoFormat
+	}
+	return rpc.JsonFormat
+}
+
+// responseFormat the format of the answer by the Accept header, the first acceptable type wins
+func responseFormat(ctx *gin.Context) rpc.Format {
+	if protobufTypes[ctx.NegotiateFormat(gin.MIMEJSON, ContentProtobuf, "application/protobuf")] {
+		return rpc.ProtoFormat
+	}
+	return rpc.JsonFormat
+}
+
+// writeMessage writes the answer of a unary call in format, a REST route may narrow it to one field
+func writeMessage(ctx *gin.Context, client *rpc.GrpcClient, msg proto.Message, format rpc.Format) {
+	if field := ctx.GetString(responseBodyKey); field != "" {
+		if sub, ok := responseField(ctx, client, msg, field, format); ok {
+			return
+		} else if sub != nil {
+			msg = sub
+		}
+	}
+	if format == rpc.ProtoFormat {
+		data, err := proto.Marshal(msg)
+		if err != nil {
+			failed(ctx, http.StatusInternalServerError, &res{Code: IntervalServerError, Msg: err.Error()})
+			return
+		}
+		ctx.Data(http.StatusOK, ContentProtobuf, data)
+		return
+	}
+	ctx.Writer.Header().Set("Content-Type", "application/json;charset=utf8")
+	client.Marshal(ctx.Writer, msg)
+}
+
+// responseField writes the field of msg in json and returns true, a binary answer can only be narrowed
+// to a message field which is returned instead
+func responseField(ctx *gin.Context, client *rpc.GrpcClient, msg proto.Message, name string, format rpc.Format) (proto.Message, bool) {
+	dm, err := dynamic.AsDynamicMessage(msg)
+	if err != nil {
+		return nil, false
+	}
+	fd := dm.GetMessageDescriptor().FindFieldByName(name)
+	if fd == nil {
+		return nil, false
+	}
+	if format == rpc.ProtoFormat {
+		if fd.GetMessageType() == nil || fd.IsRepeated() {
+			return nil, false
+		}
+		sub, _ := dm.GetField(fd).(proto.Message)
+		return sub, false
+	}
+	var buf bytes.Buffer
+	if err = client.Marshal(&buf, msg); err != nil {
+		return nil, false
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		return nil, false
+	}
+	ctx.Data(http.StatusOK, "application/json;charset=utf8", fields[fd.GetJSONName()])
+	return nil, true
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/wuranxu/light/internal/rpc"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	cases := []struct {
+		contentType string
+		accept      string
+		request     rpc.Format
+		response    rpc.Format
+	}{
+		{"", "", rpc.JsonFormat, rpc.JsonFormat},
+		{"application/json", "*/*", rpc.JsonFormat, rpc.JsonFormat},
+		{ContentProtobuf, ContentProtobuf, rpc.ProtoFormat, rpc.ProtoFormat},
+		{"application/protobuf; charset=binary", "application/json", rpc.ProtoFormat, rpc.JsonFormat},
+		{"application/json", "application/x-protobuf, application/json", rpc.JsonFormat, rpc.ProtoFormat},
+		{"application/json", "text/html", rpc.JsonFormat, rpc.JsonFormat},
+	}
+	for _, c := range cases {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/user/login", nil)
+		ctx.Request.Header.Set("Content-Type", c.contentType)
+		ctx.Request.Header.Set("Accept", c.accept)
+		if got := requestFormat(ctx); got != c.request {
+			t.Fatalf("%s: expected request format %v, got %v", c.contentType, c.request, got)
+		}
+		if got := responseFormat(ctx); got != c.response {
+			t.Fatalf("%s: expected response format %v, got %v", c.accept, c.response, got)
+		}
+	}
+}
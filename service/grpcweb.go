@@ -0,0 +1,361 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/balancer"
+	"github.com/wuranxu/light/internal/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	GrpcWeb     = "application/grpc-web"
+	GrpcWebText = "application/grpc-web-text"
+	// frame flags of the grpc-web wire format
+	dataFlag    byte = 0x00
+	compressed  byte = 0x01
+	trailerFlag byte = 0x80
+	// defaultMaxBodySize the largest request like the default of grpc servers
+	defaultMaxBodySize = 4 << 20
+)
+
+// skippedHeaders browser and transport headers that are no grpc metadata
+var skippedHeaders = map[string]bool{
+	"accept": true, "accept-encoding": true, "accept-language": true, "connection": true, "content-length": true,
+	"content-type": true, "cookie": true, "origin": true, "referer": true, "x-grpc-web": true, "x-user-agent": true,
+}
+
+// grpcWebType tells whether the request is a grpc-web call and whether it is base64 encoded, only the
+// proto codec is supported
+func grpcWebType(contentType string) (web bool, text bool) {
+	switch contentType {
+	case GrpcWeb, GrpcWeb + "+proto":
+		return true, false
+	case GrpcWebText, GrpcWebText + "+proto":
+		return true, true
+	}
+	return false, false
+}
+
+// GrpcWebHandler answers grpc-web calls of browsers on /package.Service/Method. The calls go to the
+// backends through the pooled connections like native grpc calls, other requests pass on.
+func GrpcWebHandler(ctx *gin.Context) {
+	if _, ok := grpcWebType(ctx.ContentType()); !ok || ctx.Request.Method != http.MethodPost {
+		ctx.Next()
+		return
+	}
+	ctx.Abort()
+	serveGrpcWeb(ctx, func(ss grpc.ServerStream) error {
+		return forward(ss, ctx.Request.URL.Path, ctx.ClientIP())
+	})
+}
+
+// serveGrpcWeb decodes the request of a grpc-web call, hands it to call as a grpc stream and writes
+// the answer, the status goes in a trailer frame at the end of the body
+func serveGrpcWeb(ctx *gin.Context, call func(ss grpc.ServerStream) error) {
+	_, text := grpcWebType(ctx.ContentType())
+	s := &webStream{gin: ctx, text: text, contentType: ctx.ContentType()}
+	err := s.init()
+	if err == nil {
+		var cancel context.CancelFunc
+		if cancel, err = s.deadline(); err == nil {
+			err = call(s)
+			cancel()
+		}
+	}
+	s.finish(status.Convert(err))
+}
+
+// webStream a grpc.ServerStream over a grpc-web request. Browsers send the whole request at once, so
+// its messages are read up front.
+type webStream struct {
+	gin         *gin.Context
+	ctx         context.Context
+	text        bool
+	contentType string
+	frames      [][]byte
+	header      metadata.MD
+	trailer     metadata.MD
+	sent        bool
+}
+
+// incomingMetadata turns the headers of an http call into grpc metadata
+func incomingMetadata(header http.Header) (metadata.MD, error) {
+	md := metadata.MD{}
+	for k, v := range header {
+		k = strings.ToLower(k)
+		if skippedHeaders[k] || strings.HasPrefix(k, "sec-") || strings.HasPrefix(k, "connect-") {
+			continue
+		}
+		if strings.HasSuffix(k, "-bin") {
+			for _, value := range v {
+				decoded, err := base64.StdEncoding.DecodeString(value)
+				if err != nil {
+					return nil, status.Errorf(codes.InvalidArgument, "malformed binary header %s", k)
+				}
+				md.Append(k, string(decoded))
+			}
+			continue
+		}
+		md.Append(k, v...)
+	}
+	return md, nil
+}
+
+func (s *webStream) init() error {
+	md, err := incomingMetadata(s.gin.Request.Header)
+	if err != nil {
+		return err
+	}
+	s.ctx = metadata.NewIncomingContext(s.gin.Request.Context(), md)
+	body, err := readBody(s.gin.Request.Body)
+	if err != nil {
+		return err
+	}
+	if s.text {
+		if body, err = decodeText(body); err != nil {
+			return status.Errorf(codes.InvalidArgument, "malformed grpc-web-text body: %s", err)
+		}
+	}
+	r := bytes.NewReader(body)
+	for {
+		flag, payload, err := readEnvelope(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if flag&compressed != 0 {
+			return status.Error(codes.Unimplemented, "compressed grpc-web messages are not supported")
+		}
+		s.frames = append(s.frames, payload)
+	}
+}
+
+// maxBodySize the configured limit of request bodies
+func maxBodySize() int64 {
+	if size := conf.Conf.Gateway.MaxBodySize; size > 0 {
+		return size
+	}
+	return defaultMaxBodySize
+}
+
+// readBody reads a whole request body, one exceeding the max body size fails with ResourceExhausted
+func readBody(r io.Reader) ([]byte, error) {
+	limit := maxBodySize()
+	body, err := ioutil.ReadAll(&limitedReader{r: r, n: limit})
+	if errors.Is(err, errTooLarge) {
+		return nil, status.Errorf(codes.ResourceExhausted, "the request is larger than %d bytes", limit)
+	}
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return body, nil
+}
+
+// readEnvelope reads a message with its flag and length prefix, the way grpc-web and the connect
+// streams frame messages. io.EOF only comes between messages.
+func readEnvelope(r io.Reader) (byte, []byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.EOF {
+			return 0, nil, err
+		}
+		return 0, nil, status.Error(codes.InvalidArgument, "truncated message frame")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if limit := maxBodySize(); int64(size) > limit {
+		return 0, nil, status.Errorf(codes.ResourceExhausted, "the message is larger than %d bytes", limit)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, status.Error(codes.InvalidArgument, "truncated message frame")
+	}
+	return prefix[0], payload, nil
+}
+
+// deadline bounds the call by the grpc-timeout header
+func (s *webStream) deadline() (context.CancelFunc, error) {
+	timeout, err := requestTimeout(s.gin)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if timeout <= 0 {
+		return func() {}, nil
+	}
+	var cancel context.CancelFunc
+	s.ctx, cancel = context.WithTimeout(balancer.WithClientDeadline(s.ctx), timeout)
+	return cancel, nil
+}
+
+// decodeText decodes a grpc-web-text body, it may be made of several padded base64 chunks
+func decodeText(body []byte) ([]byte, error) {
+	body = bytes.Join(bytes.Fields(body), nil)
+	var out []byte
+	for len(body) > 0 {
+		end := len(body)
+		if i := bytes.IndexByte(body, '='); i >= 0 {
+			// the chunk ends after its padding
+			end = i
+			for end < len(body) && body[end] == '=' {
+				end++
+			}
+		}
+		chunk := make([]byte, base64.StdEncoding.DecodedLen(end))
+		n, err := base64.StdEncoding.Decode(chunk, body[:end])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, chunk[:n]...)
+		body = body[end:]
+	}
+	return out, nil
+}
+
+func (s *webStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *webStream) SetHeader(md metadata.MD) error {
+	if s.sent {
+		return fmt.Errorf("header already sent")
+	}
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+// SendHeader keeps the header until the first message, a call failing without messages is answered
+// trailers only
+func (s *webStream) SendHeader(md metadata.MD) error {
+	return s.SetHeader(md)
+}
+
+func (s *webStream) SetTrailer(md metadata.MD) {
+	s.trailer = metadata.Join(s.trailer, md)
+}
+
+func (s *webStream) SendMsg(m interface{}) error {
+	payload, err := rpc.RawCodec{}.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if !s.sent {
+		s.writeHeader(nil)
+	}
+	return s.write(dataFlag, payload)
+}
+
+func (s *webStream) RecvMsg(m interface{}) error {
+	if len(s.frames) == 0 {
+		return io.EOF
+	}
+	frame := s.frames[0]
+	s.frames = s.frames[1:]
+	return rpc.RawCodec{}.Unmarshal(frame, m)
+}
+
+// writeHeader sends the http headers, a call failing before its header puts the status in them
+func (s *webStream) writeHeader(stat *status.Status) {
+	s.sent = true
+	h := s.gin.Writer.Header()
+	writeMetadata(h, "", s.header)
+	h.Set("Content-Type", s.contentType)
+	if stat != nil {
+		writeMetadata(h, "", s.trailer)
+		h.Set("grpc-status", fmt.Sprint(uint32(stat.Code())))
+		if msg := stat.Message(); msg != "" {
+			h.Set("grpc-message", encodeGrpcMessage(msg))
+		}
+	}
+	s.gin.Status(http.StatusOK)
+	s.gin.Writer.WriteHeaderNow()
+	s.gin.Writer.Flush()
+}
+
+// writeMetadata adds grpc metadata to the headers of an http answer, binary values are base64 encoded
+func writeMetadata(h http.Header, prefix string, md metadata.MD) {
+	for k, v := range md {
+		if k == "content-type" {
+			continue
+		}
+		for _, value := range v {
+			if strings.HasSuffix(k, "-bin") {
+				value = base64.StdEncoding.EncodeToString([]byte(value))
+			}
+			h.Add(prefix+k, value)
+		}
+	}
+}
+
+// envelope prefixes a message with its flag and length
+func envelope(flag byte, payload []byte) []byte {
+	frame := make([]byte, 5, 5+len(payload))
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+// write sends a frame and flushes it, so the messages of a stream reach the browser one by one
+func (s *webStream) write(flag byte, payload []byte) error {
+	frame := envelope(flag, payload)
+	if s.text {
+		frame = []byte(base64.StdEncoding.EncodeToString(frame))
+	}
+	if _, err := s.gin.Writer.Write(frame); err != nil {
+		return err
+	}
+	s.gin.Writer.Flush()
+	return nil
+}
+
+// finish ends the call with its status, in the trailer frame or, without any message sent, in the
+// headers of a trailers only response
+func (s *webStream) finish(stat *status.Status) {
+	if stat == nil {
+		stat = status.New(codes.OK, "")
+	}
+	if !s.sent {
+		s.writeHeader(stat)
+		return
+	}
+	var trailer bytes.Buffer
+	fmt.Fprintf(&trailer, "grpc-status: %d\r\n", stat.Code())
+	if msg := stat.Message(); msg != "" {
+		fmt.Fprintf(&trailer, "grpc-message: %s\r\n", encodeGrpcMessage(msg))
+	}
+	h := http.Header{}
+	writeMetadata(h, "", s.trailer)
+	for k, v := range h {
+		for _, value := range v {
+			fmt.Fprintf(&trailer, "%s: %s\r\n", strings.ToLower(k), value)
+		}
+	}
+	s.write(trailerFlag, trailer.Bytes())
+}
+
+// encodeGrpcMessage percent encodes a status message like grpc does on the wire
+func encodeGrpcMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c >= ' ' && c <= '~' && c != '%' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/rpc"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const healthCheck = "/grpc.health.v1.Health/Check"
+
+func grpcWebGateway(t *testing.T, client *rpc.GrpcClient) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	app.Use(func(ctx *gin.Context) {
+		serveGrpcWeb(ctx, func(ss grpc.ServerStream) error {
+			return client.Proxy(ss, etcd.Method{Path: ctx.Request.URL.Path}, ctx.ClientIP(), nil)
+		})
+	})
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// readFrames splits a grpc-web response body into its frames
+func readFrames(t *testing.T, body []byte) (flags []byte, payloads [][]byte) {
+	for len(body) > 0 {
+		if len(body) < 5 {
+			t.Fatalf("truncated frame: %v", body)
+		}
+		size := binary.BigEndian.Uint32(body[1:5])
+		flags = append(flags, body[0])
+		payloads = append(payloads, body[5:5+size])
+		body = body[5+size:]
+	}
+	return flags, payloads
+}
+
+func postRaw(t *testing.T, url, contentType string, body []byte, headers ...string) (*http.Response, []byte) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+func TestGrpcWeb(t *testing.T) {
+	lis, hs, _ := startHealthServer(t)
+	var dialed int32
+	client, err := bufDialer(lis, &dialed)("health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	gateway := grpcWebGateway(t, client)
+	hs.SetServingStatus("user", healthpb.HealthCheckResponse_NOT_SERVING)
+	req, _ := proto.Marshal(&healthpb.HealthCheckRequest{Service: "user"})
+
+	resp, body := postRaw(t, gateway.URL+healthCheck, GrpcWeb+"+proto", envelope(dataFlag, req))
+	if resp.Header.Get("Content-Type") != GrpcWeb+"+proto" {
+		t.Fatalf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+	flags, payloads := readFrames(t, body)
+	if len(flags) != 2 || flags[0] != dataFlag || flags[1] != trailerFlag {
+		t.Fatalf("expected a message and the trailers, got flags %v", flags)
+	}
+	var out healthpb.HealthCheckResponse
+	if err = proto.Unmarshal(payloads[0], &out); err != nil || out.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("unexpected answer %v: %v", out.Status, err)
+	}
+	if !strings.Contains(string(payloads[1]), "grpc-status: 0\r\n") {
+		t.Fatalf("unexpected trailers %q", payloads[1])
+	}
+
+	// text mode encodes both ways with base64
+	text := base64.StdEncoding.EncodeToString(envelope(dataFlag, req))
+	_, body = postRaw(t, gateway.URL+healthCheck, GrpcWebText, []byte(text))
+	decoded, err := decodeText(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags, _ = readFrames(t, decoded); len(flags) != 2 {
+		t.Fatalf("expected a message and the trailers, got flags %v", flags)
+	}
+
+	// a failure before any message answers trailers only
+	req, _ = proto.Marshal(&healthpb.HealthCheckRequest{Service: "order"})
+	resp, body = postRaw(t, gateway.URL+healthCheck, GrpcWeb, envelope(dataFlag, req))
+	if resp.Header.Get("grpc-status") != "5" || resp.Header.Get("grpc-message") != "unknown service" || len(body) != 0 {
+		t.Fatalf("expected NotFound in the headers, got %v with body %q", resp.Header, body)
+	}
+
+	// streams end with the status of the backend in the trailer frame
+	req, _ = proto.Marshal(&healthpb.HealthCheckRequest{Service: "user"})
+	_, body = postRaw(t, gateway.URL+healthWatch, GrpcWeb, envelope(dataFlag, req), "grpc-timeout", "200m")
+	flags, payloads = readFrames(t, body)
+	if len(flags) != 2 || flags[0] != dataFlag || !strings.Contains(string(payloads[1]), "grpc-status: 4\r\n") {
+		t.Fatalf("expected a message and DeadlineExceeded, got flags %v", flags)
+	}
+
+	// malformed bodies never reach the backend
+	resp, _ = postRaw(t, gateway.URL+healthCheck, GrpcWeb, []byte{0, 0, 0})
+	if resp.Header.Get("grpc-status") != "3" {
+		t.Fatalf("expected InvalidArgument, got %v", resp.Header)
+	}
+
+	// nor do bodies over the limit
+	defer func(size int64) { conf.Conf.Gateway.MaxBodySize = size }(conf.Conf.Gateway.MaxBodySize)
+	conf.Conf.Gateway.MaxBodySize = 8
+	resp, _ = postRaw(t, gateway.URL+healthCheck, GrpcWeb, envelope(dataFlag, req))
+	if resp.Header.Get("grpc-status") != "8" {
+		t.Fatalf("expected ResourceExhausted, got %v", resp.Header)
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	chunks := base64.StdEncoding.EncodeToString([]byte("a")) + base64.StdEncoding.EncodeToString([]byte("bc")) +
+		"\r\n" + base64.StdEncoding.EncodeToString([]byte("def"))
+	got, err := decodeText([]byte(chunks))
+	if err != nil || string(got) != "abcdef" {
+		t.Fatalf("expected abcdef, got %q: %v", got, err)
+	}
+	if _, err = decodeText([]byte("a$==")); err == nil {
+		t.Fatal("expected malformed base64 to fail")
+	}
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/wuranxu/light/internal/auth"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const (
+	// HashByUser hashes by the id of the logged in user
+	HashByUser = "user"
+	// HashByHeader hashes by a request header, like header:X-Session-Id
+	HashByHeader = "header:"
+	// HashByField hashes by a field of the json body, nested fields are separated by dots
+	HashByField = "field:"
+)
+
+// hashKey the key the consistent hash of the method asks for, ok is false when the method does not
+// hash or the request lacks the key, such calls are balanced as usual
+func hashKey(ctx *gin.Context, method etcd.Method, userInfo *auth.UserInfo) (key string, ok bool, err error) {
+	switch spec := method.HashKey; {
+	case spec == "":
+		return "", false, nil
+	case spec == HashByUser:
+		// methods without authorization may still be called by a logged in user
+		if userInfo = optionalUser(ctx, userInfo); userInfo == nil {
+			return "", false, nil
+		}
+		return strconv.Itoa(userInfo.ID), true, nil
+	case strings.HasPrefix(spec, HashByHeader):
+		key = ctx.GetHeader(strings.TrimPrefix(spec, HashByHeader))
+		return key, key != "", nil
+	case strings.HasPrefix(spec, HashByField):
+		return bodyField(ctx, strings.TrimPrefix(spec, HashByField))
+	}
+	return "", false, fmt.Errorf("unknown hash key %q of %s", method.HashKey, method.Path)
+}
+
+// bodyField reads a field of the json body, the body stays readable for the call
+func bodyField(ctx *gin.Context, path string) (string, bool, error) {
+	// uploads are streamed to the backend, they are not read for a key
+	if ctx.Request.Body == nil || ctx.ContentType() == gin.MIMEMultipartPOSTForm {
+		return "", false, nil
+	}
+	body, err := ioutil.ReadAll(ctx.Request.Body)
+	if err != nil {
+		return "", false, err
+	}
+	ctx.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err = decoder.Decode(&value); err != nil {
+		// the call reports the malformed body
+		return "", false, nil
+	}
+	for _, name := range strings.Split(path, ".") {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false, nil
+		}
+		if value, ok = fields[name]; !ok {
+			return "", false, nil
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v, true, nil
+	case json.Number:
+		return v.String(), true, nil
+	case bool:
+		return strconv.FormatBool(v), true, nil
+	}
+	// objects, arrays and null make no key
+	return "", false, nil
+}
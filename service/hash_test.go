@@ -0,0 +1,51 @@
+package service
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/wuranxu/light/internal/auth"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHashKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	body := `{"session": {"id": 42, "name": "smoke"}, "plan": "nightly", "tags": ["a"]}`
+	cases := []struct {
+		spec string
+		user *auth.UserInfo
+		key  string
+		ok   bool
+	}{
+		{"", nil, "", false},
+		{HashByUser, &auth.UserInfo{ID: 7}, "7", true},
+		{HashByUser, nil, "", false},
+		{HashByHeader + "X-Session-Id", nil, "abc", true},
+		{HashByHeader + "X-Missing", nil, "", false},
+		{HashByField + "plan", nil, "nightly", true},
+		{HashByField + "session.id", nil, "42", true},
+		{HashByField + "session.missing", nil, "", false},
+		{HashByField + "tags", nil, "", false},
+	}
+	for _, c := range cases {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest("POST", "/v1/test/run", strings.NewReader(body))
+		ctx.Request.Header.Set("X-Session-Id", "abc")
+		key, ok, err := hashKey(ctx, etcd.Method{Path: "/test/run", HashKey: c.spec}, c.user)
+		if err != nil || key != c.key || ok != c.ok {
+			t.Fatalf("%s: expected %q %v, got %q %v %v", c.spec, c.key, c.ok, key, ok, err)
+		}
+		// the call still gets the whole body
+		if rest, _ := ioutil.ReadAll(ctx.Request.Body); string(rest) != body {
+			t.Fatalf("%s: expected the body to stay readable, got %q", c.spec, rest)
+		}
+	}
+
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest("POST", "/v1/test/run", nil)
+	if _, _, err := hashKey(ctx, etcd.Method{HashKey: "cookie:session"}, nil); err == nil {
+		t.Fatal("expected an unknown hash key to fail")
+	}
+}
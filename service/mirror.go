@@ -0,0 +1,109 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
+	"github.com/wuranxu/light/internal/auth"
+	"github.com/wuranxu/light/internal/balancer"
+	"github.com/wuranxu/light/internal/rpc"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"log"
+	"math/rand"
+)
+
+// maxMirrors shadow calls in flight at most, calls beyond are not mirrored so shadows never pile up
+const maxMirrors = 64
+
+var mirrors = make(chan struct{}, maxMirrors)
+
+// shadow a call to be replayed against the mirror of its route
+type shadow struct {
+	mirror   *etcd.Mirror
+	version  string
+	service  string
+	method   string
+	body     []byte
+	format   rpc.Format
+	ip       string
+	userInfo *auth.UserInfo
+}
+
+// mirrorOf returns the shadow of the call when its route is mirrored, the body is kept for the replay
+func mirrorOf(ctx *gin.Context, client *rpc.GrpcClient, addr etcd.Method, version, service, method string, userInfo *auth.UserInfo) *shadow {
+	mirror, err := client.SearchMirror(version, service, method)
+	if err != nil {
+		log.Printf("ignore mirror rule of %s.%s.%s, error: %s", version, service, method, err)
+		return nil
+	}
+	if mirror == nil || !mirror.Allows(addr) || (mirror.Percent > 0 && rand.Float64()*100 >= mirror.Percent) {
+		return nil
+	}
+	body, err := ioutil.ReadAll(ctx.Request.Body)
+	if err != nil {
+		return nil
+	}
+	ctx.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	s := &shadow{mirror: mirror, version: version, service: service, method: method, body: body, format: requestFormat(ctx), ip: ctx.RemoteIP(), userInfo: userInfo}
+	if mirror.Version != "" {
+		s.version = mirror.Version
+	}
+	if mirror.Service != "" {
+		s.service = mirror.Service
+	}
+	return s
+}
+
+// replay sends the shadow call in the background, its response is only compared with the primary one
+func (s *shadow) replay(primary proto.Message, primaryErr error) {
+	select {
+	case mirrors <- struct{}{}:
+	default:
+		log.Printf("mirror of %s.%s skipped, too many shadow calls in flight", s.service, s.method)
+		return
+	}
+	if primary != nil {
+		// the primary response is still being written to the client
+		primary = proto.Clone(primary)
+	}
+	go func() {
+		defer func() { <-mirrors }()
+		s.compare(primary, primaryErr)
+	}()
+}
+
+func (s *shadow) compare(primary proto.Message, primaryErr error) {
+	route := s.version + "." + s.service + "." + s.method
+	client, release, err := Clients.GetClient(s.service)
+	if err != nil {
+		log.Printf("mirror %s failed, error: %s", route, err)
+		return
+	}
+	defer release()
+	method, err := client.SearchCallAddr(s.version, s.service, s.method)
+	if err != nil {
+		log.Printf("mirror %s failed, error: %s", route, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(balancer.WithVersion(context.Background(), s.version), rpc.CallTimeout(method, 0))
+	defer cancel()
+	res, err := client.InvokeAs(ctx, method, ioutil.NopCloser(bytes.NewReader(s.body)), s.format, s.ip, s.userInfo)
+	if primaryErr != nil || err != nil {
+		if status.Code(primaryErr) != status.Code(err) {
+			log.Printf("mirror %s differs: primary error %v, shadow error %v", route, primaryErr, err)
+		}
+		return
+	}
+	diffs, err := rpc.Diff(primary, res)
+	if err != nil {
+		log.Printf("mirror %s can not be compared, error: %s", route, err)
+		return
+	}
+	if len(diffs) == 0 {
+		return
+	}
+	log.Printf("mirror %s differs in %d fields: %v", route, len(diffs), diffs)
+}
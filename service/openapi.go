@@ -0,0 +1,77 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/wuranxu/light/internal/openapi"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// OpenAPIPath where the OpenAPI document of the registered methods is served
+const OpenAPIPath = "/_light/openapi.json"
+
+// openapiDoc the json of the current document
+var openapiDoc atomic.Value
+
+func init() {
+	storeOpenAPI(nil)
+}
+
+// openapiInfo describes the document, its version lists the versions of the registered methods
+func openapiInfo(methods []described) openapi.Info {
+	seen := make(map[string]bool)
+	var versions []string
+	for _, m := range methods {
+		if !seen[m.reg.Version] {
+			seen[m.reg.Version] = true
+			versions = append(versions, m.reg.Version)
+		}
+	}
+	sort.Strings(versions)
+	version := strings.Join(versions, ", ")
+	if version == "" {
+		version = "none"
+	}
+	return openapi.Info{
+		Title:       "light gateway",
+		Description: "The methods registered in etcd, called as POST /version/service/method or by their REST routes.",
+		Version:     version,
+	}
+}
+
+// openapiDocument documents the methods
+func openapiDocument(methods []described) *openapi.Document {
+	builder := openapi.NewBuilder(openapiInfo(methods))
+	for _, m := range methods {
+		routes, err := methodRoutes(m)
+		if err != nil {
+			log.Printf("skip rest routes of %s in the openapi document, error: %s", m.reg.Key(), err)
+		}
+		builder.Add(openapi.Method{
+			Registration: m.reg,
+			Descriptor:   m.cache.Method(),
+			Download:     downloadOf(m.reg.Method, m.cache) != nil,
+			Routes:       routes,
+		})
+	}
+	return builder.Document()
+}
+
+// storeOpenAPI serves the document of the methods from now on
+func storeOpenAPI(methods []described) {
+	data, err := json.Marshal(openapiDocument(methods))
+	if err != nil {
+		log.Printf("encode openapi document failed, error: %s", err)
+		return
+	}
+	openapiDoc.Store(data)
+}
+
+// OpenAPI serves the OpenAPI document of the registered methods
+func OpenAPI(ctx *gin.Context) {
+	ctx.Data(http.StatusOK, "application/json;charset=utf8", openapiDoc.Load().([]byte))
+}
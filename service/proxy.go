@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/auth"
+	"github.com/wuranxu/light/internal/balancer"
+	"github.com/wuranxu/light/internal/rpc"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"github.com/wuranxu/light/middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"strings"
+	"time"
+)
+
+// VersionMetadata the metadata native grpc clients pick the version of a call with
+const VersionMetadata = "x-api-version"
+
+// NewProxyServer returns a grpc server passing every call through to its backend, messages are
+// never decoded. Without a certificate it speaks h2c.
+func NewProxyServer(cfg conf.ProxyConfig) (*grpc.Server, error) {
+	opts := []grpc.ServerOption{grpc.ForceServerCodec(rpc.RawCodec{}), grpc.UnknownServiceHandler(proxy)}
+	if cfg.CertFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	return grpc.NewServer(opts...), nil
+}
+
+// proxyStream a server stream with the context of the backend call
+type proxyStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *proxyStream) Context() context.Context {
+	return s.ctx
+}
+
+func firstOf(md metadata.MD, keys ...string) string {
+	for _, key := range keys {
+		if v := md.Get(key); len(v) > 0 && v[0] != "" {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// boundStream a stream that has to know the backend of its call before it starts, like to transcode
+// its messages with the descriptors of the method
+type boundStream interface {
+	bind(client *rpc.GrpcClient, method etcd.Method) error
+}
+
+func proxy(_ interface{}, ss grpc.ServerStream) error {
+	fullMethod, _ := grpc.MethodFromServerStream(ss)
+	return forward(ss, fullMethod, peerIP(ss.Context()))
+}
+
+// forward routes a native grpc call like Invoke routes a json call: the service is found in etcd, the
+// method registration decides about authorization and timeouts
+func forward(ss grpc.ServerStream, fullMethod, ip string) error {
+	split := strings.Split(fullMethod, "/")
+	if len(split) != 3 || split[0] != "" {
+		return status.Errorf(codes.Unimplemented, "malformed method %q", fullMethod)
+	}
+	service, method := split[1], split[2]
+	ctx := ss.Context()
+	md, _ := metadata.FromIncomingContext(ctx)
+	version := firstOf(md, VersionMetadata)
+	if version == "" {
+		version = conf.Conf.Proxy.DefaultVersion
+	}
+	client, release, err := Clients.GetClient(service)
+	if err != nil {
+		return status.Error(codes.Unavailable, NoAvailableServiceError.Error())
+	}
+	defer release()
+	addr, err := client.SearchCallAddr(version, etcd.LowerFirst(service), etcd.LowerFirst(method))
+	if err != nil {
+		return status.Error(codes.Unimplemented, err.Error())
+	}
+	var userInfo *auth.UserInfo
+	if addr.Authorization {
+		if userInfo, err = middleware.ParseToken(firstOf(md, "token", "authorization")); err != nil {
+			return status.Error(codes.Unauthenticated, err.Error())
+		}
+	}
+	if b, ok := ss.(boundStream); ok {
+		if err = b.bind(client, addr); err != nil {
+			return err
+		}
+	}
+	var requested time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		requested = time.Until(deadline)
+		ctx = balancer.WithClientDeadline(ctx)
+	}
+	ctx = balancer.WithVersion(ctx, version)
+	if timeout := rpc.StreamTimeout(addr, requested); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return client.Proxy(&proxyStream{ServerStream: ss, ctx: ctx}, addr, ip, userInfo)
+}
@@ -0,0 +1,323 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wuranxu/light/internal/rest"
+	"github.com/wuranxu/light/internal/rpc"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// registryDebounce waits for a burst of registrations to settle before what depends on them is rebuilt
+	registryDebounce = time.Second
+	// registryResync rebuilds now and then, descriptors may change without a registration
+	registryResync = time.Minute
+	// responseBodyKey the gin key of the field of the answer a route responds with
+	responseBodyKey = "light_response_body"
+	// boundKey the gin key telling the request was bound into a json body already
+	boundKey = "light_bound"
+	// probeCall a call of a method nobody registered, routes matching it would take the calls of any method
+	probeCall = "/light_probe/light_probe/light_probe"
+)
+
+// routes the current *rest.Table
+var routes atomic.Value
+
+func init() {
+	routes.Store(rest.NewTable())
+}
+
+// described a registered method with its descriptors
+type described struct {
+	reg   etcd.Registration
+	cache *rpc.MethodCache
+}
+
+// describeMethods fetches the descriptors of every registered method, methods whose descriptors can
+// not be fetched are left out. The clients are borrowed, background lookups keep no service alive.
+func describeMethods(cli *etcd.Client) ([]described, error) {
+	regs, err := cli.Methods()
+	if err != nil {
+		return nil, err
+	}
+	// one client per service, nil for the ones that could not be dialed
+	clients := make(map[string]*rpc.GrpcClient)
+	var releases []func()
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+	methods := make([]described, 0, len(regs))
+	for _, reg := range regs {
+		client, ok := clients[reg.Service]
+		if !ok {
+			var release func()
+			if client, release, err = Clients.Borrow(reg.Service); err != nil {
+				log.Printf("skip the methods of %s, error: %s", reg.Service, err)
+			} else {
+				releases = append(releases, release)
+			}
+			clients[reg.Service] = client
+		}
+		if client == nil {
+			continue
+		}
+		cache, err := client.Describe(reg.Method)
+		if err != nil {
+			log.Printf("skip %s, error: %s", reg.Key(), err)
+			continue
+		}
+		methods = append(methods, described{reg: reg, cache: cache})
+	}
+	return methods, nil
+}
+
+// methodRoutes the REST routes of the google.api.http options of a method
+func methodRoutes(m described) ([]*rest.Route, error) {
+	rules, err := rest.Rules(m.cache.Method())
+	if err != nil {
+		return nil, err
+	}
+	routes := make([]*rest.Route, 0, len(rules))
+	for _, rule := range rules {
+		route, err := rest.NewRoute(rule, m.reg)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// gatewayPath the path of a route of the gateway itself route matches, empty when there is none. REST
+// routes run before the routes of the gateway, a backend could take the calls of every service otherwise.
+func gatewayPath(route *rest.Route, methods []described) string {
+	if route.HTTPMethod != http.MethodGet && route.HTTPMethod != http.MethodPost {
+		return ""
+	}
+	paths := []string{probeCall}
+	if route.HTTPMethod == http.MethodGet {
+		paths = append(paths, OpenAPIPath)
+	}
+	for _, m := range methods {
+		// a method may bind the call of its own
+		if m.reg.Key() != route.Registration.Key() {
+			paths = append(paths, "/"+m.reg.Version+"/"+m.reg.Service+"/"+m.reg.Name)
+		}
+	}
+	for _, path := range paths {
+		if _, ok := route.Template.Match(path); ok {
+			return path
+		}
+	}
+	return ""
+}
+
+// routeTable collects the REST routes of the google.api.http options of the methods, routes of the
+// gateway are not given away
+func routeTable(methods []described) *rest.Table {
+	table := rest.NewTable()
+	for _, m := range methods {
+		routes, err := methodRoutes(m)
+		if err != nil {
+			log.Printf("skip rest routes of %s, error: %s", m.reg.Key(), err)
+			continue
+		}
+		for _, route := range routes {
+			if path := gatewayPath(route, methods); path != "" {
+				log.Printf("skip rest route %s %s of %s, it takes %s of the gateway", route.HTTPMethod, route.Template, m.reg.Key(), path)
+				continue
+			}
+			if err = table.Add(route); err != nil {
+				log.Printf("skip rest route of %s, error: %s", m.reg.Key(), err)
+			}
+		}
+	}
+	return table
+}
+
+// refresh rebuilds the REST routes and the OpenAPI document, the descriptors are fetched once for both
+func refresh(cli *etcd.Client) {
+	methods, err := describeMethods(cli)
+	if err != nil {
+		log.Printf("list registered methods failed, error: %s", err)
+		return
+	}
+	routes.Store(routeTable(methods))
+	storeOpenAPI(methods)
+}
+
+// WatchRegistry keeps the REST routes and the OpenAPI document up to date, it returns when ctx is done
+func WatchRegistry(ctx context.Context, cli *etcd.Client) {
+	changed := make(chan struct{}, 1)
+	onChange := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	go cli.WatchInstances(ctx, onChange)
+	go cli.WatchMethods(ctx, onChange)
+	refresh(cli)
+	ticker := time.NewTicker(registryResync)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-changed:
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(registryDebounce):
+			}
+		}
+		refresh(cli)
+	}
+}
+
+// RestHandler serves the REST routes of the google.api.http options. The request is bound into the
+// input message and called like /:version/:service/:method, other requests pass on.
+func RestHandler(ctx *gin.Context) {
+	route, values := routes.Load().(*rest.Table).Match(ctx.Request.Method, ctx.Request.URL.EscapedPath())
+	if route == nil {
+		ctx.Next()
+		return
+	}
+	ctx.Abort()
+	reg := route.Registration
+	client, release, err := Clients.GetClient(reg.Service)
+	if err != nil {
+		failed(ctx, http.StatusServiceUnavailable, &res{Code: NoAvailableService, Msg: NoAvailableServiceError.Error()})
+		return
+	}
+	defer release()
+	cache, err := client.Describe(reg.Method)
+	if err != nil {
+		remoteError(ctx, client, err, nil)
+		return
+	}
+	body, err := bindRoute(ctx, client, cache, route, values)
+	if err != nil {
+		failed(ctx, http.StatusBadRequest, &res{Code: ArgsParseFailed, Msg: err.Error()})
+		return
+	}
+	setJsonBody(ctx, body)
+	ctx.Set(boundKey, true)
+	ctx.Params = gin.Params{{Key: "version", Value: reg.Version}, {Key: "service", Value: reg.Service}, {Key: "method", Value: reg.Name}}
+	if route.ResponseBody != "" {
+		ctx.Set(responseBodyKey, route.ResponseBody)
+	}
+	Invoke(ctx)
+}
+
+// bindRoute builds the json request of a route: the body goes to the body field of the route, then
+// the path variables and, unless the body takes the whole message, the query parameters are bound
+func bindRoute(ctx *gin.Context, client *rpc.GrpcClient, cache *rpc.MethodCache, route *rest.Route, values map[string]string) ([]byte, error) {
+	msg, err := dynamic.AsDynamicMessage(cache.NewRequest())
+	if err != nil {
+		return nil, err
+	}
+	if route.Body != "" && ctx.Request.Body != nil {
+		data, err := ioutil.ReadAll(ctx.Request.Body)
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			if route.Body != "*" {
+				data = []byte(fmt.Sprintf("{%q: %s}", route.Body, data))
+			}
+			if err = client.Reflection().Unmarshal(data, msg); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for field, value := range values {
+		if err = rest.Bind(msg, field, value); err != nil {
+			return nil, err
+		}
+	}
+	if route.Body != "*" {
+		err = bindValues(msg, ctx.Request.URL.Query(), func(key string) bool {
+			_, ok := values[key]
+			return ok || route.Body != "" && (key == route.Body || strings.HasPrefix(key, route.Body+"."))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return marshalRequest(client, msg)
+}
+
+// getAllowed tells whether a method may be called by GET, only idempotent methods and the ones with
+// a get rule in their google.api.http options are
+func getAllowed(method etcd.Method, cache *rpc.MethodCache) bool {
+	if method.Idempotent {
+		return true
+	}
+	rules, err := rest.Rules(cache.Method())
+	if err != nil {
+		return false
+	}
+	for _, rule := range rules {
+		if rule.GetGet() != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// queryRequest builds the json request of a GET call from its query parameters
+func queryRequest(ctx *gin.Context, client *rpc.GrpcClient, cache *rpc.MethodCache) ([]byte, error) {
+	msg, err := dynamic.AsDynamicMessage(cache.NewRequest())
+	if err != nil {
+		return nil, err
+	}
+	if err = bindValues(msg, ctx.Request.URL.Query(), nil); err != nil {
+		return nil, err
+	}
+	return marshalRequest(client, msg)
+}
+
+// bindValues binds query or form values into msg by field path, keys skip tells are left out
+func bindValues(msg *dynamic.Message, values url.Values, skip func(key string) bool) error {
+	for key, v := range values {
+		if skip != nil && skip(key) {
+			continue
+		}
+		// parameters like cache busters are no fields
+		if err := rest.Bind(msg, key, v...); err != nil && !errors.Is(err, rest.ErrUnknownField) {
+			return err
+		}
+	}
+	return nil
+}
+
+func marshalRequest(client *rpc.GrpcClient, msg *dynamic.Message) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := client.Marshal(&buf, msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// setJsonBody replaces the request body by the json request bound from the url
+func setJsonBody(ctx *gin.Context, body []byte) {
+	ctx.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	ctx.Request.ContentLength = int64(len(body))
+	ctx.Request.Header.Set("Content-Type", gin.MIMEJSON)
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/wuranxu/light/internal/rest"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBindRoute(t *testing.T) {
+	lis, _, _ := startHealthServer(t)
+	var dialed int32
+	client, err := bufDialer(lis, &dialed)("health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	cache, err := client.Describe(etcd.Method{Path: healthCheck})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		template string
+		body     string
+		method   string
+		url      string
+		request  string
+		expected string
+	}{
+		// path variables win over the query, unknown parameters are ignored
+		{"/health/{service}", "", http.MethodGet, "/health/user?service=order&_=1", "", `{"service":"user"}`},
+		{"/health", "", http.MethodGet, "/health?service=order", "", `{"service":"order"}`},
+		{"/health", "*", http.MethodPost, "/health?service=order", `{"service": "user"}`, `{"service":"user"}`},
+		{"/health", "service", http.MethodPost, "/health", `"user"`, `{"service":"user"}`},
+	}
+	for _, c := range cases {
+		template, err := rest.Parse(c.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		route := &rest.Route{HTTPMethod: c.method, Template: template, Body: c.body}
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(c.method, c.url, strings.NewReader(c.request))
+		values, ok := template.Match(ctx.Request.URL.EscapedPath())
+		if !ok {
+			t.Fatalf("%s does not match %s", c.template, c.url)
+		}
+		body, err := bindRoute(ctx, client, cache, route, values)
+		if err != nil {
+			t.Fatalf("%s %s: %v", c.method, c.url, err)
+		}
+		if compact := strings.Join(strings.Fields(string(body)), ""); compact != c.expected {
+			t.Fatalf("%s %s: expected %s, got %s", c.method, c.url, c.expected, body)
+		}
+	}
+}
+
+func TestGetAllowed(t *testing.T) {
+	lis, _, _ := startHealthServer(t)
+	var dialed int32
+	client, err := bufDialer(lis, &dialed)("health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	cache, err := client.Describe(etcd.Method{Path: healthCheck})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getAllowed(etcd.Method{Path: healthCheck}, cache) {
+		t.Fatal("expected methods without a get rule to need POST")
+	}
+	if !getAllowed(etcd.Method{Path: healthCheck, Idempotent: true}, cache) {
+		t.Fatal("expected idempotent methods to allow GET")
+	}
+}
+
+func TestQueryRequest(t *testing.T) {
+	lis, _, _ := startHealthServer(t)
+	var dialed int32
+	client, err := bufDialer(lis, &dialed)("health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	cache, err := client.Describe(etcd.Method{Path: healthCheck})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"/v1/health/check":                         `{"service":""}`,
+		"/v1/health/check?service=user&_=16000000": `{"service":"user"}`,
+		"/v1/health/check?service=a&service=b":     `{"service":"b"}`,
+	}
+	for url, expected := range cases {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, url, nil)
+		body, err := queryRequest(ctx, client, cache)
+		if err != nil {
+			t.Fatalf("%s: %v", url, err)
+		}
+		if compact := strings.Join(strings.Fields(string(body)), ""); compact != expected {
+			t.Fatalf("%s: expected %s, got %s", url, expected, body)
+		}
+	}
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/v1/health/check?service.name=user", nil)
+	if _, err = queryRequest(ctx, client, cache); err == nil {
+		t.Fatal("expected a string to have no fields")
+	}
+}
+
+func TestGatewayPath(t *testing.T) {
+	login := etcd.Registration{Version: "v1", Service: "user", Name: "login"}
+	methods := []described{{reg: login}, {reg: etcd.Registration{Version: "v1", Service: "order", Name: "create"}}}
+	cases := []struct {
+		method   string
+		template string
+		expected string
+	}{
+		{http.MethodPost, "/{version}/{service}/{method}", probeCall},
+		{http.MethodGet, "/_light/openapi.json", OpenAPIPath},
+		{http.MethodPost, "/v1/order/create", "/v1/order/create"},
+		{http.MethodGet, "/v1/{service}/create", "/v1/order/create"},
+		// the call of the method itself, other http methods and paths of its own are left to it
+		{http.MethodPost, "/v1/user/login", ""},
+		{http.MethodDelete, "/v1/order/create", ""},
+		{http.MethodGet, "/v1/users/{id}", ""},
+	}
+	for _, c := range cases {
+		template, err := rest.Parse(c.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		route := &rest.Route{HTTPMethod: c.method, Template: template, Registration: login}
+		if path := gatewayPath(route, methods); path != c.expected {
+			t.Fatalf("%s %s: expected %q, got %q", c.method, c.template, c.expected, path)
+		}
+	}
+}
@@ -1,16 +1,22 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gorilla/websocket"
 	"github.com/wuranxu/light/internal/auth"
+	"github.com/wuranxu/light/internal/balancer"
 	"github.com/wuranxu/light/internal/rpc"
 	"github.com/wuranxu/light/middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 	"net/http"
+	"strconv"
 	"strings"
-	"sync"
+	"time"
 )
 
 const (
@@ -28,42 +34,20 @@ const (
 	IntervalServerError
 )
 
+// AttemptsHeader response header telling how many times the backend was called
+const AttemptsHeader = "X-Request-Attempts"
+
 var (
 	InnerError              = errors.New("系统内部错误")
 	SystemError             = errors.New("抱歉, 网络似乎开小差了")
 	NoAvailableServiceError = errors.New("服务未响应，请检查请求地址是否正确")
+	ClientStreamError       = errors.New("客户端流式方法只支持multipart/form-data上传, 其他调用请使用websocket")
+	GetNotAllowedError      = errors.New("只有幂等方法或声明了get路由的方法支持GET调用, 请使用POST")
 	Marshaler               = jsonpb.Marshaler{
 		EmitDefaults: false,
 	}
 )
 
-type GrpcCache struct {
-	lock  sync.RWMutex
-	cache map[string]*rpc.GrpcClient
-}
-
-//func (g *GrpcCache) GetClient(service string) (*rpc.GrpcClient, error) {
-//	g.lock.RLock()
-//	client, ok := g.cache[service]
-//	g.lock.RUnlock()
-//	if ok {
-//		return client, nil
-//	}
-//	client, err := rpc.NewGrpcClient(service)
-//	if err != nil {
-//		return nil, err
-//	}
-//	defer client.Close()
-//	//g.SetClient(service, client)
-//	return client, nil
-//}
-
-func (g *GrpcCache) SetClient(service string, client *rpc.GrpcClient) {
-	g.lock.Lock()
-	defer g.lock.Unlock()
-	g.cache[service] = client
-}
-
 type Response interface {
 	toJson() []byte
 }
@@ -146,6 +130,28 @@ func response(ctx *gin.Context, r interface{}) {
 	ctx.JSON(http.StatusOK, r)
 }
 
+// requestTimeout the timeout asked for by the client, grpc-timeout wins over X-Request-Timeout
+func requestTimeout(ctx *gin.Context) (time.Duration, error) {
+	if v := ctx.GetHeader("grpc-timeout"); v != "" {
+		return rpc.ParseGrpcTimeout(v)
+	}
+	if v := ctx.GetHeader("X-Request-Timeout"); v != "" {
+		return rpc.ParseRequestTimeout(v)
+	}
+	return 0, nil
+}
+
+// withTimeout bounds the request context by the timeout of a stream, 0 leaves it unbounded. Streams
+// only time out when the client asks for it.
+func withTimeout(ctx *gin.Context, timeout time.Duration) context.CancelFunc {
+	if timeout <= 0 {
+		return func() {}
+	}
+	c, cancel := context.WithTimeout(balancer.WithClientDeadline(ctx.Request.Context()), timeout)
+	ctx.Request = ctx.Request.WithContext(c)
+	return cancel
+}
+
 func fileNameList(ctx *gin.Context) []string {
 	fileList := ctx.Query("files")
 	if fileList == "" {
@@ -228,30 +234,129 @@ func Invoke(ctx *gin.Context) {
 	version := ctx.Param("version")
 	service := ctx.Param("service")
 	method := ctx.Param("method")
-	client, err := rpc.NewGrpcClient(service)
+	client, release, err := Clients.GetClient(service)
 	if err != nil {
-		response(ctx, &res{Code: NoAvailableService, Msg: NoAvailableServiceError.Error()})
+		failed(ctx, http.StatusServiceUnavailable, &res{Code: NoAvailableService, Msg: NoAvailableServiceError.Error()})
 		return
 	}
-	defer client.Close()
-	addr, err := client.SearchCallAddr(version, service, method)
+	defer release()
+	// the access log tells which backend served the request
+	reqCtx, served := balancer.WithServed(ctx.Request.Context())
+	ctx.Request = ctx.Request.WithContext(reqCtx)
+	defer func() {
+		ctx.Set(middleware.ZoneKey, served.Zone())
+		ctx.Set(middleware.UpstreamKey, served.Addr())
+	}()
+	target, addr, err := route(ctx, client, version, service, method)
 	if err != nil {
-		response(ctx, &res{Code: MethodNotFound, Msg: err.Error()})
+		failed(ctx, http.StatusNotFound, &res{Code: MethodNotFound, Msg: err.Error()})
 		return
 	}
+	if target != version {
+		ctx.Request = ctx.Request.WithContext(balancer.WithSplitVersion(ctx.Request.Context(), target))
+	} else {
+		ctx.Request = ctx.Request.WithContext(balancer.WithVersion(ctx.Request.Context(), version))
+	}
+	version = target
+	ctx.Writer = &versionWriter{ResponseWriter: ctx.Writer, served: served}
 	var userInfo *auth.UserInfo
 	if addr.Authorization {
 		// 需要解析token
 		if userInfo, err = middleware.GetUserInfo(ctx); err != nil {
-			response(ctx, &res{Code: LoginRequired, Msg: err.Error()})
+			failed(ctx, http.StatusUnauthorized, &res{Code: LoginRequired, Msg: err.Error()})
 			return
 		}
 	}
-	resp, err := client.InvokeWithReflect(addr, ctx.Request.Body, ctx.RemoteIP(), userInfo)
+	cache, err := client.Describe(addr)
 	if err != nil {
-		response(ctx, &res{Code: RemoteCallFailed, Msg: err.Error()})
+		remoteError(ctx, client, err, nil)
+		return
+	}
+	form, multipart := formType(ctx)
+	switch {
+	case ctx.Request.Method == http.MethodGet && !websocket.IsWebSocketUpgrade(ctx.Request) && !ctx.GetBool(boundKey):
+		// GET calls carry the request in the query string, links and images must not cause writes
+		if !getAllowed(addr, cache) {
+			ctx.Header("Allow", http.MethodPost)
+			failed(ctx, http.StatusMethodNotAllowed, &res{Code: MethodNotFound, Msg: GetNotAllowedError.Error()})
+			return
+		}
+		body, err := queryRequest(ctx, client, cache)
+		if err != nil {
+			failed(ctx, http.StatusBadRequest, &res{Code: ArgsParseFailed, Msg: err.Error()})
+			return
+		}
+		setJsonBody(ctx, body)
+	case form && !cache.Method().IsClientStreaming():
+		body, err := formRequest(ctx, client, cache)
+		if err != nil {
+			failed(ctx, uploadStatus(err), &res{Code: ArgsParseFailed, Msg: err.Error()})
+			return
+		}
+		setJsonBody(ctx, body)
+	}
+	key, hashed, err := hashKey(ctx, addr, userInfo)
+	if err != nil {
+		failed(ctx, http.StatusInternalServerError, &res{Code: IntervalServerError, Msg: err.Error()})
+		return
+	}
+	if hashed {
+		ctx.Request = ctx.Request.WithContext(balancer.WithHashKey(ctx.Request.Context(), key))
+	}
+	requested, err := requestTimeout(ctx)
+	if err != nil {
+		failed(ctx, http.StatusBadRequest, &res{Code: ArgsParseFailed, Msg: err.Error()})
+		return
+	}
+	download := downloadOf(addr, cache)
+	switch md := cache.Method(); {
+	case websocket.IsWebSocketUpgrade(ctx.Request):
+		defer withTimeout(ctx, rpc.StreamTimeout(addr, requested))()
+		websocketStream(ctx, client, addr, userInfo)
+		return
+	case md.IsClientStreaming() && !md.IsServerStreaming() && multipart:
+		defer withTimeout(ctx, rpc.StreamTimeout(addr, requested))()
+		uploadStream(ctx, client, addr, userInfo)
+		return
+	case md.IsClientStreaming():
+		failed(ctx, http.StatusBadRequest, &res{Code: MethodNotFound, Msg: ClientStreamError.Error()})
+		return
+	case md.IsServerStreaming() && download != nil:
+		defer withTimeout(ctx, rpc.StreamTimeout(addr, requested))()
+		downloadStream(ctx, client, addr, userInfo, download)
+		return
+	case md.IsServerStreaming():
+		defer withTimeout(ctx, rpc.StreamTimeout(addr, requested))()
+		serverStream(ctx, client, addr, userInfo)
+		return
+	}
+	// the backend call ends with the http request, a client going away cancels it
+	callCtx := ctx.Request.Context()
+	if requested > 0 {
+		callCtx = balancer.WithClientDeadline(callCtx)
+	}
+	callCtx, cancel := context.WithTimeout(callCtx, rpc.CallTimeout(addr, requested))
+	defer cancel()
+	var (
+		trailer  metadata.MD
+		attempts int
+	)
+	mirror := mirrorOf(ctx, client, addr, version, service, method, userInfo)
+	format := requestFormat(ctx)
+	resp, err := client.InvokeAs(callCtx, addr, ctx.Request.Body, format, ctx.RemoteIP(), userInfo, grpc.Trailer(&trailer), rpc.Attempts(&attempts))
+	if mirror != nil {
+		mirror.replay(resp, err)
+	}
+	if attempts > 0 {
+		ctx.Header(AttemptsHeader, strconv.Itoa(attempts))
+	}
+	if err != nil {
+		remoteError(ctx, client, err, trailer)
+		return
+	}
+	if download != nil {
+		writeDownload(ctx, download, resp)
 		return
 	}
-	ctx.Writer.Header().Set("Content-Type", "application/json;charset=utf8")
-	client.Marshal(ctx.Writer, resp)
+	writeMessage(ctx, client, resp, responseFormat(ctx))
 }
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/wuranxu/light/internal/auth"
+	"github.com/wuranxu/light/internal/balancer"
+	"github.com/wuranxu/light/internal/rpc"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"github.com/wuranxu/light/middleware"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// VersionHeader the response header telling which version served the call
+const VersionHeader = "X-Served-Version"
+
+// versionWriter tells the version of the backend that served the call in VersionHeader, it is only
+// known once a backend was picked and set when the response starts
+type versionWriter struct {
+	gin.ResponseWriter
+	served *balancer.Served
+}
+
+func (w *versionWriter) setVersion() {
+	if w.Written() {
+		return
+	}
+	if version := w.served.Version(); version != "" {
+		w.Header().Set(VersionHeader, version)
+	}
+}
+
+func (w *versionWriter) WriteHeader(code int) {
+	w.setVersion()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *versionWriter) WriteHeaderNow() {
+	w.setVersion()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *versionWriter) Write(data []byte) (int, error) {
+	w.setVersion()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *versionWriter) WriteString(s string) (int, error) {
+	w.setVersion()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *versionWriter) Flush() {
+	w.setVersion()
+	w.ResponseWriter.Flush()
+}
+
+// optionalUser the logged in user of routes that do not require one, nil for anonymous calls
+func optionalUser(ctx *gin.Context, userInfo *auth.UserInfo) *auth.UserInfo {
+	if userInfo != nil {
+		return userInfo
+	}
+	userInfo, err := middleware.GetUserInfo(ctx)
+	if err != nil {
+		return nil
+	}
+	return userInfo
+}
+
+// bucket places a sticky key of a route in one of 10000 buckets
+func bucket(sticky, route string) float64 {
+	h := fnv.New32a()
+	h.Write([]byte(route + "|" + sticky))
+	return float64(h.Sum32() % 10000)
+}
+
+// splitVersion the version a split of rule claims the call for, empty when no split does. Allowlists
+// come first, then the percentages add up in order. Users keep their side of a split, anonymous
+// callers are told apart by their ip.
+func splitVersion(rule *etcd.SplitRule, route string, user *auth.UserInfo, header http.Header, ip string) string {
+	for _, split := range rule.Splits {
+		if user != nil {
+			for _, id := range split.Users {
+				if id == user.ID {
+					return split.Version
+				}
+			}
+		}
+		for name, value := range split.Headers {
+			if header.Get(name) == value {
+				return split.Version
+			}
+		}
+	}
+	sticky := "ip:" + ip
+	if user != nil {
+		sticky = "user:" + strconv.Itoa(user.ID)
+	}
+	b, sum := bucket(sticky, route), 0.0
+	for _, split := range rule.Splits {
+		sum += split.Percent * 100
+		if b < sum {
+			return split.Version
+		}
+	}
+	return ""
+}
+
+// route looks up the method of the url, or of the version a split rule sends the call to. Broken rules
+// and versions missing the method leave the call on the version of the url, the call fails when no
+// instance serves the version it was split to.
+func route(ctx *gin.Context, client *rpc.GrpcClient, version, service, method string) (string, etcd.Method, error) {
+	addr, err := client.SearchCallAddr(version, service, method)
+	if err != nil {
+		return version, addr, err
+	}
+	rule, err := client.SearchSplit(version, service, method)
+	if err != nil {
+		log.Printf("ignore split rule of %s.%s.%s, error: %s", version, service, method, err)
+		return version, addr, nil
+	}
+	if rule == nil {
+		return version, addr, nil
+	}
+	target := splitVersion(rule, version+"."+service+"."+method, optionalUser(ctx, nil), ctx.Request.Header, ctx.ClientIP())
+	if target == "" || target == version {
+		return version, addr, nil
+	}
+	split, err := client.SearchCallAddr(target, service, method)
+	if err != nil {
+		log.Printf("split %s.%s.%s to %s failed, error: %s", version, service, method, target, err)
+		return version, addr, nil
+	}
+	return target, split, nil
+}
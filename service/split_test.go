@@ -0,0 +1,48 @@
+package service
+
+import (
+	"fmt"
+	"github.com/wuranxu/light/internal/auth"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"net/http"
+	"testing"
+)
+
+func TestSplitVersion(t *testing.T) {
+	rule := &etcd.SplitRule{Splits: []etcd.Split{
+		{Version: "v2", Percent: 10, Users: []int{42}, Headers: map[string]string{"X-Canary": "always"}},
+		{Version: "v3", Percent: 5},
+	}}
+	route := "v1.user.login"
+	if v := splitVersion(rule, route, &auth.UserInfo{ID: 42}, http.Header{}, "10.0.0.1"); v != "v2" {
+		t.Fatalf("expected the allowlisted user on v2, got %q", v)
+	}
+	header := http.Header{}
+	header.Set("X-Canary", "always")
+	if v := splitVersion(rule, route, nil, header, "10.0.0.1"); v != "v2" {
+		t.Fatalf("expected the canary header on v2, got %q", v)
+	}
+
+	served := make(map[string]int)
+	for id := 0; id < 10000; id++ {
+		user := &auth.UserInfo{ID: id + 1000}
+		v := splitVersion(rule, route, user, http.Header{}, "10.0.0.1")
+		for i := 0; i < 3; i++ {
+			if again := splitVersion(rule, route, user, http.Header{}, fmt.Sprintf("10.0.1.%d", i)); again != v {
+				t.Fatalf("expected user %d to stick to %q, got %q", user.ID, v, again)
+			}
+		}
+		served[v]++
+	}
+	if served["v2"] < 800 || served["v2"] > 1200 || served["v3"] < 350 || served["v3"] > 650 {
+		t.Fatalf("expected about 10%% on v2 and 5%% on v3, got %v", served)
+	}
+
+	anonymous := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		anonymous[splitVersion(rule, route, nil, http.Header{}, fmt.Sprintf("10.%d.%d.1", i/256, i%256))]++
+	}
+	if anonymous[""] < 700 || anonymous["v2"] == 0 {
+		t.Fatalf("expected anonymous callers to be split by ip, got %v", anonymous)
+	}
+}
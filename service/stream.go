@@ -0,0 +1,148 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
+	"github.com/wuranxu/light/internal/auth"
+	"github.com/wuranxu/light/internal/balancer"
+	"github.com/wuranxu/light/internal/errors"
+	"github.com/wuranxu/light/internal/rpc"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"net/http"
+	"strings"
+)
+
+const (
+	EventStream = "text/event-stream"
+	NdJson      = "application/x-ndjson"
+)
+
+// streamWriter writes every message of a server stream as soon as it arrives
+type streamWriter interface {
+	ContentType() string
+	Message(data []byte) error
+	Error(data []byte) error
+}
+
+type sseWriter struct {
+	w gin.ResponseWriter
+}
+
+func (s *sseWriter) ContentType() string {
+	return EventStream
+}
+
+func (s *sseWriter) event(name string, data []byte) error {
+	var buf bytes.Buffer
+	buf.WriteString("event: " + name + "\n")
+	buf.WriteString("data: ")
+	buf.Write(data)
+	buf.WriteString("\n\n")
+	if _, err := s.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	s.w.Flush()
+	return nil
+}
+
+func (s *sseWriter) Message(data []byte) error {
+	return s.event("message", data)
+}
+
+func (s *sseWriter) Error(data []byte) error {
+	return s.event("error", data)
+}
+
+type ndJsonWriter struct {
+	w gin.ResponseWriter
+}
+
+func (n *ndJsonWriter) ContentType() string {
+	return NdJson
+}
+
+func (n *ndJsonWriter) Message(data []byte) error {
+	if _, err := n.w.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	n.w.Flush()
+	return nil
+}
+
+func (n *ndJsonWriter) Error(data []byte) error {
+	return n.Message(data)
+}
+
+// newStreamWriter picks the stream format from the Accept header, ndjson is the default
+func newStreamWriter(ctx *gin.Context) streamWriter {
+	if strings.Contains(ctx.GetHeader("Accept"), EventStream) {
+		return &sseWriter{w: ctx.Writer}
+	}
+	return &ndJsonWriter{w: ctx.Writer}
+}
+
+// compactMessage marshals msg into a single line of json
+func compactMessage(client *rpc.GrpcClient, msg proto.Message) ([]byte, error) {
+	var buf, out bytes.Buffer
+	if err := client.Marshal(&buf, msg); err != nil {
+		return nil, err
+	}
+	if err := json.Compact(&out, buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// serverStream relays a server streaming method, errors of the stream are sent as the final event.
+// Headers are only written once the backend answers, so a request failing to decode gets a plain json response.
+func serverStream(ctx *gin.Context, client *rpc.GrpcClient, method etcd.Method, userInfo *auth.UserInfo) {
+	writer := newStreamWriter(ctx)
+	started := false
+	start := func() {
+		if started {
+			return
+		}
+		started = true
+		header := ctx.Writer.Header()
+		header.Set("Content-Type", writer.ContentType()+";charset=utf8")
+		header.Set("Cache-Control", "no-cache")
+		header.Set("X-Accel-Buffering", "no")
+		ctx.Status(http.StatusOK)
+	}
+	var trailer metadata.MD
+	err := client.InvokeServerStream(ctx.Request.Context(), method, ctx.Request.Body, ctx.RemoteIP(), userInfo, func(msg proto.Message) error {
+		data, err := compactMessage(client, msg)
+		if err != nil {
+			return err
+		}
+		start()
+		return writer.Message(data)
+	}, grpc.Trailer(&trailer))
+	if err == nil {
+		// an empty stream still gets a well formed response
+		start()
+		ctx.Writer.Flush()
+		return
+	}
+	if ctx.Request.Context().Err() == context.Canceled {
+		// nobody is listening anymore
+		return
+	}
+	if !started && balancer.Rejected(err) {
+		failed(ctx, http.StatusServiceUnavailable, &res{Code: NoAvailableService, Msg: err.Error()})
+		return
+	}
+	stat, fromServer := errors.FromError(err)
+	if !started && !fromServer {
+		failed(ctx, http.StatusBadRequest, &res{Code: ArgsParseFailed, Msg: err.Error()})
+		return
+	}
+	start()
+	data, _ := json.Marshal(&res{Code: RemoteCallFailed, Msg: stat.Message(), Data: newStatusData(client, stat, trailer)})
+	writer.Error(data)
+}
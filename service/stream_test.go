@@ -0,0 +1,133 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/wuranxu/light/internal/rpc"
+	"github.com/wuranxu/light/internal/service/etcd"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const healthWatch = "/grpc.health.v1.Health/Watch"
+
+func streamGateway(t *testing.T, client *rpc.GrpcClient) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	app.POST("/stream", func(ctx *gin.Context) {
+		serverStream(ctx, client, etcd.Method{Path: healthWatch}, nil)
+	})
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func postStream(t *testing.T, url, accept, body string) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", accept)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func readEvent(t *testing.T, r *bufio.Reader) (string, string) {
+	t.Helper()
+	var event, data string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			return event, data
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestServerStream_SSE(t *testing.T) {
+	lis, hs, srv := startHealthServer(t)
+	var dialed int32
+	client, err := bufDialer(lis, &dialed)("health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	gateway := streamGateway(t, client)
+
+	resp := postStream(t, gateway.URL+"/stream", EventStream, `{"service": ""}`)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), EventStream) {
+		t.Fatalf("unexpected content type: %s", resp.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(resp.Body)
+	event, data := readEvent(t, reader)
+	if event != "message" || !strings.Contains(data, "SERVING") {
+		t.Fatalf("unexpected first event %s: %s", event, data)
+	}
+
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	event, data = readEvent(t, reader)
+	if event != "message" || !strings.Contains(data, "NOT_SERVING") {
+		t.Fatalf("unexpected second event %s: %s", event, data)
+	}
+
+	// the stream ends with an error status, it is reported as the final event
+	srv.Stop()
+	event, data = readEvent(t, reader)
+	if event != "error" {
+		t.Fatalf("expected error event, got %s: %s", event, data)
+	}
+	var r res
+	if err := json.Unmarshal([]byte(data), &r); err != nil || r.Code != RemoteCallFailed {
+		t.Fatalf("unexpected error event: %s", data)
+	}
+}
+
+func TestServerStream_NDJSON(t *testing.T) {
+	lis, _, _ := startHealthServer(t)
+	var dialed int32
+	client, err := bufDialer(lis, &dialed)("health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	gateway := streamGateway(t, client)
+
+	resp := postStream(t, gateway.URL+"/stream", NdJson, `{"service": ""}`)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), NdJson) {
+		t.Fatalf("unexpected content type: %s", resp.Header.Get("Content-Type"))
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &msg); err != nil {
+		t.Fatalf("expected a json line, got %q", line)
+	}
+	if msg["status"] != "SERVING" {
+		t.Fatalf("unexpected message: %v", msg)
+	}
+
+	// a body that does not decode never opens the stream
+	resp = postStream(t, gateway.URL+"/stream", NdJson, `{"service": `)
+	var r res
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil || r.Code != ArgsParseFailed {
+		t.Fatalf("expected ArgsParseFailed, got %+v, %v", r, err)
+	}
+}
@@ -0,0 +1,236 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/auth"
+	"github.com/wuranxu/light/internal/rest"
+	"github.com/wuranxu/light/internal/rpc"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+const (
+	defaultMaxRequestSize = 32 << 20
+	defaultMaxFileSize    = 10 << 20
+	defaultMaxStreamSize  = 1 << 30
+	defaultChunkSize      = 64 << 10
+)
+
+// errTooLarge a form or a file exceeds the upload limits
+var errTooLarge = errors.New("request entity too large")
+
+// uploadConfig the upload limits with defaults for the zero fields
+func uploadConfig() conf.UploadConfig {
+	cfg := conf.Conf.Upload
+	if cfg.MaxRequestSize <= 0 {
+		cfg.MaxRequestSize = defaultMaxRequestSize
+	}
+	if cfg.MaxFileSize <= 0 {
+		cfg.MaxFileSize = defaultMaxFileSize
+	}
+	if cfg.MaxStreamSize <= 0 {
+		cfg.MaxStreamSize = defaultMaxStreamSize
+	}
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = defaultChunkSize
+	}
+	return cfg
+}
+
+// formType tells whether the body is a form and whether it is a multipart one that may carry files
+func formType(ctx *gin.Context) (form bool, multipart bool) {
+	switch ctx.ContentType() {
+	case gin.MIMEPOSTForm:
+		return true, false
+	case gin.MIMEMultipartPOSTForm:
+		return true, true
+	}
+	return false, false
+}
+
+// uploadStatus the http status of a failed upload
+func uploadStatus(err error) int {
+	if errors.Is(err, errTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// limitedReader reads up to n bytes, reading more fails with errTooLarge and marks it exceeded
+type limitedReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		n, l.n, l.exceeded = int(l.n), 0, true
+		return n, errTooLarge
+	}
+	l.n -= int64(n)
+	return n, err
+}
+
+// formRequest builds the json request of a unary call from a form. Values are bound like query
+// parameters, files go to the bytes or file message field named like their form field.
+func formRequest(ctx *gin.Context, client *rpc.GrpcClient, cache *rpc.MethodCache) ([]byte, error) {
+	cfg := uploadConfig()
+	body := &limitedReader{r: ctx.Request.Body, n: cfg.MaxRequestSize}
+	ctx.Request.Body = ioutil.NopCloser(body)
+	var err error
+	if _, multipart := formType(ctx); multipart {
+		err = ctx.Request.ParseMultipartForm(cfg.MaxRequestSize)
+	} else {
+		err = ctx.Request.ParseForm()
+	}
+	if body.exceeded {
+		return nil, fmt.Errorf("%w: the form is larger than %d bytes", errTooLarge, cfg.MaxRequestSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	msg, err := dynamic.AsDynamicMessage(cache.NewRequest())
+	if err != nil {
+		return nil, err
+	}
+	if err = bindValues(msg, ctx.Request.PostForm, nil); err != nil {
+		return nil, err
+	}
+	if ctx.Request.MultipartForm != nil {
+		for name, files := range ctx.Request.MultipartForm.File {
+			for _, fh := range files {
+				if err = bindFile(msg, name, fh, cfg.MaxFileSize); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return marshalRequest(client, msg)
+}
+
+// bindFile binds an uploaded file, unlike values files of unknown fields are refused
+func bindFile(msg *dynamic.Message, name string, fh *multipart.FileHeader, limit int64) error {
+	if fh.Size > limit {
+		return fmt.Errorf("%w: %s is larger than %d bytes", errTooLarge, fh.Filename, limit)
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	return rest.BindFile(msg, name, rest.File{Name: fh.Filename, ContentType: fh.Header.Get("Content-Type"), Size: fh.Size, Content: content})
+}
+
+// uploadStream streams a multipart form to a client streaming method and writes its answer like the
+// one of a unary call. Every chunk of a file is sent in a message of its own, the form values go with
+// the next message sent.
+func uploadStream(ctx *gin.Context, client *rpc.GrpcClient, method etcd.Method, userInfo *auth.UserInfo) {
+	cfg := uploadConfig()
+	body := &limitedReader{r: ctx.Request.Body, n: cfg.MaxStreamSize}
+	ctx.Request.Body = ioutil.NopCloser(body)
+	reader, err := ctx.Request.MultipartReader()
+	if err != nil {
+		failed(ctx, http.StatusBadRequest, &res{Code: ArgsParseFailed, Msg: err.Error()})
+		return
+	}
+	stream, err := client.NewStream(ctx.Request.Context(), method, ctx.RemoteIP(), userInfo)
+	if err != nil {
+		remoteError(ctx, client, err, nil)
+		return
+	}
+	defer stream.Close()
+	// io.EOF tells the backend ended the stream early, the answer says why
+	if err = sendParts(stream, reader, cfg.ChunkSize); err != nil && err != io.EOF {
+		if body.exceeded {
+			err = fmt.Errorf("%w: the form is larger than %d bytes", errTooLarge, cfg.MaxStreamSize)
+		}
+		failed(ctx, uploadStatus(err), &res{Code: ArgsParseFailed, Msg: err.Error()})
+		return
+	}
+	stream.CloseSend()
+	resp, err := stream.Recv()
+	if err != nil {
+		remoteError(ctx, client, err, stream.Trailer())
+		return
+	}
+	writeMessage(ctx, client, resp, responseFormat(ctx))
+}
+
+// sendParts sends the parts of a form in the order they arrive, an empty file is sent as one empty chunk
+func sendParts(stream *rpc.Stream, reader *multipart.Reader, chunkSize int) error {
+	values := url.Values{}
+	next := func() (*dynamic.Message, error) {
+		msg, err := dynamic.AsDynamicMessage(stream.Method().NewRequest())
+		if err != nil {
+			return nil, err
+		}
+		err = bindValues(msg, values, nil)
+		values = url.Values{}
+		return msg, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if part.FileName() == "" {
+			value, err := ioutil.ReadAll(part)
+			if err != nil {
+				return err
+			}
+			values.Add(part.FormName(), string(value))
+			continue
+		}
+		for first := true; ; first = false {
+			chunk := make([]byte, chunkSize)
+			n, err := io.ReadFull(part, chunk)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			if n > 0 || first {
+				msg, err := next()
+				if err != nil {
+					return err
+				}
+				file := rest.File{Name: part.FileName(), ContentType: part.Header.Get("Content-Type"), Content: chunk[:n]}
+				if err = rest.BindFile(msg, part.FormName(), file); err != nil {
+					return err
+				}
+				if err = stream.SendMessage(msg); err != nil {
+					return err
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	msg, err := next()
+	if err != nil {
+		return err
+	}
+	return stream.SendMessage(msg)
+}
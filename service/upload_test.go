@@ -0,0 +1,247 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/rpc"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	importerProto = `syntax = "proto3";
+package importer;
+
+message File {
+  string filename = 1;
+  string content_type = 2;
+  int64 size = 3;
+  bytes content = 4;
+}
+
+message ImportRequest {
+  string project = 1;
+  repeated string tags = 2;
+  repeated File files = 3;
+  bytes raw = 4;
+}
+
+message ImportReply {
+  string project = 1;
+  repeated string names = 2;
+  int64 bytes = 3;
+  int32 messages = 4;
+}
+
+service Importer {
+  rpc Import(ImportRequest) returns (ImportReply);
+  rpc ImportStream(stream ImportRequest) returns (ImportReply);
+}
+`
+	importCall   = "/importer.Importer/Import"
+	importStream = "/importer.Importer/ImportStream"
+)
+
+// startImporter serves the importer service with dynamic messages, the reply sums up what arrived
+func startImporter(t *testing.T) *rpc.GrpcClient {
+	parser := protoparse.Parser{Accessor: protoparse.FileContentsFromMap(map[string]string{"importer.proto": importerProto})}
+	fds, err := parser.ParseFiles("importer.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd := fds[0].FindService("importer.Importer")
+	lis := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer(grpc.UnknownServiceHandler(func(_ interface{}, ss grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(ss)
+		md := sd.FindMethodByName(method[strings.LastIndex(method, "/")+1:])
+		reply := dynamic.NewMessage(md.GetOutputType())
+		var size int64
+		var messages int32
+		for {
+			req := dynamic.NewMessage(md.GetInputType())
+			if err := ss.RecvMsg(req); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			messages++
+			if project := req.GetFieldByName("project").(string); project != "" {
+				reply.SetFieldByName("project", project)
+			}
+			size += int64(len(req.GetFieldByName("raw").([]byte)))
+			for _, f := range req.GetFieldByName("files").([]interface{}) {
+				file := f.(*dynamic.Message)
+				reply.AddRepeatedFieldByName("names", file.GetFieldByName("filename"))
+				size += int64(len(file.GetFieldByName("content").([]byte)))
+			}
+			if !md.IsClientStreaming() {
+				break
+			}
+		}
+		reply.SetFieldByName("bytes", size)
+		reply.SetFieldByName("messages", messages)
+		return ss.SendMsg(reply)
+	}))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.NewClient(conn, nil)
+	t.Cleanup(func() { client.Close() })
+	src, err := rpc.DescriptorSourceFromFileDescriptors(fds...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Reflection().SetFileSource(conf.SourceFile, src)
+	return client
+}
+
+// uploadGateway serves unary imports through formRequest and streamed ones through uploadStream
+func uploadGateway(t *testing.T, client *rpc.GrpcClient) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	app.POST("/import", func(ctx *gin.Context) {
+		method := etcd.Method{Path: importCall}
+		cache, err := client.Describe(method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := formRequest(ctx, client, cache)
+		if err != nil {
+			failed(ctx, uploadStatus(err), &res{Code: ArgsParseFailed, Msg: err.Error()})
+			return
+		}
+		resp, err := client.InvokeWithReflect(ctx, method, ioutil.NopCloser(bytes.NewReader(body)), ctx.RemoteIP(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeMessage(ctx, client, resp, rpc.JsonFormat)
+	})
+	app.POST("/stream", func(ctx *gin.Context) {
+		uploadStream(ctx, client, etcd.Method{Path: importStream}, nil)
+	})
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+type part struct {
+	name, filename, content string
+}
+
+func multipartBody(t *testing.T, parts ...part) (string, []byte) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		var err error
+		var pw io.Writer
+		if p.filename == "" {
+			pw, err = w.CreateFormField(p.name)
+		} else {
+			pw, err = w.CreateFormFile(p.name, p.filename)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(pw, p.content)
+	}
+	w.Close()
+	return w.FormDataContentType(), buf.Bytes()
+}
+
+type importReply struct {
+	Project  string   `json:"project"`
+	Names    []string `json:"names"`
+	Bytes    string   `json:"bytes"`
+	Messages int      `json:"messages"`
+}
+
+func postImport(t *testing.T, url, contentType string, body []byte) (int, importReply) {
+	resp, data := postRaw(t, url, contentType, body)
+	var reply importReply
+	if resp.StatusCode == http.StatusOK {
+		if err := json.Unmarshal(data, &reply); err != nil {
+			t.Fatalf("unexpected answer %s: %v", data, err)
+		}
+	}
+	return resp.StatusCode, reply
+}
+
+func TestFormRequest(t *testing.T) {
+	gateway := uploadGateway(t, startImporter(t))
+	defer func(cfg conf.UploadConfig) { conf.Conf.Upload = cfg }(conf.Conf.Upload)
+	conf.Conf.Upload = conf.UploadConfig{MaxRequestSize: 4096, MaxFileSize: 1024}
+
+	status, reply := postImport(t, gateway.URL+"/import", gin.MIMEPOSTForm, []byte("project=light&unknown=1"))
+	if status != http.StatusOK || reply.Project != "light" {
+		t.Fatalf("unexpected answer %d %+v", status, reply)
+	}
+
+	contentType, body := multipartBody(t,
+		part{name: "project", content: "light"},
+		part{name: "files", filename: "a.json", content: "{}"},
+		part{name: "files", filename: "b.json", content: "[1]"},
+		part{name: "raw", filename: "raw.bin", content: "12345"},
+	)
+	status, reply = postImport(t, gateway.URL+"/import", contentType, body)
+	if status != http.StatusOK || reply.Project != "light" || strings.Join(reply.Names, ",") != "a.json,b.json" || reply.Bytes != "10" {
+		t.Fatalf("unexpected answer %d %+v", status, reply)
+	}
+
+	cases := []struct {
+		parts  []part
+		status int
+	}{
+		{[]part{{name: "files", filename: "big.json", content: strings.Repeat("x", 2048)}}, http.StatusRequestEntityTooLarge},
+		{[]part{{name: "a", content: strings.Repeat("x", 8192)}}, http.StatusRequestEntityTooLarge},
+		{[]part{{name: "project", filename: "a.json", content: "{}"}}, http.StatusBadRequest},
+		{[]part{{name: "attachments", filename: "a.json", content: "{}"}}, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		contentType, body = multipartBody(t, c.parts...)
+		if status, _ = postImport(t, gateway.URL+"/import", contentType, body); status != c.status {
+			t.Fatalf("%s: expected %d, got %d", c.parts[0].name, c.status, status)
+		}
+	}
+}
+
+func TestUploadStream(t *testing.T) {
+	gateway := uploadGateway(t, startImporter(t))
+	defer func(cfg conf.UploadConfig) { conf.Conf.Upload = cfg }(conf.Conf.Upload)
+	conf.Conf.Upload = conf.UploadConfig{ChunkSize: 4, MaxStreamSize: 1024}
+
+	contentType, body := multipartBody(t,
+		part{name: "project", content: "light"},
+		part{name: "files", filename: "a.json", content: "0123456789"},
+		part{name: "files", filename: "empty.json"},
+	)
+	status, reply := postImport(t, gateway.URL+"/stream", contentType, body)
+	// a.json takes three chunks, the empty file one
+	if status != http.StatusOK || reply.Project != "light" || reply.Messages != 4 || reply.Bytes != "10" ||
+		strings.Join(reply.Names, ",") != "a.json,a.json,a.json,empty.json" {
+		t.Fatalf("unexpected answer %d %+v", status, reply)
+	}
+
+	contentType, body = multipartBody(t, part{name: "files", filename: "big.json", content: strings.Repeat("x", 2048)})
+	if status, _ = postImport(t, gateway.URL+"/stream", contentType, body); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected %d, got %d", http.StatusRequestEntityTooLarge, status)
+	}
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/auth"
+	"github.com/wuranxu/light/internal/errors"
+	"github.com/wuranxu/light/internal/rpc"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"google.golang.org/grpc/metadata"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// CloseSendFrame text frame a websocket client sends to half-close the request stream
+	CloseSendFrame = "EOF"
+	wsReadLimit    = 4 << 20
+	wsWriteWait    = 10 * time.Second
+)
+
+var upgrader = websocket.Upgrader{CheckOrigin: checkOrigin}
+
+// checkOrigin lets pages of the gateway host and of the allowed origins open websockets, browsers let
+// any page open one. Clients sending no origin are no browsers.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range conf.Conf.Gateway.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// websocketStream relays any kind of stream over a websocket. Every inbound text frame is a json
+// request, the frame "EOF" half-closes the request stream. Every response is sent as a text frame,
+// the final status goes into the close frame, an error status is sent as a json frame before it.
+func websocketStream(ctx *gin.Context, client *rpc.GrpcClient, method etcd.Method, userInfo *auth.UserInfo) {
+	conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		// the upgrader has already replied with an http error
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(wsReadLimit)
+
+	stream, err := client.NewStream(ctx.Request.Context(), method, ctx.RemoteIP(), userInfo)
+	if err != nil {
+		closeWebsocket(conn, client, err, nil)
+		return
+	}
+	defer stream.Close()
+
+	// a request that fails to decode aborts the stream, it is reported instead of the cancellation
+	decodeErr := make(chan error, 1)
+	go func() {
+		halfClosed := false
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				// the client went away, nobody is left to read the responses
+				stream.Close()
+				return
+			}
+			if halfClosed {
+				continue
+			}
+			if string(data) == CloseSendFrame {
+				halfClosed = true
+				stream.CloseSend()
+				continue
+			}
+			if err = stream.Send(data); err == io.EOF {
+				// the backend ended the stream, Recv reports why
+				halfClosed = true
+			} else if err != nil {
+				decodeErr <- err
+				stream.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			closeWebsocket(conn, client, nil, stream)
+			return
+		}
+		if err != nil {
+			select {
+			case err = <-decodeErr:
+			default:
+			}
+			closeWebsocket(conn, client, err, stream)
+			return
+		}
+		data, err := compactMessage(client, msg)
+		if err != nil {
+			closeWebsocket(conn, client, err, stream)
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		if err = conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			return
+		}
+	}
+}
+
+// closeWebsocket finishes the websocket, a failed stream sends its status as a json frame first
+func closeWebsocket(conn *websocket.Conn, client *rpc.GrpcClient, err error, stream *rpc.Stream) {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if err == nil {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		return
+	}
+	stat, fromServer := errors.FromError(err)
+	code := int32(RemoteCallFailed)
+	if !fromServer {
+		code = ArgsParseFailed
+	}
+	r := &res{Code: code, Msg: stat.Message()}
+	if fromServer {
+		var trailer metadata.MD
+		if stream != nil {
+			trailer = stream.Trailer()
+		}
+		r.Data = newStatusData(client, stat, trailer)
+	}
+	data, _ := json.Marshal(r)
+	conn.WriteMessage(websocket.TextMessage, data)
+	// close reasons are limited to 123 bytes
+	reason := stat.Code().String()
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, reason))
+}
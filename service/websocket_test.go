@@ -0,0 +1,116 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/wuranxu/light/conf"
+	"github.com/wuranxu/light/internal/service/etcd"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const reflectionInfo = "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"
+
+func dialWebsocket(t *testing.T, path string) *websocket.Conn {
+	lis, _, _ := startHealthServer(t)
+	var dialed int32
+	client, err := bufDialer(lis, &dialed)("reflection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	app.GET("/ws", func(ctx *gin.Context) {
+		websocketStream(ctx, client, etcd.Method{Path: path}, nil)
+	})
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestWebsocketStream_Bidi(t *testing.T) {
+	conn := dialWebsocket(t, reflectionInfo)
+	for i := 0; i < 2; i++ {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"listServices": ""}`)); err != nil {
+			t.Fatal(err)
+		}
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "grpc.health.v1.Health") {
+			t.Fatalf("unexpected response: %s", data)
+		}
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(CloseSendFrame)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected normal closure, got %v", err)
+	}
+}
+
+func TestWebsocketStream_ServerStream(t *testing.T) {
+	conn := dialWebsocket(t, healthWatch)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"service": ""}`)); err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "SERVING") {
+		t.Fatalf("unexpected response: %s", data)
+	}
+}
+
+func TestWebsocketStream_BadRequest(t *testing.T) {
+	conn := dialWebsocket(t, reflectionInfo)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"listServices": `)); err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r res
+	if err := json.Unmarshal(data, &r); err != nil || r.Code != ArgsParseFailed {
+		t.Fatalf("expected ArgsParseFailed frame, got %s", data)
+	}
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseInternalServerErr) {
+		t.Fatalf("expected error closure, got %v", err)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	allowed := conf.Conf.Gateway.AllowedOrigins
+	defer func() { conf.Conf.Gateway.AllowedOrigins = allowed }()
+	conf.Conf.Gateway.AllowedOrigins = []string{"https://admin.example.com/"}
+	cases := map[string]bool{
+		"":                          true,
+		"http://gateway:8080":       true,
+		"https://admin.example.com": true,
+		"https://evil.example.com":  false,
+		"http://gateway:9090":       false,
+	}
+	for origin, expected := range cases {
+		req := httptest.NewRequest(http.MethodGet, "http://gateway:8080/ws", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if got := checkOrigin(req); got != expected {
+			t.Errorf("origin %q: expected %v, got %v", origin, expected, got)
+		}
+	}
+}